@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/getsentry/sentry-go"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/slack-go/slack"
 
 	"github.com/anthropics/anthropic-sdk-go"
@@ -13,73 +17,167 @@ import (
 
 type ToolHandler interface {
 	GetName() string
+	GetDescription() string
+	GetInputSchema() anthropic.ToolInputSchemaParam
 	HandleTool(
+		ctx context.Context,
 		input json.RawMessage,
 	) (*string, error)
 }
 
 func newTemplateToolHandler(
 	name string,
-	handleTool func(input json.RawMessage) (*string, error),
+	description string,
+	inputSchema anthropic.ToolInputSchemaParam,
+	handleTool func(ctx context.Context, input json.RawMessage) (*string, error),
 ) ToolHandler {
 	return &templateToolHandler{
-		name:       name,
-		handleTool: handleTool,
+		name:        name,
+		description: description,
+		inputSchema: inputSchema,
+		handleTool:  handleTool,
 	}
 }
 
 type templateToolHandler struct {
-	name       string
-	handleTool func(input json.RawMessage) (*string, error)
+	name        string
+	description string
+	inputSchema anthropic.ToolInputSchemaParam
+	handleTool  func(ctx context.Context, input json.RawMessage) (*string, error)
 }
 
 func (h *templateToolHandler) GetName() string {
 	return h.name
 }
 
-func (h *templateToolHandler) HandleTool(input json.RawMessage) (*string, error) {
-	return h.handleTool(input)
+func (h *templateToolHandler) GetDescription() string {
+	return h.description
 }
 
+func (h *templateToolHandler) GetInputSchema() anthropic.ToolInputSchemaParam {
+	return h.inputSchema
+}
+
+func (h *templateToolHandler) HandleTool(ctx context.Context, input json.RawMessage) (*string, error) {
+	return h.handleTool(ctx, input)
+}
+
+// CreateToolHandler creates a tool whose input schema is generated from T,
+// see inputSchemaFor for the struct tags that are understood.
 func CreateToolHandler[T any](
 	name string,
+	description string,
 	handleTool func(input T) (*string, error),
 ) ToolHandler {
-	handler := func(input json.RawMessage) (*string, error) {
+	return CreateContextToolHandler(name, description, func(ctx context.Context, input T) (*string, error) {
+		return handleTool(input)
+	})
+}
+
+// CreateContextToolHandler is CreateToolHandler for tools that need the
+// context of the turn, for example the conversation they were called from.
+func CreateContextToolHandler[T any](
+	name string,
+	description string,
+	handleTool func(ctx context.Context, input T) (*string, error),
+) ToolHandler {
+	handler := func(ctx context.Context, input json.RawMessage) (*string, error) {
 		var toolInput T
 		err := json.Unmarshal(input, &toolInput)
 		if err != nil {
 			return nil, errors.Wrap(err, "failed to unmarshal input")
 		}
-		return handleTool(toolInput)
+		return handleTool(ctx, toolInput)
 	}
-	return newTemplateToolHandler(name, handler)
+	return newTemplateToolHandler(name, description, inputSchemaFor[T](), handler)
 }
 
+// messageHandler runs the tools a model reply asks for and stores the turn.
+// It does not care which provider the reply came from.
 type messageHandler interface {
 	HandleMessage(
-		message *anthropic.Message,
+		ctx context.Context,
+		turn assistantTurn,
 		messageStore MessageStore,
 		conversationID string,
 	) (*LLMResponse, error)
+	ToolParams(ctx context.Context) []anthropic.ToolUnionParam
+}
+
+// assistantTurn is a reply from the model. Conversations are stored as
+// anthropic message params whichever provider they are sent to, so providers
+// convert their replies into this.
+type assistantTurn struct {
+	Message      anthropic.MessageParam
+	InputTokens  int64
+	OutputTokens int64
 }
 
+// anthropicTurn converts a reply from the Anthropic API.
+func anthropicTurn(message *anthropic.Message) assistantTurn {
+	return assistantTurn{
+		Message:      message.ToParam(),
+		InputTokens:  message.Usage.InputTokens,
+		OutputTokens: message.Usage.OutputTokens,
+	}
+}
+
+// toolCall is one tool the model asked for.
+type toolCall struct {
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+}
+
+// AnthropicMessageHandler is the messageHandler for every provider, the name
+// is from when Anthropic was the only one.
 type AnthropicMessageHandler struct {
 	tools map[string]ToolHandler
+	// toolNames keeps the registration order so the tool list sent to the
+	// model is stable between calls.
+	toolNames []string
+	// parallelism is how many tool calls from one turn run at the same time.
+	parallelism int
 }
 
 func NewAnthropicMessageHandler(
 	tools []ToolHandler,
 ) *AnthropicMessageHandler {
 	toolsMap := make(map[string]ToolHandler)
+	toolNames := []string{}
 	for _, tool := range tools {
+		if _, ok := toolsMap[tool.GetName()]; !ok {
+			toolNames = append(toolNames, tool.GetName())
+		}
 		toolsMap[tool.GetName()] = tool
 	}
 	return &AnthropicMessageHandler{
-		tools: toolsMap,
+		tools:       toolsMap,
+		toolNames:   toolNames,
+		parallelism: envInt("TOOL_PARALLELISM", 4),
 	}
 }
 
+// ToolParams describes the tools allowed in ctx to the model.
+func (h *AnthropicMessageHandler) ToolParams(ctx context.Context) []anthropic.ToolUnionParam {
+	tools := make([]anthropic.ToolUnionParam, 0, len(h.toolNames))
+	for _, name := range h.toolNames {
+		if !toolAllowed(ctx, name) {
+			continue
+		}
+		tool := h.tools[name]
+		toolParam := anthropic.ToolParam{
+			Name:        tool.GetName(),
+			InputSchema: tool.GetInputSchema(),
+		}
+		if description := tool.GetDescription(); description != "" {
+			toolParam.Description = anthropic.String(description)
+		}
+		tools = append(tools, anthropic.ToolUnionParam{OfTool: &toolParam})
+	}
+	return tools
+}
+
 func (h *AnthropicMessageHandler) getTool(
 	name string,
 ) ToolHandler {
@@ -89,73 +187,161 @@ func (h *AnthropicMessageHandler) getTool(
 	return nil
 }
 
+// callTool runs the named tool. A panicking tool is reported to sentry and
+// returned as an error so the turn can carry on.
 func (h *AnthropicMessageHandler) callTool(
+	ctx context.Context,
 	name string,
 	input json.RawMessage,
-) (*string, error) {
+) (response *string, err error) {
 	tool := h.getTool(name)
 	if tool == nil {
-		return nil, errors.New("tool not found")
+		return nil, errors.Errorf("tool %q not found", name)
+	}
+	if !toolAllowed(ctx, name) {
+		return nil, errors.Errorf("tool %q is not allowed here", name)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			sentry.CurrentHub().Recover(r)
+			log.WithFields(log.Fields{"tool": name, "panic": r}).Error("tool panicked")
+			response, err = nil, errors.New("internal error")
+		}
+	}()
+	response, err = tool.HandleTool(ctx, input)
+	if err == nil && response == nil {
+		err = errors.New("tool returned nil")
+	}
+	return response, err
+}
+
+// toolOutcome is the result of one tool_use block.
+type toolOutcome struct {
+	response *string
+	err      error
+}
+
+// toolResult is the tool_result block for the outcome. Errors become is_error
+// results so the model can see what went wrong and try again.
+func (o toolOutcome) toolResult(toolUseID string) (anthropic.ContentBlockParamUnion, string) {
+	if o.err != nil {
+		response := "Error: " + o.err.Error()
+		return anthropic.NewToolResultBlock(toolUseID, response, true), response
 	}
-	return tool.HandleTool(input)
+	response := strings.TrimSpace(*o.response)
+	return anthropic.NewToolResultBlock(toolUseID, response, false), response
+}
+
+// callTools runs the tool calls concurrently, at most h.parallelism at a
+// time. Outcomes are returned in the same order as the calls.
+func (h *AnthropicMessageHandler) callTools(
+	ctx context.Context,
+	blocks []toolCall,
+) []toolOutcome {
+	parallelism := h.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	outcomes := make([]toolOutcome, len(blocks))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, block := range blocks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			start := time.Now()
+			response, err := h.callTool(ctx, block.Name, block.Input)
+			outcomes[i] = toolOutcome{response: response, err: err}
+			log.WithFields(log.Fields{
+				"reqID":     reqIDFromContext(ctx),
+				"tool":      block.Name,
+				"toolUseID": block.ID,
+				"duration":  time.Since(start).String(),
+				"error":     err,
+			}).Info("tool call")
+		}()
+	}
+	wg.Wait()
+	return outcomes
 }
 
 func (h *AnthropicMessageHandler) HandleMessage(
-	message *anthropic.Message,
+	ctx context.Context,
+	turn assistantTurn,
 	messageStore MessageStore,
 	conversationID string,
 ) (*LLMResponse, error) {
 
 	content := ""
-
-	for _, block := range message.Content {
-		switch block := block.AsAny().(type) {
-		case anthropic.TextBlock:
-			content += block.Text
+	thinking := []string{}
+	toolUses := []toolCall{}
+	for _, block := range turn.Message.Content {
+		switch {
+		case block.OfText != nil:
+			content += block.OfText.Text
 			content += "\n"
 
-		case anthropic.ThinkingBlock:
-			content += block.Thinking
-			content += "\n"
-		}
-	}
+		// thinking stays in the stored turn as it is, it is only shown
+		// where the thinking visibility allows
+		case block.OfThinking != nil:
+			thinking = append(thinking, block.OfThinking.Thinking)
 
-	toolResults := []anthropic.ContentBlockParamUnion{}
-	for _, block := range message.Content {
-		switch variant := block.AsAny().(type) {
-		case anthropic.ToolUseBlock:
+		case block.OfRedactedThinking != nil:
+			thinking = append(thinking, redactedThinkingNote)
 
-			maybeResponse, err := h.callTool(block.Name, variant.Input)
+		case block.OfToolUse != nil:
+			input, err := json.Marshal(block.OfToolUse.Input)
 			if err != nil {
-				return nil, errors.Wrap(err, "failed to call tool")
-			}
-
-			if maybeResponse == nil {
-				return nil, errors.New("tool returned nil")
+				return nil, errors.Wrap(err, "couldn't encode tool input")
 			}
-
-			response := *maybeResponse
-
-			content += "\n" + block.Name + ": \n" + response
-			content = strings.TrimSpace(content)
-			response = strings.TrimSpace(response)
-			toolResults = append(toolResults, anthropic.NewToolResultBlock(block.ID, response, false))
-
+			toolUses = append(toolUses, toolCall{ID: block.OfToolUse.ID, Name: block.OfToolUse.Name, Input: input})
+		}
+	}
+	if approvals := toolApprovalsFromContext(ctx); approvals != nil && len(approvals.pending(ctx, toolUses)) > 0 {
+		// the turn waits for someone to approve, the tool results are
+		// stored once they decide
+		if err := approvals.Request(ctx, conversationID, turn.Message, toolUses); err != nil {
+			return nil, errors.Wrap(err, "couldn't ask for tool approval")
 		}
+		return &LLMResponse{
+			Message:      content,
+			Thinking:     strings.Join(thinking, "\n\n"),
+			InputTokens:  turn.InputTokens,
+			OutputTokens: turn.OutputTokens,
+		}, nil
+	}
+	outcomes := h.callTools(withConversationID(ctx, conversationID), toolUses)
+
+	// every tool_use gets a tool_result, even when the tool failed, so the
+	// stored conversation stays valid for the next turn
+	toolResults := []anthropic.ContentBlockParamUnion{}
+	for i, block := range toolUses {
+		toolResult, response := outcomes[i].toolResult(block.ID)
+		content += "\n" + block.Name + ": \n" + response
+		content = strings.TrimSpace(content)
+		toolResults = append(toolResults, toolResult)
 	}
 
-	mesagesToStore := []anthropic.MessageParam{message.ToParam()}
+	// the reply isn't stored again as assistant text, a trailing assistant
+	// message is sent back as a prefill and that is rejected when thinking
+	// is on
+	mesagesToStore := []anthropic.MessageParam{turn.Message}
 	if len(toolResults) > 0 {
 		mesagesToStore = append(mesagesToStore, anthropic.NewUserMessage(toolResults...))
 	}
-	if strings.TrimSpace(content) != "" {
-		mesagesToStore = append(mesagesToStore, anthropic.NewAssistantMessage(anthropic.NewTextBlock(strings.TrimSpace(content))))
-	}
 
-	messageStore.AppendMessages(conversationID, mesagesToStore)
+	if err := messageStore.AppendMessages(conversationID, mesagesToStore); err != nil {
+		return nil, errors.Wrap(err, "couldn't store messages")
+	}
 	return &LLMResponse{
-		Message: content,
-		Loop:    len(toolResults) > 0,
+		Message:      content,
+		Thinking:     strings.Join(thinking, "\n\n"),
+		Loop:         len(toolResults) > 0,
+		InputTokens:  turn.InputTokens,
+		OutputTokens: turn.OutputTokens,
 	}, nil
 
 }
@@ -163,15 +349,20 @@ func (h *AnthropicMessageHandler) HandleMessage(
 // LLMInterface defines the interface for LLMs with a Prompt method.
 type LLMInterface interface {
 	Prompt(
+		ctx context.Context,
 		messages []anthropic.MessageParam,
 		messageStore MessageStore,
 		conversationID string,
 	) (*LLMResponse, error)
+	// Summarize condenses messages into notes that can stand in for them
+	// when a conversation outgrows the context window.
+	Summarize(ctx context.Context, messages []anthropic.MessageParam) (string, error)
 }
 
 // LLM is a struct that holds the anthropic client and any other config.
 type LLM struct {
 	client         anthropic.Client
+	model          anthropic.Model
 	messageHandler messageHandler
 }
 
@@ -181,104 +372,119 @@ func newLLM(
 ) *LLM {
 	return &LLM{
 		client:         client,
+		model:          anthropic.ModelClaude4Sonnet20250514,
 		messageHandler: messageHandler,
 	}
 }
 
 // Prompt implements the LLMInterface for LLM.
-func (l *LLM) Prompt(messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
-	toolParams := []anthropic.ToolParam{
-		{
-			Name:        "jwtdecode",
-			Description: anthropic.String("Decode a JWT token"),
-			InputSchema: anthropic.ToolInputSchemaParam{
-				Properties: map[string]interface{}{
-					"token": map[string]interface{}{
-						"type":        "string",
-						"description": "The JWT token to decode",
-					},
-				},
-			},
-		},
-		{
-			Name:        "quickjs",
-			Description: anthropic.String("Run a JavaScript function"),
-			InputSchema: anthropic.ToolInputSchemaParam{
-				Properties: map[string]interface{}{
-					"code": map[string]interface{}{
-						"type": "string",
-						"description": `The JavaScript code to run. console.log does not work. return the value at the end of the script to get the outcome of the sciprt
-console.log("hello world") // does not work 
-"hello" // this works
-
-
-the above script would return "hello"
-						`,
-					},
-				},
-			},
-		},
-		{
-			Name:        "postgres_query",
-			Description: anthropic.String("Run a PostgreSQL query"),
-			InputSchema: anthropic.ToolInputSchemaParam{
-				Properties: map[string]interface{}{
-					"query": map[string]interface{}{
-						"type":        "string",
-						"description": "The PostgreSQL query to run. inspect the database schema to see what tables and columns are available. use the schema to build your query.",
-					},
-				},
-			},
-		},
-	}
-
-	tools := make([]anthropic.ToolUnionParam, len(toolParams))
-	for i, toolParam := range toolParams {
-		tools[i] = anthropic.ToolUnionParam{OfTool: &toolParam}
-	}
-
-	message, err := l.client.Messages.New(context.TODO(), anthropic.MessageNewParams{
-		Model:     anthropic.ModelClaude4Sonnet20250514,
+func (l *LLM) Prompt(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+	params := anthropic.MessageNewParams{
+		Model:     anthropic.Model(modelFor(ctx, string(l.model))),
 		MaxTokens: 20_000,
 		Messages:  messages,
-		Tools:     tools,
-		Thinking: anthropic.ThinkingConfigParamUnion{
-			OfEnabled: &anthropic.ThinkingConfigEnabledParam{BudgetTokens: 5_000}},
-		System: []anthropic.TextBlockParam{
-			{
-				Text: "your responses are going to be going to slack, so use that format for your responses",
-			},
-			{
-				Text: "text like this **bold** is not supported in slack, it just shows the starts, so use a different way to organize your text",
-			},
-		},
-	})
+		Tools:     l.messageHandler.ToolParams(ctx),
+		System:    systemPromptParams(ctx),
+	}
+	if budget := thinkingBudgetFor(ctx, 5_000); budget > 0 {
+		params.Thinking = anthropic.ThinkingConfigParamUnion{
+			OfEnabled: &anthropic.ThinkingConfigEnabledParam{BudgetTokens: budget}}
+		// max_tokens has to leave room for the answer after thinking
+		if params.MaxTokens < budget+5_000 {
+			params.MaxTokens = budget + 5_000
+		}
+	}
 
+	onText := textStreamFromContext(ctx)
+	if _, err := anthropic.CalculateNonStreamingTimeout(int(params.MaxTokens), params.Model, nil); onText == nil && err != nil {
+		// the SDK refuses long non-streaming requests, which a persona's
+		// model or thinking budget can make this one
+		onText = func(string) {}
+	}
+	var message *anthropic.Message
+	var err error
+	if onText != nil {
+		message, err = l.stream(ctx, params, onText)
+	} else {
+		message, err = l.client.Messages.New(ctx, params)
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "couldn't create message")
 	}
-	resp, err := l.messageHandler.HandleMessage(message, messageStore, conversationID)
+	resp, err := l.messageHandler.HandleMessage(ctx, anthropicTurn(message), messageStore, conversationID)
 	if err != nil {
 		return nil, errors.Wrap(err, "couldn't handle message")
 	}
 	return resp, nil
 }
 
+// stream creates the message with the streaming API, passing text deltas to
+// onText as they arrive and returning the accumulated message.
+func (l *LLM) stream(
+	ctx context.Context,
+	params anthropic.MessageNewParams,
+	onText func(text string),
+) (*anthropic.Message, error) {
+	stream := l.client.Messages.NewStreaming(ctx, params)
+	defer stream.Close()
+
+	message := anthropic.Message{}
+	for stream.Next() {
+		event := stream.Current()
+		if err := message.Accumulate(event); err != nil {
+			return nil, errors.Wrap(err, "couldn't accumulate stream event")
+		}
+		if ev, ok := event.AsAny().(anthropic.ContentBlockDeltaEvent); ok {
+			if delta, ok := ev.Delta.AsAny().(anthropic.TextDelta); ok {
+				onText(delta.Text)
+			}
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, errors.Wrap(err, "couldn't stream message")
+	}
+	return &message, nil
+}
+
 // NewLLM returns a new LLM struct implementing LLMInterface.
 func NewLLM(client anthropic.Client, messageHandler messageHandler) *LLM {
-	return &LLM{client: client, messageHandler: messageHandler}
+	return newLLM(client, messageHandler)
+}
+
+// systemPrompt is sent with every conversation, whichever provider it goes
+// to.
+var systemPrompt = []string{
+	"your responses are posted to slack. write them in markdown, headings, tables, code blocks and links are converted to slack formatting before they are posted",
+}
+
+func systemPromptParams(ctx context.Context) []anthropic.TextBlockParam {
+	prompt := systemPromptFor(ctx)
+	params := make([]anthropic.TextBlockParam, 0, len(prompt))
+	for _, text := range prompt {
+		params = append(params, anthropic.TextBlockParam{Text: text})
+	}
+	return params
 }
 
 type LLMResponse struct {
 	Message string
-	Loop    bool
+	// Thinking is the model's extended thinking, it is kept out of Message.
+	Thinking string
+	Loop     bool
+	// InputTokens and OutputTokens are the usage reported for the LLM call.
+	InputTokens  int64
+	OutputTokens int64
 }
 
 type MessageStore interface {
-	CallLLM(conversationID string, text string) (*LLMResponse, error)
+	CallLLM(ctx context.Context, conversationID string, text string) (*LLMResponse, error)
 	AppendMessages(conversationID string, message []anthropic.MessageParam) error
 	GetMessages() map[string][]anthropic.MessageParam
+	// HasConversation reports whether anything has been stored for the
+	// conversation.
+	HasConversation(conversationID string) (bool, error)
 	Loop(
+		ctx context.Context,
 		conversationID string,
 		api *slack.Client,
 		reqID string,
@@ -287,24 +493,42 @@ type MessageStore interface {
 
 var _ MessageStore = &SlackMessageStore{}
 
+// SlackMessageStore keeps conversations in memory. Turns are serialized per
+// conversation, so CallLLM and Loop for the same conversation never run at
+// the same time.
 type SlackMessageStore struct {
-	messages map[string][]anthropic.MessageParam
-	llm      LLMInterface
+	mu        sync.RWMutex
+	messages  map[string][]anthropic.MessageParam
+	llm       LLMInterface
+	turns     keyedMutex
+	compactor *contextCompactor
 }
 
-func (s *SlackMessageStore) CallLLM(conversationID string, text string) (*LLMResponse, error) {
+// conversation returns a copy of the conversation's messages.
+func (s *SlackMessageStore) conversation(conversationID string) []anthropic.MessageParam {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]anthropic.MessageParam{}, s.messages[conversationID]...)
+}
+
+func (s *SlackMessageStore) CallLLM(ctx context.Context, conversationID string, text string) (*LLMResponse, error) {
+	unlock := s.turns.Lock(conversationID)
+	defer unlock()
+
 	if strings.TrimSpace(text) != "" {
-		s.messages[conversationID] = append(s.messages[conversationID], anthropic.NewUserMessage(anthropic.NewTextBlock(strings.TrimSpace(text))))
+		s.AppendMessages(conversationID, []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock(strings.TrimSpace(text)))})
 	}
 
-	if len(s.messages[conversationID]) == 0 {
+	messages := s.compact(ctx, conversationID, s.conversation(conversationID))
+	if len(messages) == 0 {
 		return &LLMResponse{
 			Message: "I can't respond to an empty message. Please provide some input. keep your outputs basic and text only since no formatting is applied.",
 			Loop:    false,
 		}, nil
 	}
 	message, err := s.llm.Prompt(
-		s.messages[conversationID],
+		ctx,
+		messages,
 		s,
 		conversationID,
 	)
@@ -316,21 +540,53 @@ func (s *SlackMessageStore) CallLLM(conversationID string, text string) (*LLMRes
 }
 
 func (s *SlackMessageStore) AppendMessages(conversationID string, message []anthropic.MessageParam) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.messages[conversationID] = append(s.messages[conversationID], message...)
 	return nil
 }
 
+// compact keeps the conversation inside the context window, storing the
+// compacted messages in place of the old ones.
+func (s *SlackMessageStore) compact(ctx context.Context, conversationID string, messages []anthropic.MessageParam) []anthropic.MessageParam {
+	messages, changed := s.compactor.Compact(ctx, messages)
+	if changed {
+		s.mu.Lock()
+		s.messages[conversationID] = append([]anthropic.MessageParam{}, messages...)
+		s.mu.Unlock()
+	}
+	return messages
+}
+
+func (s *SlackMessageStore) HasConversation(conversationID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.messages[conversationID]) > 0, nil
+}
+
+// GetMessages returns a snapshot of every conversation.
 func (s *SlackMessageStore) GetMessages() map[string][]anthropic.MessageParam {
-	return s.messages
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messages := make(map[string][]anthropic.MessageParam, len(s.messages))
+	for conversationID, m := range s.messages {
+		messages[conversationID] = append([]anthropic.MessageParam{}, m...)
+	}
+	return messages
 }
 
 func (s *SlackMessageStore) Loop(
+	ctx context.Context,
 	conversationID string,
 	api *slack.Client,
 	reqID string,
 ) (*LLMResponse, error) {
+	unlock := s.turns.Lock(conversationID)
+	defer unlock()
+
 	message, err := s.llm.Prompt(
-		s.messages[conversationID],
+		ctx,
+		s.compact(ctx, conversationID, s.conversation(conversationID)),
 		s,
 		conversationID,
 	)
@@ -345,7 +601,8 @@ func NewSlackMessageStore(
 	llm LLMInterface,
 ) *SlackMessageStore {
 	return &SlackMessageStore{
-		messages: make(map[string][]anthropic.MessageParam),
-		llm:      llm,
+		messages:  make(map[string][]anthropic.MessageParam),
+		llm:       llm,
+		compactor: newContextCompactor(llm),
 	}
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// agentBudget bounds a single agent run, a zero value disables that limit.
+type agentBudget struct {
+	MaxIterations   int
+	MaxInputTokens  int64
+	MaxOutputTokens int64
+	MaxDuration     time.Duration
+}
+
+func agentBudgetFromEnv() agentBudget {
+	return agentBudget{
+		MaxIterations:   envInt("AGENT_MAX_ITERATIONS", 10),
+		MaxInputTokens:  int64(envInt("AGENT_MAX_INPUT_TOKENS", 500_000)),
+		MaxOutputTokens: int64(envInt("AGENT_MAX_OUTPUT_TOKENS", 100_000)),
+		MaxDuration:     envDuration("AGENT_MAX_DURATION", 5*time.Minute),
+	}
+}
+
+// agentOutput is where the agent loop publishes its replies.
+type agentOutput interface {
+	// Reply starts the reply to one LLM call. It returns the context to make
+	// the call with and a function that publishes the final text and the
+	// model's thinking, if any.
+	Reply(ctx context.Context) (context.Context, func(text string, thinking string))
+	// Status posts a message about the loop itself.
+	Status(text string)
+}
+
+type agentLoopResult struct {
+	Iterations   int
+	InputTokens  int64
+	OutputTokens int64
+	// Exhausted names the budget that stopped the loop, it is empty when the
+	// model finished on its own.
+	Exhausted string
+}
+
+// agentLoop keeps calling the LLM while it asks for tools, until the model
+// is done or the budget runs out.
+type agentLoop struct {
+	messageStore MessageStore
+	budget       agentBudget
+}
+
+func newAgentLoop(messageStore MessageStore, budget agentBudget) *agentLoop {
+	return &agentLoop{
+		messageStore: messageStore,
+		budget:       budget,
+	}
+}
+
+// Run sends text to the conversation and drives the loop. Every response is
+// published through output, when a budget runs out a single status message
+// is posted. Errors are reported to sentry, published as a short reply and
+// returned. With empty text the conversation goes on from what is stored,
+// a turn paused for tool approval resumes that way.
+func (a *agentLoop) Run(
+	ctx context.Context,
+	conversationID string,
+	text string,
+	api *slack.Client,
+	reqID string,
+	output agentOutput,
+) (*agentLoopResult, error) {
+	start := time.Now()
+	if a.budget.MaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.budget.MaxDuration)
+		defer cancel()
+	}
+
+	result := &agentLoopResult{}
+	for {
+		if result.Exhausted = a.exhausted(result, start); result.Exhausted != "" {
+			output.Status(result.status())
+			return result, nil
+		}
+
+		callCtx, finish := output.Reply(ctx)
+		resp, err := a.step(callCtx, result.Iterations == 0 && text != "", conversationID, text, api, reqID)
+		result.Iterations++
+		if err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				result.Exhausted = "time"
+				finish(result.status(), "")
+				return result, nil
+			}
+			eventID := sentry.CaptureException(err)
+			finish(errorReply(eventID), "")
+			return result, err
+		}
+		if resp == nil {
+			finish("", "")
+			return result, nil
+		}
+		finish(resp.Message, resp.Thinking)
+
+		result.InputTokens += resp.InputTokens
+		result.OutputTokens += resp.OutputTokens
+		if !resp.Loop {
+			return result, nil
+		}
+	}
+}
+
+// step makes one LLM call, a panic is turned into an error.
+func (a *agentLoop) step(
+	ctx context.Context,
+	first bool,
+	conversationID string,
+	text string,
+	api *slack.Client,
+	reqID string,
+) (resp *LLMResponse, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp, err = nil, errors.Errorf("panic: %v", r)
+		}
+	}()
+	if first {
+		return a.messageStore.CallLLM(ctx, conversationID, text)
+	}
+	return a.messageStore.Loop(ctx, conversationID, api, reqID)
+}
+
+// errorReply is the short message shown in slack when a turn fails, the
+// details go to sentry.
+func errorReply(eventID *sentry.EventID) string {
+	if eventID == nil {
+		return "Sorry, something went wrong while answering. Reply to try again."
+	}
+	return fmt.Sprintf("Sorry, something went wrong while answering (ref %s). Reply to try again.", *eventID)
+}
+
+// exhausted returns the name of the first budget that has run out.
+func (a *agentLoop) exhausted(result *agentLoopResult, start time.Time) string {
+	switch {
+	case a.budget.MaxIterations > 0 && result.Iterations >= a.budget.MaxIterations:
+		return "iteration"
+	case a.budget.MaxInputTokens > 0 && result.InputTokens >= a.budget.MaxInputTokens:
+		return "input token"
+	case a.budget.MaxOutputTokens > 0 && result.OutputTokens >= a.budget.MaxOutputTokens:
+		return "output token"
+	case a.budget.MaxDuration > 0 && time.Since(start) >= a.budget.MaxDuration:
+		return "time"
+	}
+	return ""
+}
+
+func (r *agentLoopResult) status() string {
+	return fmt.Sprintf(
+		"Stopped after %d steps because the %s budget ran out (%d input / %d output tokens used). Reply to let me continue.",
+		r.Iterations,
+		r.Exhausted,
+		r.InputTokens,
+		r.OutputTokens,
+	)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// recordingOutput collects what the agent loop publishes.
+type recordingOutput struct {
+	replies []string
+	status  []string
+}
+
+func (o *recordingOutput) Reply(ctx context.Context) (context.Context, func(text string, thinking string)) {
+	return ctx, func(text string, thinking string) { o.replies = append(o.replies, text) }
+}
+
+func (o *recordingOutput) Status(text string) {
+	o.status = append(o.status, text)
+}
+
+func Test_agentLoop_Run(t *testing.T) {
+	tests := []struct {
+		name           string
+		budget         agentBudget
+		loops          int
+		delay          time.Duration
+		wantIterations int
+		wantExhausted  string
+	}{
+		{
+			name:           "finishes on its own",
+			budget:         agentBudget{MaxIterations: 10},
+			loops:          3,
+			wantIterations: 4,
+		},
+		{
+			name:           "iteration budget",
+			budget:         agentBudget{MaxIterations: 3},
+			loops:          100,
+			wantIterations: 3,
+			wantExhausted:  "iteration",
+		},
+		{
+			name:           "output token budget",
+			budget:         agentBudget{MaxIterations: 10, MaxOutputTokens: 250},
+			loops:          100,
+			wantIterations: 3,
+			wantExhausted:  "output token",
+		},
+		{
+			name:           "time budget",
+			budget:         agentBudget{MaxIterations: 10, MaxDuration: 50 * time.Millisecond},
+			loops:          100,
+			delay:          30 * time.Millisecond,
+			wantIterations: 2,
+			wantExhausted:  "time",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			llm := &mockLLM{fn: func(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+				calls++
+				select {
+				case <-time.After(tt.delay):
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+				return &LLMResponse{Message: "step", Loop: calls <= tt.loops, InputTokens: 100, OutputTokens: 100}, nil
+			}}
+			output := &recordingOutput{}
+			result, err := newAgentLoop(NewSlackMessageStore(llm), tt.budget).Run(context.Background(), "test", "hello", nil, "req", output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Iterations != tt.wantIterations {
+				t.Errorf("Run() iterations = %d, want %d", result.Iterations, tt.wantIterations)
+			}
+			if result.Exhausted != tt.wantExhausted {
+				t.Errorf("Run() exhausted = %q, want %q", result.Exhausted, tt.wantExhausted)
+			}
+			statusMessages := len(output.status)
+			for _, reply := range output.replies {
+				if strings.HasPrefix(reply, "Stopped after") {
+					statusMessages++
+				}
+			}
+			if wantStatus := map[bool]int{true: 1, false: 0}[tt.wantExhausted != ""]; statusMessages != wantStatus {
+				t.Errorf("Run() posted %d status messages, want %d", statusMessages, wantStatus)
+			}
+		})
+	}
+}
@@ -1,25 +1,41 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/pkg/errors"
 )
 
 // Add this mock type to allow function-based mocking of LLMInterface
 // mockLLM implements LLMInterface for testing
 
 type mockLLM struct {
-	fn func(messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error)
+	fn        func(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error)
+	summarize func(ctx context.Context, messages []anthropic.MessageParam) (string, error)
 }
 
-func (m *mockLLM) Prompt(messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
-	return m.fn(messages, messageStore, conversationID)
+func (m *mockLLM) Prompt(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+	return m.fn(ctx, messages, messageStore, conversationID)
+}
+
+func (m *mockLLM) Summarize(ctx context.Context, messages []anthropic.MessageParam) (string, error) {
+	if m.summarize == nil {
+		return "", errors.New("mockLLM can't summarize")
+	}
+	return m.summarize(ctx, messages)
 }
 
 func zip[T any](a, b []T) [][]T {
 	acc := make([][]T, 0, len(a))
-	for i := 0; i < len(a); i++ {
+	for i := 0; i < len(a) && i < len(b); i++ {
 		acc = append(acc, []T{a[i], b[i]})
 	}
 	return acc
@@ -46,7 +62,7 @@ func TestSlackMessageStore_AppendMessages(t *testing.T) {
 			name: "test",
 			fields: fields{
 				messages: make(map[string][]anthropic.MessageParam),
-				llm: &mockLLM{fn: func(messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+				llm: &mockLLM{fn: func(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
 					return &LLMResponse{Message: "test", Loop: false}, nil
 				}},
 			},
@@ -66,7 +82,7 @@ func TestSlackMessageStore_AppendMessages(t *testing.T) {
 				messages: map[string][]anthropic.MessageParam{
 					"test": {anthropic.NewUserMessage(anthropic.NewTextBlock("test"))},
 				},
-				llm: &mockLLM{fn: func(messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+				llm: &mockLLM{fn: func(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
 					return &LLMResponse{Message: "test", Loop: false}, nil
 				}},
 			},
@@ -83,41 +99,93 @@ func TestSlackMessageStore_AppendMessages(t *testing.T) {
 		},
 	}
 	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			s := &SlackMessageStore{
-				messages: tt.fields.messages,
-				llm:      tt.fields.llm,
-			}
-			if err := s.AppendMessages(tt.args.conversationID, tt.args.message); (err != nil) != tt.wantErr {
-				t.Errorf("SlackMessageStore.AppendMessages() error = %v, wantErr %v", err, tt.wantErr)
-			}
-			gotMessages := zip(tt.fields.messages[tt.args.conversationID], tt.expectedMessages)
-			for _, messages := range gotMessages {
-				got := messages[0]
-				want := messages[1]
-				if got.Role != want.Role {
-					t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", got, want)
+		for storeName, s := range newTestMessageStores(t, tt.fields.messages, tt.fields.llm, tt.args.conversationID) {
+			t.Run(tt.name+"/"+storeName, func(t *testing.T) {
+				if err := s.AppendMessages(tt.args.conversationID, tt.args.message); (err != nil) != tt.wantErr {
+					t.Errorf("SlackMessageStore.AppendMessages() error = %v, wantErr %v", err, tt.wantErr)
 				}
-				zippedContent := zip(got.Content, want.Content)
-				for _, content := range zippedContent {
-					gotContent := content[0]
-					wantContent := content[1]
-					if gotContent.OfText.Text != wantContent.OfText.Text {
-						t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", gotContent, wantContent)
-					}
-					// if gotContent.OfThinking.Thinking != wantContent.OfThinking.Thinking {
-					// 	t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", gotContent, wantContent)
-					// }
-					// if gotContent.OfToolResult.Content[0].OfText.Text != wantContent.OfToolResult.Content[0].OfText.Text {
-					// 	t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", gotContent, wantContent)
-					// }
-
+				if got := len(s.GetMessages()[tt.args.conversationID]); got != len(tt.expectedMessages) {
+					t.Errorf("SlackMessageStore.AppendMessages() stored %d messages, want %d", got, len(tt.expectedMessages))
 				}
-			}
+				assertMessagesEqual(t, s.GetMessages()[tt.args.conversationID], tt.expectedMessages)
+			})
+		}
+	}
+
+}
+
+// newTestMessageStores returns every MessageStore implementation seeded with
+// messages. The postgres store is only included when TEST_DATABASE_URL is set,
+// the conversations in resetIDs are deleted from it before seeding.
+func newTestMessageStores(
+	t *testing.T,
+	messages map[string][]anthropic.MessageParam,
+	llm LLMInterface,
+	resetIDs ...string,
+) map[string]MessageStore {
+	t.Helper()
+	stores := map[string]MessageStore{}
 
-		})
+	memory := NewSlackMessageStore(llm)
+	for conversationID, m := range messages {
+		memory.messages[conversationID] = append([]anthropic.MessageParam{}, m...)
 	}
+	stores["memory"] = memory
 
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		return stores
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	postgres, err := NewPostgresMessageStore(db, llm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for conversationID := range messages {
+		resetIDs = append(resetIDs, conversationID)
+	}
+	for _, conversationID := range resetIDs {
+		if _, err := db.Exec(`DELETE FROM agent_conversations WHERE conversation_id = $1`, conversationID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for conversationID, m := range messages {
+		if err := postgres.AppendMessages(conversationID, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stores["postgres"] = postgres
+	return stores
+}
+
+func assertMessagesEqual(t *testing.T, gotMessages []anthropic.MessageParam, expectedMessages []anthropic.MessageParam) {
+	t.Helper()
+	for _, messages := range zip(gotMessages, expectedMessages) {
+		got := messages[0]
+		want := messages[1]
+		if got.Role != want.Role {
+			t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", got, want)
+		}
+		zippedContent := zip(got.Content, want.Content)
+		for _, content := range zippedContent {
+			gotContent := content[0]
+			wantContent := content[1]
+			if gotContent.OfText.Text != wantContent.OfText.Text {
+				t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", gotContent, wantContent)
+			}
+			// if gotContent.OfThinking.Thinking != wantContent.OfThinking.Thinking {
+			// 	t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", gotContent, wantContent)
+			// }
+			// if gotContent.OfToolResult.Content[0].OfText.Text != wantContent.OfToolResult.Content[0].OfText.Text {
+			// 	t.Errorf("SlackMessageStore.AppendMessages() = %v, want %v", gotContent, wantContent)
+			// }
+
+		}
+	}
 }
 
 // func Test_handleMessage(t *testing.T) {
@@ -203,3 +271,121 @@ func TestSlackMessageStore_AppendMessages(t *testing.T) {
 // 		})
 // 	}
 // }
+
+func TestAnthropicMessageHandler_HandleMessageParallelTools(t *testing.T) {
+	var message anthropic.Message
+	err := json.Unmarshal([]byte(`{
+		"id": "msg_1", "type": "message", "role": "assistant", "model": "claude",
+		"content": [
+			{"type": "tool_use", "id": "toolu_1", "name": "sleep", "input": {"ms": 60, "text": "one"}},
+			{"type": "tool_use", "id": "toolu_2", "name": "sleep", "input": {"ms": 10, "text": "two"}},
+			{"type": "tool_use", "id": "toolu_3", "name": "sleep", "input": {"ms": 30, "text": "three"}},
+			{"type": "tool_use", "id": "toolu_4", "name": "sleep", "input": {"ms": 1, "text": "four"}}
+		],
+		"usage": {"input_tokens": 1, "output_tokens": 1}
+	}`), &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var running, maxRunning atomic.Int32
+	handler := NewAnthropicMessageHandler([]ToolHandler{
+		CreateToolHandler("sleep", "Sleep then echo", func(input struct {
+			Ms   int    `json:"ms"`
+			Text string `json:"text"`
+		}) (*string, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			for {
+				m := maxRunning.Load()
+				if n <= m || maxRunning.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Duration(input.Ms) * time.Millisecond)
+			return &input.Text, nil
+		}),
+	})
+	handler.parallelism = 3
+
+	store := NewSlackMessageStore(nil)
+	resp, err := handler.HandleMessage(context.Background(), anthropicTurn(&message), store, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Loop {
+		t.Errorf("HandleMessage() Loop = false, want true")
+	}
+	if got := maxRunning.Load(); got != 3 {
+		t.Errorf("ran %d tools at once, want 3", got)
+	}
+
+	results := store.GetMessages()["test"][1].Content
+	for i, want := range []string{"one", "two", "three", "four"} {
+		result := results[i].OfToolResult
+		if result.ToolUseID != fmt.Sprintf("toolu_%d", i+1) || result.Content[0].OfText.Text != want {
+			t.Errorf("tool result %d = %s %q, want toolu_%d %q", i, result.ToolUseID, result.Content[0].OfText.Text, i+1, want)
+		}
+	}
+}
+
+func TestAnthropicMessageHandler_HandleMessageToolErrors(t *testing.T) {
+	var message anthropic.Message
+	err := json.Unmarshal([]byte(`{
+		"id": "msg_1", "type": "message", "role": "assistant", "model": "claude",
+		"content": [
+			{"type": "tool_use", "id": "toolu_1", "name": "missing", "input": {}},
+			{"type": "tool_use", "id": "toolu_2", "name": "jwtdecode", "input": {"token": 42}},
+			{"type": "tool_use", "id": "toolu_3", "name": "jwtdecode", "input": {"token": "not a jwt"}},
+			{"type": "tool_use", "id": "toolu_4", "name": "panics", "input": {}},
+			{"type": "tool_use", "id": "toolu_5", "name": "nothing", "input": {}},
+			{"type": "tool_use", "id": "toolu_6", "name": "ok", "input": {}}
+		],
+		"usage": {"input_tokens": 1, "output_tokens": 1}
+	}`), &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := "fine"
+	handler := NewAnthropicMessageHandler([]ToolHandler{
+		CreateToolHandler("jwtdecode", "Decode a JWT token", func(input struct {
+			Token string `json:"token"`
+		}) (*string, error) {
+			response, err := jwtdecode(input.Token)
+			return &response, err
+		}),
+		CreateToolHandler("panics", "Panics", func(input struct{}) (*string, error) {
+			panic("boom")
+		}),
+		CreateToolHandler("nothing", "Returns nil", func(input struct{}) (*string, error) {
+			return nil, nil
+		}),
+		CreateToolHandler("ok", "Works", func(input struct{}) (*string, error) {
+			return &ok, nil
+		}),
+	})
+
+	store := NewSlackMessageStore(nil)
+	resp, err := handler.HandleMessage(context.Background(), anthropicTurn(&message), store, "test")
+	if err != nil {
+		t.Fatalf("HandleMessage() error = %v, want tool errors returned to the model", err)
+	}
+	if !resp.Loop {
+		t.Errorf("HandleMessage() Loop = false, want true")
+	}
+
+	results := store.GetMessages()["test"][1].Content
+	if len(results) != 6 {
+		t.Fatalf("stored %d tool results, want 6", len(results))
+	}
+	for i, result := range results {
+		wantError := i < 5
+		if got := result.OfToolResult.IsError.Value; got != wantError {
+			t.Errorf("tool result %s is_error = %v, want %v", result.OfToolResult.ToolUseID, got, wantError)
+		}
+	}
+	if got := results[0].OfToolResult.Content[0].OfText.Text; got != `Error: tool "missing" not found` {
+		t.Errorf("unknown tool result = %q", got)
+	}
+}
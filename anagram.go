@@ -2,12 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"embed"
 	"fmt"
 	"log"
-	"net/http"
 	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/slack-go/slack"
 )
 
@@ -98,29 +99,44 @@ func allAnagrams(word string) Anagrams {
 	return ans
 }
 
-func anagram(s slack.SlashCommand, api *slack.Client, w http.ResponseWriter) {
+// findAnagrams returns every way to spell letters as one or more words,
+// letters is at most 8 characters because the search grows factorially.
+func findAnagrams(letters string) ([]string, error) {
+	if len(letters) > 8 {
+		return nil, errors.New("message too long, max 8 chars")
+	}
+	var items []string
+	for _, a := range allAnagrams(letters) {
+		items = append(items, strings.Join(a, " "))
+	}
+	return items, nil
+}
+
+func anagram(s slack.SlashCommand, api *slack.Client) (string, error) {
 	if len(s.Text) > 8 {
-		logErrMsgSlack(w, "message too long, max 8 chars")
-		return
+		return "", errors.New("message too long, max 8 chars")
 	}
 
 	// slack wants a fast response, anagrams can take a while to find,
 	// dm user anagrams after found and respond right away
-	logErrMsgSlack(w, "searching...\nwill dm when finished")
-
 	go func() {
-		anagrams := allAnagrams(s.Text)
-		var items []string
-		for _, a := range anagrams {
-			items = append(items, strings.Join(a, " "))
+		items, err := findAnagrams(s.Text)
+		if err != nil {
+			log.Println(err)
+			return
 		}
-		_, _, err := api.PostMessage(
+		err = newSlackPoster(api).Post(
+			context.Background(),
 			s.UserID,
-			slack.MsgOptionText("```\n"+strings.Join(items, "\n")+"\n```", false),
+			"",
+			"```\n"+strings.Join(items, "\n")+"\n```",
+			"anagrams.txt",
+			nil,
 			slack.MsgOptionAsUser(true), // Add this if you want that the bot would post message as a user, otherwise it will send response using the default slackbot
 		)
 		if err != nil {
 			log.Println(err)
 		}
 	}()
+	return "searching...\nwill dm when finished", nil
 }
@@ -7,5 +7,17 @@ import (
 )
 
 func b64(s slack.SlashCommand) string {
-	return base64.StdEncoding.EncodeToString([]byte(s.Text))
+	return base64Encode(s.Text)
+}
+
+func base64Encode(text string) string {
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+func base64Decode(text string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(text)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
 }
@@ -2,39 +2,42 @@ package main
 
 import (
 	"math/rand"
-	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/pkg/errors"
 	"github.com/slack-go/slack"
 )
 
-func choose(s slack.SlashCommand, w http.ResponseWriter) {
-	var vals []string
-	if strings.Contains(s.Text, "\"") {
+func choose(s slack.SlashCommand) string {
+	msg, err := chooseOne(chooseOptions(s.Text))
+	if err != nil {
+		return err.Error()
+	}
+	return msg
+}
 
-		ss := strings.Split(s.Text, "\"")
-		for _, s := range ss {
-			if s != "" && s != " " {
-				vals = append(vals, s)
-			}
+// chooseOptions splits text on spaces, or on quotes when it has any so
+// options can have spaces in them.
+func chooseOptions(text string) []string {
+	if !strings.Contains(text, "\"") {
+		return strings.Fields(text)
+	}
+	var vals []string
+	for _, s := range strings.Split(text, "\"") {
+		if strings.TrimSpace(s) != "" {
+			vals = append(vals, s)
 		}
-	} else {
-		vals = strings.Split(s.Text, " ")
 	}
-	rand.Seed(time.Now().Unix()) // initialize global pseudo random generator
-	source := rand.NewSource(time.Now().Unix())
-	r := rand.New(source) // initialize local pseudorandom generator
+	return vals
+}
 
-	var msg string
-	if len(vals) > 0 {
-		msg = vals[r.Intn(len(vals))]
-	} else {
-		msg = "nothing to choose from"
+// chooseOne picks one of options at random.
+func chooseOne(options []string) (string, error) {
+	if len(options) == 0 {
+		return "", errors.New("nothing to choose from")
 	}
-	logErrMsgSlack(w, msg)
-
+	return options[rand.Intn(len(options))], nil
 }
 
 type weightedChoice struct {
@@ -50,22 +53,9 @@ func atoi(s string) int {
 	return i
 }
 
-func wchoose(s slack.SlashCommand, w http.ResponseWriter) {
-	var vals []string
-	if strings.Contains(s.Text, "\"") {
-
-		ss := strings.Split(s.Text, "\"")
-		for _, s := range ss {
-			if s != "" && s != " " {
-				vals = append(vals, s)
-			}
-		}
-	} else {
-		vals = strings.Split(s.Text, " ")
-	}
-
+func wchoose(s slack.SlashCommand) string {
 	var choices []weightedChoice
-	for _, v := range vals {
+	for _, v := range chooseOptions(s.Text) {
 		if strings.Contains(v, ":") {
 			ss := strings.Split(v, ":")
 			choices = append(choices, weightedChoice{choice: ss[0], weight: atoi(ss[1])})
@@ -73,25 +63,32 @@ func wchoose(s slack.SlashCommand, w http.ResponseWriter) {
 			choices = append(choices, weightedChoice{choice: v, weight: 1})
 		}
 	}
+	msg, err := chooseWeighted(choices)
+	if err != nil {
+		return err.Error()
+	}
+	return msg
+}
 
-	choicesStr := []string{}
-
+// chooseWeighted picks one of choices at random, a choice with weight 3 is
+// three times as likely as one with weight 1.
+func chooseWeighted(choices []weightedChoice) (string, error) {
+	total := 0
 	for _, c := range choices {
-		for i := 0; i < c.weight; i++ {
-			choicesStr = append(choicesStr, c.choice)
+		if c.weight < 0 {
+			return "", errors.Errorf("weight of %s is negative", c.choice)
 		}
+		total += c.weight
 	}
-
-	rand.Seed(time.Now().Unix()) // initialize global pseudo random generator
-	source := rand.NewSource(time.Now().Unix())
-	r := rand.New(source) // initialize local pseudorandom generator
-
-	var msg string
-	if len(vals) > 0 {
-		msg = choicesStr[r.Intn(len(choicesStr))]
-	} else {
-		msg = "nothing to choose from"
+	if total == 0 {
+		return "", errors.New("nothing to choose from")
 	}
-	logErrMsgSlack(w, msg)
-
+	n := rand.Intn(total)
+	for _, c := range choices {
+		if n < c.weight {
+			return c.choice, nil
+		}
+		n -= c.weight
+	}
+	return "", errors.New("nothing to choose from")
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+// Command is a slash command. Run returns the response shown to the user,
+// errors are shown to the user too.
+type Command interface {
+	// GetName is the command with its slash, such as "/convert".
+	GetName() string
+	// GetUsage shows the arguments, such as "<value> <from> <to>".
+	GetUsage() string
+	GetDescription() string
+	GetExamples() []string
+	Run(ctx context.Context, s slack.SlashCommand) (*slack.Msg, error)
+}
+
+type templateCommand struct {
+	name        string
+	usage       string
+	description string
+	examples    []string
+	run         func(ctx context.Context, s slack.SlashCommand) (*slack.Msg, error)
+}
+
+func (c *templateCommand) GetName() string        { return c.name }
+func (c *templateCommand) GetUsage() string       { return c.usage }
+func (c *templateCommand) GetDescription() string { return c.description }
+func (c *templateCommand) GetExamples() []string  { return c.examples }
+
+func (c *templateCommand) Run(ctx context.Context, s slack.SlashCommand) (*slack.Msg, error) {
+	return c.run(ctx, s)
+}
+
+// newCommand creates a command whose response is plain text.
+func newCommand(
+	name string,
+	usage string,
+	description string,
+	examples []string,
+	run func(ctx context.Context, s slack.SlashCommand) (string, error),
+) Command {
+	return &templateCommand{
+		name:        name,
+		usage:       usage,
+		description: description,
+		examples:    examples,
+		run: func(ctx context.Context, s slack.SlashCommand) (*slack.Msg, error) {
+			text, err := run(ctx, s)
+			if err != nil {
+				return nil, err
+			}
+			return &slack.Msg{Text: text}, nil
+		},
+	}
+}
+
+// helpCommandName lists the commands, it is registered by
+// newCommandRegistry.
+const helpCommandName = "/lucksacks"
+
+// commandRegistry serves /slash. Requests are verified with the signing
+// secret and sent to the command registered under their name.
+type commandRegistry struct {
+	signingSecret string
+	commands      map[string]Command
+}
+
+func newCommandRegistry(signingSecret string, commands ...Command) *commandRegistry {
+	r := &commandRegistry{signingSecret: signingSecret, commands: map[string]Command{}}
+	r.Register(newCommand(helpCommandName, "help [command]", "lists the commands, or shows how to use one", []string{helpCommandName + " help", helpCommandName + " help /tz"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+		return r.Help(s.Text), nil
+	}))
+	for _, c := range commands {
+		r.Register(c)
+	}
+	return r
+}
+
+// Register adds c, replacing a command with the same name.
+func (r *commandRegistry) Register(c Command) {
+	r.commands[c.GetName()] = c
+}
+
+// Help lists every command with its usage. "help /tz" or "help tz" shows
+// the description and examples of that command instead.
+func (r *commandRegistry) Help(text string) string {
+	args := strings.Fields(text)
+	if len(args) > 0 && args[0] == "help" {
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		name := "/" + strings.TrimPrefix(args[0], "/")
+		c, ok := r.commands[name]
+		if !ok {
+			return r.unknown(name)
+		}
+		lines := []string{fmt.Sprintf("`%s %s`", c.GetName(), c.GetUsage()), c.GetDescription()}
+		if len(c.GetExamples()) > 0 {
+			lines = append(lines, "", "examples:")
+			for _, example := range c.GetExamples() {
+				lines = append(lines, "`"+example+"`")
+			}
+		}
+		return strings.Join(lines, "\n")
+	}
+
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{"commands:"}
+	for _, name := range names {
+		c := r.commands[name]
+		lines = append(lines, fmt.Sprintf("`%s %s` %s", name, c.GetUsage(), c.GetDescription()))
+	}
+	lines = append(lines, "", fmt.Sprintf("`%s help <command>` shows examples", helpCommandName))
+	return strings.Join(lines, "\n")
+}
+
+func (r *commandRegistry) unknown(name string) string {
+	return fmt.Sprintf("unknown command %s, `%s help` lists the commands", name, helpCommandName)
+}
+
+func (r *commandRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	verifier, err := slack.NewSecretsVerifier(req.Header, r.signingSecret)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	req.Body = io.NopCloser(io.TeeReader(req.Body, &verifier))
+	s, err := slack.SlashCommandParse(req)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = verifier.Ensure(); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	reqID := uuid.New().String()
+	logger := log.WithFields(log.Fields{"reqID": reqID, "command": s.Command, "user": s.UserID})
+	c, ok := r.commands[s.Command]
+	if !ok {
+		logger.Warn("unknown command")
+		logErrMsgSlack(w, r.unknown(s.Command))
+		return
+	}
+	msg, err := c.Run(withReqID(req.Context(), reqID), s)
+	if err != nil {
+		logger.WithFields(log.Fields{"error": err}).Info("command failed")
+		logErrMsgSlack(w, err.Error())
+		return
+	}
+	if msg == nil {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := writeSlackMsg(w, msg); err != nil {
+		sentry.CaptureException(err)
+		logger.WithFields(log.Fields{"error": err}).Error("failed to write command response")
+	}
+}
+
+// newSlashCommands are the commands served on /slash.
+func newSlashCommands(api *slack.Client, personaCmd *personaCommand, streakTable StreakTable) []Command {
+	return []Command{
+		newCommand("/anagram", "<letters>", "finds anagrams of up to 8 letters and sends them as a DM", []string{"/anagram listen"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return anagram(s, api)
+		}),
+		newCommand("/convert", "<value> <from> <to>", "converts between units", []string{"/convert 5 mile km", "/convert 100 fahrenheit celsius"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return convert(s)
+		}),
+		newCommand("/tz", "<hh:mm> <zone> | now usa | help", "converts a time to the US time zones", []string{"/tz 14:30 est", "/tz now usa"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return tz(s)
+		}),
+		newCommand("/yt", "<playlist or channel url>", "makes a /feed command for a youtube playlist or channel", []string{"/yt https://www.youtube.com/channel/UC4a-Gbdw7vOaccHmFo40b9g"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return yt(s), nil
+		}),
+		newCommand("/ttv", "<channel url>", "makes a /feed command for a twitch channel's videos", []string{"/ttv https://www.twitch.tv/gamesdonequick"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return ttv(s), nil
+		}),
+		newCommand("/roll", "<sides>", "rolls a die, a random number between 1 and sides", []string{"/roll 6"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return roll(s)
+		}),
+		newCommand("/choose", "<a> <b> ...", `picks one of the options, quote options with spaces`, []string{"/choose pizza tacos", `/choose "fish and chips" "pad thai"`}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return choose(s), nil
+		}),
+		newCommand("/wchoose", "<a:weight> <b:weight> ...", "picks one of the options, an option with weight 3 is three times as likely", []string{"/wchoose pizza:3 tacos:1"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return wchoose(s), nil
+		}),
+		newCommand("/sha256", "<text>", "hex encoded SHA-256 digest of the text", []string{"/sha256 hello"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return sha256Hex(s.Text), nil
+		}),
+		newCommand("/sentiment", "<text>", "detects the sentiment of the text with AWS Comprehend", []string{"/sentiment what a great day"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return sentiment(s)
+		}),
+		newCommand("/hex", "[count]", "random 2 digit hex numbers from the ANU quantum random number generator", []string{"/hex", "/hex 4"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return qrng(s, "https://qrng.anu.edu.au/wp-content/plugins/colours-plugin/get_one_hex.php")
+		}),
+		newCommand("/binary", "[count]", "random 8 bit binary numbers from the ANU quantum random number generator", []string{"/binary"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return qrng(s, "https://qrng.anu.edu.au/wp-content/plugins/colours-plugin/get_one_binary.php")
+		}),
+		newCommand("/ralpha", "[count]", "random blocks of 1024 characters from the ANU quantum random number generator", []string{"/ralpha"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return qrng(s, "https://qrng.anu.edu.au/wp-content/plugins/colours-plugin/get_block_alpha.php")
+		}),
+		newCommand("/rcolor", "", "a random color from the ANU quantum random number generator", []string{"/rcolor"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return rcolor()
+		}),
+		newCommand("/jwtdecode", "<token>", "shows the claims of a JWT without verifying it", []string{"/jwtdecode eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return jwtdecode(s.Text)
+		}),
+		newCommand("/persona", "show | list | set <scope> <setting> <value> | clear <scope>", "configures how the bot behaves in a channel, DMs or the workspace", []string{"/persona show", "/persona set here prompt answer in French"}, personaCmd.Run),
+		newCommand("/gpt3", "<prompt>", "asks an OpenAI model", []string{"/gpt3 write a haiku about go"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return gpt3(s.Text)
+		}),
+		newCommand("/b64", "<text>", "base64 encodes the text", []string{"/b64 hello"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return b64(s), nil
+		}),
+		newCommand("/date", "", "today's date in a few formats and the unix time", []string{"/date"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			return date(), nil
+		}),
+		newCommand("/streak", "[add <name> | delete <name>]", "lists your streaks, or starts or removes one", []string{"/streak", "/streak add no sugar", "/streak delete no sugar"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+			msg, err := streak(streakTable, s)
+			if err != nil {
+				sentry.CaptureException(err)
+			}
+			return msg, err
+		}),
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+func Test_commandRegistry(t *testing.T) {
+	echo := newCommand("/echo", "<text>", "says the text back", []string{"/echo hi"}, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+		if s.Text == "" {
+			return "", errors.New("nothing to echo")
+		}
+		return s.Text, nil
+	})
+	registry := newCommandRegistry("secret", echo, newCommand("/convert", "<value> <from> <to>", "converts between units", nil, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+		return convert(s)
+	}))
+
+	tests := []struct {
+		name     string
+		command  string
+		text     string
+		wantCode int
+		want     []string
+	}{
+		{name: "dispatch", command: "/echo", text: "hello", wantCode: http.StatusOK, want: []string{"hello"}},
+		{name: "error shown to the user", command: "/echo", wantCode: http.StatusOK, want: []string{"nothing to echo"}},
+		{name: "too few arguments", command: "/convert", text: "5 mile", wantCode: http.StatusOK, want: []string{"usage: /convert"}},
+		{name: "unknown command", command: "/nope", wantCode: http.StatusOK, want: []string{"unknown command /nope", "/lucksacks help"}},
+		{name: "help", command: "/lucksacks", text: "help", wantCode: http.StatusOK, want: []string{"`/convert <value> <from> <to>` converts between units", "`/echo <text>` says the text back", "`/lucksacks help [command]`"}},
+		{name: "help for a command", command: "/lucksacks", text: "help echo", wantCode: http.StatusOK, want: []string{"`/echo <text>`\nsays the text back", "examples:\n`/echo hi`"}},
+		{name: "help for an unknown command", command: "/lucksacks", text: "help /nope", wantCode: http.StatusOK, want: []string{"unknown command /nope"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := url.Values{"command": {tt.command}, "text": {tt.text}, "user_id": {"U1"}}.Encode()
+			r := httptest.NewRequest(http.MethodPost, "/slash", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			signSlackRequest(r, "secret", body)
+			w := httptest.NewRecorder()
+			registry.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			var msg slack.Msg
+			if err := json.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+				t.Fatalf("body %q: %v", w.Body.String(), err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(msg.Text, want) {
+					t.Errorf("response %q, want it to contain %q", msg.Text, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_commandRegistry_Unverified(t *testing.T) {
+	called := false
+	registry := newCommandRegistry("secret", newCommand("/echo", "", "", nil, func(ctx context.Context, s slack.SlashCommand) (string, error) {
+		called = true
+		return "", nil
+	}))
+	body := url.Values{"command": {"/echo"}}.Encode()
+	r := httptest.NewRequest(http.MethodPost, "/slash", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signSlackRequest(r, "not the secret", body)
+	w := httptest.NewRecorder()
+	registry.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized || called {
+		t.Errorf("got %d and called = %v, want 401", w.Code, called)
+	}
+}
+
+func Test_roll(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr bool
+	}{
+		{text: "6"},
+		{text: "help"},
+		{text: "six", wantErr: true},
+		{text: "0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := roll(slack.SlashCommand{Text: tt.text})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("roll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.text == "6" && (got < "1" || got > "6" || len(got) != 1) {
+				t.Errorf("roll() = %q, want 1 to 6", got)
+			}
+		})
+	}
+}
+
+func Test_tz(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    string
+		wantErr bool
+	}{
+		{text: "", want: TZ_HELP},
+		{text: "14:30 America/New_York", want: "14:30 EDT/EST America/New_York"},
+		{text: "14:30", wantErr: true},
+		{text: "2pm est", wantErr: true},
+		{text: "now mars", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := tz(slack.SlashCommand{Text: tt.text})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tz() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("tz() = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// summaryPrefix starts the text block that replaces summarized turns.
+const summaryPrefix = "Summary of the earlier conversation:\n"
+
+// contextCompactor keeps conversations inside the model's context window.
+// Once a conversation is estimated to be over MaxTokens, tool results before
+// the current turn are truncated to ToolResultChars, and if that is not
+// enough, the oldest turns are summarized by the LLM so that the turns kept
+// fit in TargetTokens. Conversations are only ever cut where a user turn
+// starts, so tool_use and tool_result blocks stay in pairs and the current
+// turn is left as it is.
+type contextCompactor struct {
+	llm             LLMInterface
+	MaxTokens       int
+	TargetTokens    int
+	ToolResultChars int
+}
+
+func newContextCompactor(llm LLMInterface) *contextCompactor {
+	return &contextCompactor{
+		llm:             llm,
+		MaxTokens:       envInt("CONTEXT_MAX_TOKENS", 150_000),
+		TargetTokens:    envInt("CONTEXT_TARGET_TOKENS", 60_000),
+		ToolResultChars: envInt("CONTEXT_TOOL_RESULT_CHARS", 2_000),
+	}
+}
+
+// estimateTokens is a rough token count for messages, about four bytes of
+// JSON per token. It errs on the high side, which is the safe side here.
+func estimateTokens(messages []anthropic.MessageParam) int {
+	b, err := json.Marshal(messages)
+	if err != nil {
+		return 0
+	}
+	return len(b) / 4
+}
+
+// turnStarts returns the indexes of the user messages that start a turn, as
+// opposed to the ones that carry tool results.
+func turnStarts(messages []anthropic.MessageParam) []int {
+	starts := []int{}
+	for i, message := range messages {
+		if message.Role != anthropic.MessageParamRoleUser {
+			continue
+		}
+		toolResults := false
+		for _, block := range message.Content {
+			if block.OfToolResult != nil {
+				toolResults = true
+				break
+			}
+		}
+		if !toolResults {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// Compact returns messages, compacted if they are over the limit. changed is
+// set when the returned messages should replace the stored ones. A failed
+// summary is logged and the truncated messages are returned.
+func (c *contextCompactor) Compact(ctx context.Context, messages []anthropic.MessageParam) (compacted []anthropic.MessageParam, changed bool) {
+	if c == nil || c.MaxTokens <= 0 || estimateTokens(messages) <= c.MaxTokens {
+		return messages, false
+	}
+	starts := turnStarts(messages)
+	currentTurn := 0
+	if len(starts) > 0 {
+		currentTurn = starts[len(starts)-1]
+	}
+
+	compacted = append(truncateToolResults(messages[:currentTurn], c.ToolResultChars), messages[currentTurn:]...)
+	fields := log.Fields{
+		"reqID":  reqIDFromContext(ctx),
+		"before": estimateTokens(messages),
+	}
+	if estimateTokens(compacted) <= c.MaxTokens {
+		fields["after"] = estimateTokens(compacted)
+		log.WithFields(fields).Info("truncated old tool results")
+		return compacted, true
+	}
+
+	cut := currentTurn
+	for _, start := range starts {
+		if start > 0 && estimateTokens(compacted[start:]) <= c.TargetTokens {
+			cut = start
+			break
+		}
+	}
+	if cut == 0 {
+		return compacted, true
+	}
+	summary, err := c.llm.Summarize(ctx, compacted[:cut])
+	if err != nil {
+		fields["error"] = err
+		log.WithFields(fields).Error("failed to summarize conversation")
+		return compacted, true
+	}
+
+	// the summary goes in front of the first kept turn so user and assistant
+	// messages still alternate
+	first := compacted[cut]
+	first.Content = append([]anthropic.ContentBlockParamUnion{anthropic.NewTextBlock(summaryPrefix + summary)}, first.Content...)
+	compacted = append([]anthropic.MessageParam{first}, compacted[cut+1:]...)
+	fields["after"] = estimateTokens(compacted)
+	fields["summarized"] = cut
+	log.WithFields(fields).Info("summarized old turns")
+	return compacted, true
+}
+
+// truncateToolResults shortens the text of tool results over maxChars. The
+// messages are copied, not changed in place.
+func truncateToolResults(messages []anthropic.MessageParam, maxChars int) []anthropic.MessageParam {
+	truncated := make([]anthropic.MessageParam, 0, len(messages))
+	for _, message := range messages {
+		content := make([]anthropic.ContentBlockParamUnion, 0, len(message.Content))
+		for _, block := range message.Content {
+			if block.OfToolResult != nil {
+				result := *block.OfToolResult
+				result.Content = make([]anthropic.ToolResultBlockParamContentUnion, 0, len(block.OfToolResult.Content))
+				for _, c := range block.OfToolResult.Content {
+					if c.OfText != nil && len(c.OfText.Text) > maxChars {
+						text := *c.OfText
+						text.Text = fmt.Sprintf("%s\n(truncated from %d characters to save context)", truncateText(text.Text, maxChars), len(c.OfText.Text))
+						c = anthropic.ToolResultBlockParamContentUnion{OfText: &text}
+					}
+					result.Content = append(result.Content, c)
+				}
+				block = anthropic.ContentBlockParamUnion{OfToolResult: &result}
+			}
+			content = append(content, block)
+		}
+		message.Content = content
+		truncated = append(truncated, message)
+	}
+	return truncated
+}
+
+// truncateText cuts s to at most n bytes without splitting a character.
+func truncateText(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// transcript renders messages as plain text for summarizing. Thinking is left
+// out and long blocks are cut to maxBlockChars.
+func transcript(messages []anthropic.MessageParam, maxBlockChars int) string {
+	clip := func(s string) string {
+		if len(s) > maxBlockChars {
+			return truncateText(s, maxBlockChars) + " ..."
+		}
+		return s
+	}
+	toolNames := map[string]string{}
+	var b strings.Builder
+	for _, message := range messages {
+		for _, block := range message.Content {
+			switch {
+			case block.OfText != nil:
+				fmt.Fprintf(&b, "%s: %s\n", message.Role, clip(block.OfText.Text))
+			case block.OfToolUse != nil:
+				toolNames[block.OfToolUse.ID] = block.OfToolUse.Name
+				input, _ := json.Marshal(block.OfToolUse.Input)
+				fmt.Fprintf(&b, "%s called %s with %s\n", message.Role, block.OfToolUse.Name, clip(string(input)))
+			case block.OfToolResult != nil:
+				texts := []string{}
+				for _, c := range block.OfToolResult.Content {
+					if c.OfText != nil {
+						texts = append(texts, c.OfText.Text)
+					}
+				}
+				fmt.Fprintf(&b, "%s returned: %s\n", toolNames[block.OfToolResult.ToolUseID], clip(strings.Join(texts, "\n")))
+			}
+		}
+	}
+	return b.String()
+}
+
+const summarizePrompt = `You are compacting a Slack conversation between users and an assistant so it can carry on with less context. Summarize the transcript below. Keep the facts, decisions, numbers, names, open questions and what the user asked for, and what tools found. Leave out pleasantries. Write it as notes for the assistant, not as a reply to the user.`
+
+// maxTranscriptChars caps the transcript sent to be summarized.
+const maxTranscriptChars = 400_000
+
+// summaryTranscript is the transcript of messages sent to be summarized,
+// capped at maxTranscriptChars.
+func summaryTranscript(messages []anthropic.MessageParam) string {
+	text := transcript(messages, 4_000)
+	if len(text) > maxTranscriptChars {
+		// keep the start, where an earlier summary would be, and the most
+		// recent turns
+		head := truncateText(text, maxTranscriptChars/4)
+		tail := text[len(text)-(maxTranscriptChars-len(head)):]
+		for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+			tail = tail[1:]
+		}
+		text = head + "\n[... earlier turns left out ...]\n" + tail
+	}
+	return text
+}
+
+// Summarize asks the model for a summary of messages, used to compact long
+// conversations.
+func (l *LLM) Summarize(ctx context.Context, messages []anthropic.MessageParam) (string, error) {
+	text := summaryTranscript(messages)
+	message, err := l.client.Messages.New(ctx, anthropic.MessageNewParams{
+		Model:     l.model,
+		MaxTokens: 4_000,
+		System:    []anthropic.TextBlockParam{{Text: summarizePrompt}},
+		Messages: []anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewTextBlock(text)),
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't summarize conversation")
+	}
+	summary := ""
+	for _, block := range message.Content {
+		if text, ok := block.AsAny().(anthropic.TextBlock); ok {
+			summary += text.Text
+		}
+	}
+	if strings.TrimSpace(summary) == "" {
+		return "", errors.New("the summary was empty")
+	}
+	return strings.TrimSpace(summary), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/pkg/errors"
+)
+
+// toolTurn is a user question answered with one tool call whose result is
+// resultSize bytes.
+func toolTurn(i int, resultSize int) []anthropic.MessageParam {
+	id := fmt.Sprintf("toolu_%d", i)
+	return []anthropic.MessageParam{
+		anthropic.NewUserMessage(anthropic.NewTextBlock(fmt.Sprintf("question %d", i))),
+		anthropic.NewAssistantMessage(anthropic.NewToolUseBlock(id, map[string]string{"query": "SELECT 1"}, "postgres_query")),
+		anthropic.NewUserMessage(anthropic.NewToolResultBlock(id, strings.Repeat("x", resultSize), false)),
+		anthropic.NewAssistantMessage(anthropic.NewTextBlock(fmt.Sprintf("answer %d", i))),
+	}
+}
+
+func toolTurns(n int, resultSize int) []anthropic.MessageParam {
+	messages := []anthropic.MessageParam{}
+	for i := 0; i < n; i++ {
+		messages = append(messages, toolTurn(i, resultSize)...)
+	}
+	return messages
+}
+
+// assertToolPairs checks every tool_use is answered by a tool_result in the
+// next message and every tool_result answers one.
+func assertToolPairs(t *testing.T, messages []anthropic.MessageParam) {
+	t.Helper()
+	if len(messages) > 0 && messages[0].Role != anthropic.MessageParamRoleUser {
+		t.Errorf("conversation starts with a %s message", messages[0].Role)
+	}
+	pending := map[string]bool{}
+	for i, message := range messages {
+		for _, block := range message.Content {
+			if block.OfToolResult != nil {
+				if !pending[block.OfToolResult.ToolUseID] {
+					t.Errorf("message %d: tool_result %s has no tool_use", i, block.OfToolResult.ToolUseID)
+				}
+				delete(pending, block.OfToolResult.ToolUseID)
+			}
+		}
+		if len(pending) > 0 {
+			t.Errorf("message %d: tool_use without a tool_result: %v", i, pending)
+		}
+		for _, block := range message.Content {
+			if block.OfToolUse != nil {
+				pending[block.OfToolUse.ID] = true
+			}
+		}
+	}
+}
+
+func Test_contextCompactor_Compact(t *testing.T) {
+	summarize := func(ctx context.Context, messages []anthropic.MessageParam) (string, error) {
+		return fmt.Sprintf("%d messages about questions", len(messages)), nil
+	}
+	tests := []struct {
+		name      string
+		messages  []anthropic.MessageParam
+		summarize func(ctx context.Context, messages []anthropic.MessageParam) (string, error)
+		// toolResultChars is what old tool results are truncated to, 0 is 500
+		toolResultChars int
+		wantChanged     bool
+		wantMessages    int
+		wantSummary     string
+	}{
+		{
+			name:         "under the limit",
+			messages:     toolTurns(2, 100),
+			wantMessages: 8,
+		},
+		{
+			name:         "old tool results are truncated",
+			messages:     append(toolTurns(2, 20_000), toolTurn(2, 20_000)...),
+			wantChanged:  true,
+			wantMessages: 12,
+		},
+		{
+			name:            "old turns are summarized",
+			messages:        append(toolTurns(40, 1_000), toolTurn(40, 100)...),
+			summarize:       summarize,
+			toolResultChars: 2_000,
+			wantChanged:     true,
+			wantSummary:     "messages about questions",
+		},
+		{
+			name:     "failed summaries leave the truncated turns",
+			messages: append(toolTurns(40, 1_000), toolTurn(40, 100)...),
+			summarize: func(ctx context.Context, messages []anthropic.MessageParam) (string, error) {
+				return "", errors.New("overloaded")
+			},
+			toolResultChars: 2_000,
+			wantChanged:     true,
+			wantMessages:    164,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compactor := &contextCompactor{
+				llm:             &mockLLM{summarize: tt.summarize},
+				MaxTokens:       10_000,
+				TargetTokens:    5_000,
+				ToolResultChars: 500,
+			}
+			if tt.toolResultChars > 0 {
+				compactor.ToolResultChars = tt.toolResultChars
+			}
+			got, changed := compactor.Compact(context.Background(), tt.messages)
+			if changed != tt.wantChanged {
+				t.Errorf("Compact() changed = %v, want %v", changed, tt.wantChanged)
+			}
+			if tt.wantMessages > 0 && len(got) != tt.wantMessages {
+				t.Errorf("Compact() returned %d messages, want %d", len(got), tt.wantMessages)
+			}
+			assertToolPairs(t, got)
+			if tt.wantChanged && tt.wantSummary == "" && tt.toolResultChars == 0 {
+				// the current turn keeps its full tool result
+				current := got[len(got)-2].Content[0].OfToolResult.Content[0].OfText.Text
+				if len(current) != len(tt.messages[len(tt.messages)-2].Content[0].OfToolResult.Content[0].OfText.Text) {
+					t.Errorf("Compact() truncated the current turn's tool result")
+				}
+				if old := got[2].Content[0].OfToolResult.Content[0].OfText.Text; !strings.Contains(old, "(truncated from") {
+					t.Errorf("Compact() left an old tool result of %d bytes", len(old))
+				}
+			}
+			if tt.wantSummary != "" {
+				if text := got[0].Content[0].OfText; text == nil || !strings.HasPrefix(text.Text, summaryPrefix) || !strings.HasSuffix(text.Text, tt.wantSummary) {
+					t.Errorf("Compact() first block = %+v, want the summary %q", got[0].Content[0], tt.wantSummary)
+				}
+				// the summary is merged into the first kept turn
+				if len(got) >= len(tt.messages) || len(got)%4 != 0 {
+					t.Errorf("Compact() returned %d of %d messages, want whole turns left out", len(got), len(tt.messages))
+				}
+				if estimateTokens(got) > compactor.MaxTokens {
+					t.Errorf("Compact() is still %d tokens", estimateTokens(got))
+				}
+			}
+			// the input is not changed in place
+			if text := tt.messages[2].Content[0].OfToolResult.Content[0].OfText.Text; strings.Contains(text, "truncated") {
+				t.Errorf("Compact() changed the messages it was given")
+			}
+		})
+	}
+}
+
+func TestSlackMessageStore_CompactsHistory(t *testing.T) {
+	var sent []anthropic.MessageParam
+	llm := &mockLLM{
+		fn: func(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+			sent = messages
+			return &LLMResponse{Message: "ok"}, nil
+		},
+		summarize: func(ctx context.Context, messages []anthropic.MessageParam) (string, error) {
+			return "earlier questions", nil
+		},
+	}
+	store := NewSlackMessageStore(llm)
+	store.compactor.MaxTokens = 10_000
+	store.compactor.TargetTokens = 5_000
+	store.AppendMessages("thread", toolTurns(30, 1_000))
+
+	if _, err := store.CallLLM(context.Background(), "thread", "and now?"); err != nil {
+		t.Fatal(err)
+	}
+	stored := store.GetMessages()["thread"]
+	if len(stored) != len(sent) || len(stored) >= 120 {
+		t.Errorf("stored %d messages and sent %d, want the compacted conversation in both", len(stored), len(sent))
+	}
+	if text := stored[0].Content[0].OfText; text == nil || !strings.HasPrefix(text.Text, summaryPrefix) {
+		t.Errorf("stored conversation does not start with the summary")
+	}
+	assertToolPairs(t, stored)
+}
@@ -2,40 +2,59 @@ package main
 
 import (
 	"fmt"
-	"net/http"
 	"strconv"
 	"strings"
 
 	u "github.com/bcicen/go-units"
+	"github.com/pkg/errors"
 
 	"github.com/slack-go/slack"
 )
 
-func convert(s slack.SlashCommand, w http.ResponseWriter) {
-	vals := strings.Split(s.Text, " ")
-	from, err := u.Find(vals[1])
-	if err != nil {
-		logErrMsgSlack(w, vals[1]+" not valid unit")
-		return
+func convert(s slack.SlashCommand) (string, error) {
+	vals := strings.Fields(s.Text)
+	if len(vals) != 3 {
+		return "", errors.New("usage: /convert <value> <from> <to>")
 	}
-	to, err := u.Find(vals[2])
+	val, err := strconv.ParseFloat(vals[0], 64)
 	if err != nil {
-		logErrMsgSlack(w, vals[2]+" not valid unit")
-		return
+		return "", errors.New(vals[0] + " failed to parse")
 	}
+	return describeConversion(val, vals[1], vals[2])
+}
 
-	val, err := strconv.ParseFloat(vals[0], 64)
+// describeConversion converts value like convertUnits and says so in words,
+// such as "5 miles is 8.04672 kilometers".
+func describeConversion(value float64, from string, to string) (string, error) {
+	fromUnit, converted, err := unitConversion(value, from, to)
 	if err != nil {
-		logErrMsgSlack(w, vals[0]+" failed to parse")
-		return
+		return "", err
 	}
+	return fmt.Sprintf("%s %ss is %s", strconv.FormatFloat(value, 'f', -1, 64), fromUnit.Name, converted.String()), nil
+}
 
-	message, err := u.ConvertFloat(val, from, to)
-
+// convertUnits converts value between units given by name or symbol, such as
+// "mile" or "km".
+func convertUnits(value float64, from string, to string) (float64, error) {
+	_, converted, err := unitConversion(value, from, to)
 	if err != nil {
-		logErrMsgSlack(w, "failed to preform conversion for: "+vals[0]+" "+vals[1]+" "+" "+vals[2])
-		return
+		return 0, err
+	}
+	return converted.Float(), nil
+}
 
+func unitConversion(value float64, from string, to string) (u.Unit, u.Value, error) {
+	fromUnit, err := u.Find(from)
+	if err != nil {
+		return u.Unit{}, u.Value{}, errors.Errorf("%s not valid unit", from)
+	}
+	toUnit, err := u.Find(to)
+	if err != nil {
+		return u.Unit{}, u.Value{}, errors.Errorf("%s not valid unit", to)
+	}
+	converted, err := u.ConvertFloat(value, fromUnit, toUnit)
+	if err != nil {
+		return u.Unit{}, u.Value{}, errors.Wrapf(err, "failed to convert %s to %s", from, to)
 	}
-	logErrMsgSlack(w, fmt.Sprintf("%s %ss is %s", vals[0], from.Name, message.String()))
+	return fromUnit, converted, nil
 }
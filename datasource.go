@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// datasource is a database the SQL tools can query and the limits that apply
+// to it.
+type datasource struct {
+	Name string
+	URL  string
+	// AllowWrites runs queries in a read-write transaction that is committed,
+	// by default queries run read only and are rolled back.
+	AllowWrites      bool
+	StatementTimeout time.Duration
+	MaxRows          int
+	// MaxBytes caps the size of the JSON returned to the model.
+	MaxBytes int
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// datasourceConfig is how a datasource is written in the DATASOURCES env
+// var, durations are strings such as "10s".
+type datasourceConfig struct {
+	Name             string `json:"name"`
+	URL              string `json:"url"`
+	AllowWrites      bool   `json:"allow_writes"`
+	StatementTimeout string `json:"statement_timeout"`
+	MaxRows          *int   `json:"max_rows"`
+	MaxBytes         *int   `json:"max_bytes"`
+	MaxOpenConns     *int   `json:"max_open_conns"`
+	MaxIdleConns     *int   `json:"max_idle_conns"`
+	ConnMaxLifetime  string `json:"conn_max_lifetime"`
+}
+
+// datasourceFromEnv configures the DATABASE_URL datasource, it is also where
+// the defaults for datasources in DATASOURCES come from.
+func datasourceFromEnv() datasource {
+	return datasource{
+		Name:             "default",
+		URL:              databaseURL(),
+		AllowWrites:      os.Getenv("DATABASE_ALLOW_WRITES") == "true",
+		StatementTimeout: envDuration("DATABASE_STATEMENT_TIMEOUT", 10*time.Second),
+		MaxRows:          envInt("DATABASE_MAX_ROWS", 200),
+		MaxBytes:         envInt("DATABASE_MAX_BYTES", 50_000),
+		MaxOpenConns:     envInt("DATABASE_MAX_OPEN_CONNS", 5),
+		MaxIdleConns:     envInt("DATABASE_MAX_IDLE_CONNS", 2),
+		ConnMaxLifetime:  envDuration("DATABASE_CONN_MAX_LIFETIME", 30*time.Minute),
+	}
+}
+
+// parseDatasources reads a JSON array of datasource configs, settings that
+// are left out are taken from defaults.
+func parseDatasources(config string, defaults datasource) ([]datasource, error) {
+	var configs []datasourceConfig
+	if err := json.Unmarshal([]byte(config), &configs); err != nil {
+		return nil, errors.Wrap(err, "failed to parse datasources")
+	}
+	datasources := []datasource{}
+	for _, c := range configs {
+		if c.Name == "" || c.URL == "" {
+			return nil, errors.New("every datasource needs a name and a url")
+		}
+		ds := defaults
+		ds.Name = c.Name
+		ds.URL = c.URL
+		ds.AllowWrites = c.AllowWrites
+		for _, d := range []struct {
+			value string
+			field *time.Duration
+		}{
+			{c.StatementTimeout, &ds.StatementTimeout},
+			{c.ConnMaxLifetime, &ds.ConnMaxLifetime},
+		} {
+			if d.value == "" {
+				continue
+			}
+			parsed, err := time.ParseDuration(d.value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "datasource %s", c.Name)
+			}
+			*d.field = parsed
+		}
+		for _, i := range []struct {
+			value *int
+			field *int
+		}{
+			{c.MaxRows, &ds.MaxRows},
+			{c.MaxBytes, &ds.MaxBytes},
+			{c.MaxOpenConns, &ds.MaxOpenConns},
+			{c.MaxIdleConns, &ds.MaxIdleConns},
+		} {
+			if i.value != nil {
+				*i.field = *i.value
+			}
+		}
+		datasources = append(datasources, ds)
+	}
+	return datasources, nil
+}
+
+// datasourceRegistry holds a long-lived connection pool per datasource. The
+// first datasource is the default.
+type datasourceRegistry struct {
+	names       []string
+	datasources map[string]datasource
+	pools       map[string]*sql.DB
+
+	mu     sync.RWMutex
+	health map[string]error
+}
+
+func newDatasourceRegistry(datasources []datasource) (*datasourceRegistry, error) {
+	if len(datasources) == 0 {
+		return nil, errors.New("no datasources configured")
+	}
+	r := &datasourceRegistry{
+		datasources: make(map[string]datasource),
+		pools:       make(map[string]*sql.DB),
+		health:      make(map[string]error),
+	}
+	for _, ds := range datasources {
+		if _, ok := r.datasources[ds.Name]; ok {
+			r.Close()
+			return nil, errors.Errorf("datasource %s is configured twice", ds.Name)
+		}
+		db, err := sql.Open("postgres", ds.URL)
+		if err != nil {
+			r.Close()
+			return nil, errors.Wrapf(err, "failed to open datasource %s", ds.Name)
+		}
+		db.SetMaxOpenConns(ds.MaxOpenConns)
+		db.SetMaxIdleConns(ds.MaxIdleConns)
+		db.SetConnMaxLifetime(ds.ConnMaxLifetime)
+		r.names = append(r.names, ds.Name)
+		r.datasources[ds.Name] = ds
+		r.pools[ds.Name] = db
+	}
+	return r, nil
+}
+
+// datasourceRegistryFromEnv loads the datasources from the DATASOURCES env
+// var, a JSON array such as
+//
+//	[{"name": "shop", "url": "postgres://...", "statement_timeout": "5s", "max_open_conns": 10}]
+//
+// Without it the registry has a single datasource for DATABASE_URL.
+func datasourceRegistryFromEnv() (*datasourceRegistry, error) {
+	defaults := datasourceFromEnv()
+	config := os.Getenv("DATASOURCES")
+	if config == "" {
+		return newDatasourceRegistry([]datasource{defaults})
+	}
+	datasources, err := parseDatasources(config, defaults)
+	if err != nil {
+		return nil, err
+	}
+	return newDatasourceRegistry(datasources)
+}
+
+// Get returns the pool and settings for the named datasource, an empty name
+// is the default datasource.
+func (r *datasourceRegistry) Get(name string) (*sql.DB, datasource, error) {
+	if name == "" {
+		name = r.names[0]
+	}
+	ds, ok := r.datasources[name]
+	if !ok {
+		return nil, datasource{}, errors.Errorf("unknown datasource %q, available datasources: %s", name, strings.Join(r.names, ", "))
+	}
+	r.mu.RLock()
+	err := r.health[name]
+	r.mu.RUnlock()
+	if err != nil {
+		return nil, datasource{}, errors.Wrapf(err, "datasource %s is unavailable", name)
+	}
+	return r.pools[name], ds, nil
+}
+
+// Writable reports whether queries on the named datasource may write, the
+// empty name is the default datasource.
+func (r *datasourceRegistry) Writable(name string) bool {
+	if name == "" {
+		name = r.names[0]
+	}
+	return r.datasources[name].AllowWrites
+}
+
+// Describe lists the datasources for tool descriptions.
+func (r *datasourceRegistry) Describe() string {
+	descriptions := []string{}
+	for i, name := range r.names {
+		attributes := []string{"read only"}
+		if r.datasources[name].AllowWrites {
+			attributes = []string{"read-write"}
+		}
+		if i == 0 {
+			attributes = append([]string{"default"}, attributes...)
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", name, strings.Join(attributes, ", ")))
+	}
+	return "Available datasources: " + strings.Join(descriptions, ", ")
+}
+
+// CheckHealth pings every datasource and records the result, Get refuses
+// datasources whose last check failed.
+func (r *datasourceRegistry) CheckHealth(ctx context.Context) map[string]error {
+	health := make(map[string]error, len(r.names))
+	for _, name := range r.names {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := r.pools[name].PingContext(pingCtx)
+		cancel()
+		if err != nil {
+			log.WithFields(log.Fields{"datasource": name, "error": err}).Error("datasource health check failed")
+		}
+		health[name] = err
+	}
+	r.mu.Lock()
+	r.health = health
+	r.mu.Unlock()
+	return health
+}
+
+// WatchHealth runs CheckHealth every interval until ctx is done.
+func (r *datasourceRegistry) WatchHealth(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.CheckHealth(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Serves returns the name of the datasource that connects to the same
+// database as dbURL.
+func (r *datasourceRegistry) Serves(dbURL string) (string, bool) {
+	for _, name := range r.names {
+		if sameDatabase(r.datasources[name].URL, dbURL) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// sameDatabase compares the host, port and database name of two postgres
+// urls, connection strings that aren't urls are compared as they are.
+func sameDatabase(a string, b string) bool {
+	key := func(dbURL string) string {
+		u, err := url.Parse(dbURL)
+		if err != nil || u.Host == "" {
+			return dbURL
+		}
+		port := u.Port()
+		if port == "" {
+			port = "5432"
+		}
+		return strings.ToLower(u.Hostname()) + ":" + port + "/" + strings.TrimPrefix(u.Path, "/")
+	}
+	return key(a) == key(b)
+}
+
+func (r *datasourceRegistry) Close() {
+	for _, db := range r.pools {
+		db.Close()
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// envInt reads an integer env var, falling back to def when it is unset or
+// invalid.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.WithFields(log.Fields{"env": name, "value": value, "error": err}).Error("invalid integer, using default")
+		return def
+	}
+	return i
+}
+
+// envDuration reads a duration env var such as "90s" or "5m", falling back to
+// def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.WithFields(log.Fields{"env": name, "value": value, "error": err}).Error("invalid duration, using default")
+		return def
+	}
+	return d
+}
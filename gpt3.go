@@ -1,73 +1,21 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"net/http"
+	"context"
 	"os"
 )
 
-var OpenAPISecretKey = os.Getenv("OPENAPI_SECRET_KEY")
-
-type choice struct {
-	Text string `json:"text"`
-}
-
-type gpt3Response struct {
-	Choices []choice `json:"choices"`
-}
-
-type gpt3Request struct {
-	Prompt    string `json:"prompt"`
-	Model     string `json:"model"`
-	MaxTokens int    `json:"max_tokens"`
-}
-
-func newGpt3Request(prompt string) *gpt3Request {
-	return &gpt3Request{
-		Prompt:    prompt,
-		Model:     "text-davinci-002",
-		MaxTokens: 2048,
+// openAIModel is the model /gpt3 and the openai provider use unless one is
+// configured.
+func openAIModel() string {
+	if model := os.Getenv("OPENAI_MODEL"); model != "" {
+		return model
 	}
+	return "gpt-4o-mini"
 }
 
+// gpt3 answers a one-off prompt for the /gpt3 command. The command kept its
+// name, the completions model it was written for has been retired.
 func gpt3(input string) (string, error) {
-	url := "https://api.openai.com/v1/completions"
-	headers := map[string]string{
-		"Content-Type":  "application/json",
-		"Authorization": "Bearer " + OpenAPISecretKey,
-	}
-	request := newGpt3Request(input)
-	b, err := json.Marshal(request)
-	if err != nil {
-		return "", err
-	}
-	resp, err := postRequest(url, headers, b)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	var gpt3Response gpt3Response
-	err = json.NewDecoder(resp.Body).Decode(&gpt3Response)
-	if err != nil {
-		return "", err
-	}
-	fullresponse := ""
-	for _, choice := range gpt3Response.Choices {
-		fullresponse += choice.Text
-	}
-	return fullresponse, nil
-
-}
-
-func postRequest(url string, headers map[string]string, body []byte) (*http.Response, error) {
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, err
-	}
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-	client := &http.Client{}
-	return client.Do(req)
+	return openAIClientFromEnv().complete(context.Background(), openAIModel(), input)
 }
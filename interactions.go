@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+// blockActionHandler handles a click, a menu choice or another action on
+// blocks the bot posted.
+type blockActionHandler func(ctx context.Context, callback slack.InteractionCallback, action *slack.BlockAction)
+
+// viewSubmissionHandler handles a submitted modal. It runs before slack is
+// answered and has to finish within 3 seconds, a nil response closes the
+// modal.
+type viewSubmissionHandler func(ctx context.Context, callback slack.InteractionCallback) (*slack.ViewSubmissionResponse, error)
+
+// shortcutHandler handles a global shortcut or a message shortcut, they only
+// differ in whether callback.Message is set.
+type shortcutHandler func(ctx context.Context, callback slack.InteractionCallback)
+
+// interactionRouter serves /interactions. Requests are verified with the
+// signing secret like /slash and /events, then each payload goes to the
+// handler registered for its action_id or callback_id. Slack wants an
+// answer within 3 seconds, so everything but view submissions runs after
+// the request is answered.
+type interactionRouter struct {
+	signingSecret   string
+	blockActions    map[string]blockActionHandler
+	viewSubmissions map[string]viewSubmissionHandler
+	shortcuts       map[string]shortcutHandler
+	messageActions  map[string]shortcutHandler
+	// async runs handlers after the request is answered, tests run them
+	// right away.
+	async func(f func())
+}
+
+func newInteractionRouter(signingSecret string) *interactionRouter {
+	return &interactionRouter{
+		signingSecret:   signingSecret,
+		blockActions:    map[string]blockActionHandler{},
+		viewSubmissions: map[string]viewSubmissionHandler{},
+		shortcuts:       map[string]shortcutHandler{},
+		messageActions:  map[string]shortcutHandler{},
+		async:           func(f func()) { go f() },
+	}
+}
+
+// OnBlockAction handles block_actions with actionID.
+func (r *interactionRouter) OnBlockAction(actionID string, h blockActionHandler) {
+	r.blockActions[actionID] = h
+}
+
+// OnViewSubmission handles view_submission of modals opened with callbackID.
+func (r *interactionRouter) OnViewSubmission(callbackID string, h viewSubmissionHandler) {
+	r.viewSubmissions[callbackID] = h
+}
+
+// OnShortcut handles the global shortcut with callbackID.
+func (r *interactionRouter) OnShortcut(callbackID string, h shortcutHandler) {
+	r.shortcuts[callbackID] = h
+}
+
+// OnMessageAction handles the message shortcut with callbackID.
+func (r *interactionRouter) OnMessageAction(callbackID string, h shortcutHandler) {
+	r.messageActions[callbackID] = h
+}
+
+func (r *interactionRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	reqID := uuid.New().String()
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sv, err := slack.NewSecretsVerifier(req.Header, r.signingSecret)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, err := sv.Write(body); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := sv.Ensure(); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var callback slack.InteractionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &callback); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	logger := log.WithFields(log.Fields{"reqID": reqID, "type": callback.Type, "user": callback.User.ID})
+	ctx := withReqID(context.Background(), reqID)
+
+	switch callback.Type {
+	case slack.InteractionTypeBlockActions:
+		for _, action := range callback.ActionCallback.BlockActions {
+			h, ok := r.blockActions[action.ActionID]
+			if !ok {
+				logger.WithFields(log.Fields{"actionID": action.ActionID}).Warn("no handler for block action")
+				continue
+			}
+			logger.WithFields(log.Fields{"actionID": action.ActionID}).Info("interaction")
+			r.async(func() { h(ctx, callback, action) })
+		}
+	case slack.InteractionTypeViewSubmission:
+		h, ok := r.viewSubmissions[callback.View.CallbackID]
+		if !ok {
+			logger.WithFields(log.Fields{"callbackID": callback.View.CallbackID}).Warn("no handler for view submission")
+			break
+		}
+		logger.WithFields(log.Fields{"callbackID": callback.View.CallbackID}).Info("interaction")
+		resp, err := h(withReqID(req.Context(), reqID), callback)
+		if err != nil {
+			sentry.CaptureException(err)
+			logger.WithFields(log.Fields{"error": err, "stack": fmt.Sprintf("%+v", err)}).Error("Failed to handle view submission")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if resp != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
+	case slack.InteractionTypeShortcut, slack.InteractionTypeMessageAction:
+		handlers := r.shortcuts
+		if callback.Type == slack.InteractionTypeMessageAction {
+			handlers = r.messageActions
+		}
+		h, ok := handlers[callback.CallbackID]
+		if !ok {
+			logger.WithFields(log.Fields{"callbackID": callback.CallbackID}).Warn("no handler for shortcut")
+			break
+		}
+		logger.WithFields(log.Fields{"callbackID": callback.CallbackID}).Info("interaction")
+		r.async(func() { h(ctx, callback) })
+	default:
+		logger.Info("ignored interaction")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// postEphemeralReply tells the user who interacted something only they see,
+// in the thread the interaction came from.
+func postEphemeralReply(ctx context.Context, api *slack.Client, callback slack.InteractionCallback, text string) {
+	options := []slack.MsgOption{slack.MsgOptionText(text, false)}
+	if thread := callback.Message.ThreadTimestamp; thread != "" {
+		options = append(options, slack.MsgOptionTS(thread))
+	}
+	if _, err := api.PostEphemeralContext(ctx, callback.Channel.ID, callback.User.ID, options...); err != nil {
+		log.WithFields(log.Fields{"reqID": reqIDFromContext(ctx), "error": err}).Error("Failed to post ephemeral reply")
+	}
+}
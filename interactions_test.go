@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func Test_interactionRouter(t *testing.T) {
+	tests := []struct {
+		payload  string
+		wantCode int
+		want     string
+		wantBody string
+	}{
+		{payload: "block_actions.json", wantCode: http.StatusOK, want: "action tool_approval_approve 3f1c2a9e-approval by U061F7AUR in C0CA5 thread 1700000000.000100"},
+		{payload: "view_submission.json", wantCode: http.StatusOK, want: "view persona_edit for C0CA5: answer questions about the warehouse", wantBody: `{"response_action":"clear"}`},
+		{payload: "shortcut.json", wantCode: http.StatusOK, want: "shortcut ask_lucksacks by U061F7AUR"},
+		{payload: "message_action.json", wantCode: http.StatusOK, want: "message action summarize_thread on the nightly import failed again"},
+		{payload: "view_closed.json", wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.payload, func(t *testing.T) {
+			var got []string
+			router := newInteractionRouter("secret")
+			router.async = func(f func()) { f() }
+			router.OnBlockAction(approveToolActionID, func(ctx context.Context, callback slack.InteractionCallback, action *slack.BlockAction) {
+				got = append(got, "action "+action.ActionID+" "+action.Value+" by "+callback.User.ID+" in "+callback.Channel.ID+" thread "+callback.Message.ThreadTimestamp)
+			})
+			router.OnBlockAction("unused", func(ctx context.Context, callback slack.InteractionCallback, action *slack.BlockAction) {
+				got = append(got, "wrong action handler")
+			})
+			router.OnViewSubmission("persona_edit", func(ctx context.Context, callback slack.InteractionCallback) (*slack.ViewSubmissionResponse, error) {
+				prompt := callback.View.State.Values["prompt_block"]["prompt"].Value
+				got = append(got, "view "+callback.View.CallbackID+" for "+callback.View.PrivateMetadata+": "+prompt)
+				return slack.NewClearViewSubmissionResponse(), nil
+			})
+			router.OnShortcut("ask_lucksacks", func(ctx context.Context, callback slack.InteractionCallback) {
+				got = append(got, "shortcut "+callback.CallbackID+" by "+callback.User.ID)
+			})
+			router.OnMessageAction("summarize_thread", func(ctx context.Context, callback slack.InteractionCallback) {
+				got = append(got, "message action "+callback.CallbackID+" on "+callback.Message.Text)
+			})
+
+			payload, err := os.ReadFile(filepath.Join("testdata", "interactions", tt.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := url.Values{"payload": {string(payload)}}.Encode()
+			r := httptest.NewRequest(http.MethodPost, "/interactions", strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			signSlackRequest(r, "secret", body)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.want == "" && len(got) != 0 {
+				t.Errorf("handlers called: %q, want none", got)
+			}
+			if tt.want != "" && (len(got) != 1 || got[0] != tt.want) {
+				t.Errorf("handlers called: %q, want %q", got, tt.want)
+			}
+			if gotBody := strings.TrimSpace(w.Body.String()); gotBody != tt.wantBody {
+				t.Errorf("body = %s, want %s", gotBody, tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_interactionRouter_Unverified(t *testing.T) {
+	payload, _ := json.Marshal(map[string]interface{}{"type": "shortcut", "callback_id": "ask_lucksacks"})
+	body := url.Values{"payload": {string(payload)}}.Encode()
+	called := false
+	router := newInteractionRouter("secret")
+	router.async = func(f func()) { f() }
+	router.OnShortcut("ask_lucksacks", func(ctx context.Context, callback slack.InteractionCallback) { called = true })
+
+	for name, sign := range map[string]func(r *http.Request){
+		"unsigned":     func(r *http.Request) {},
+		"wrong secret": func(r *http.Request) { signSlackRequest(r, "not the secret", body) },
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/interactions", strings.NewReader(body))
+		sign(r)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code == http.StatusOK || called {
+			t.Errorf("%s request got %d and called = %v, want it refused", name, w.Code, called)
+		}
+	}
+}
@@ -9,9 +9,7 @@ import (
 // https://stackoverflow.com/questions/45405626/decoding-jwt-token-in-golang
 func jwtdecode(tokenString string) (string, error) {
 	msg := ""
-	claims := jwt.MapClaims{}
-	_, err := jwt.ParseWithClaims(tokenString, claims, nil)
-	// ... error handling
+	claims, err := jwtClaims(tokenString)
 	if err != nil {
 		return "", err
 	}
@@ -22,3 +20,13 @@ func jwtdecode(tokenString string) (string, error) {
 	}
 	return msg, nil
 }
+
+// jwtClaims decodes the claims of a token without verifying its signature.
+func jwtClaims(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
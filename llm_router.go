@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/pkg/errors"
+)
+
+// llmConfig picks the provider and model for the deployment or a channel.
+type llmConfig struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+}
+
+// llmProviders builds an LLMInterface for each provider. All of them share
+// the same tools through messageHandler.
+type llmProviders struct {
+	anthropicClient anthropic.Client
+	openAIClient    *openAIClient
+	messageHandler  messageHandler
+}
+
+func (p llmProviders) build(config llmConfig) (LLMInterface, error) {
+	switch config.Provider {
+	case "", "anthropic":
+		llm := NewLLM(p.anthropicClient, p.messageHandler)
+		if config.Model != "" {
+			llm.model = anthropic.Model(config.Model)
+		}
+		return llm, nil
+	case "openai":
+		model := config.Model
+		if model == "" {
+			model = openAIModel()
+		}
+		return newOpenAILLM(p.openAIClient, model, p.messageHandler), nil
+	default:
+		return nil, errors.Errorf("unknown llm provider %q, use anthropic or openai", config.Provider)
+	}
+}
+
+var _ LLMInterface = &llmRouter{}
+
+// llmRouter sends each conversation to the LLM configured for its channel,
+// or to the default one.
+type llmRouter struct {
+	defaultLLM LLMInterface
+	channels   map[string]LLMInterface
+}
+
+// newLLMRouter builds the LLMs for defaults and for each channel. A channel
+// that leaves out the provider gets the default provider and model, one that
+// only leaves out the model gets that provider's default model.
+func newLLMRouter(providers llmProviders, defaults llmConfig, channels map[string]llmConfig) (*llmRouter, error) {
+	built := map[llmConfig]LLMInterface{}
+	get := func(config llmConfig) (LLMInterface, error) {
+		if config.Provider == "" {
+			config.Provider = defaults.Provider
+			if config.Model == "" {
+				config.Model = defaults.Model
+			}
+		}
+		if llm, ok := built[config]; ok {
+			return llm, nil
+		}
+		llm, err := providers.build(config)
+		if err != nil {
+			return nil, err
+		}
+		built[config] = llm
+		return llm, nil
+	}
+	defaultLLM, err := get(defaults)
+	if err != nil {
+		return nil, err
+	}
+	router := &llmRouter{defaultLLM: defaultLLM, channels: map[string]LLMInterface{}}
+	for channel, config := range channels {
+		llm, err := get(config)
+		if err != nil {
+			return nil, errors.Wrapf(err, "channel %s", channel)
+		}
+		router.channels[channel] = llm
+	}
+	return router, nil
+}
+
+// llmRouterFromEnv reads the default provider and model from LLM_PROVIDER
+// and LLM_MODEL, and per channel overrides from LLM_CHANNELS, a JSON object
+// such as {"C0123": {"provider": "openai", "model": "llama3.1"}}.
+func llmRouterFromEnv(providers llmProviders) (*llmRouter, error) {
+	defaults := llmConfig{
+		Provider: os.Getenv("LLM_PROVIDER"),
+		Model:    os.Getenv("LLM_MODEL"),
+	}
+	if defaults.Provider == "" {
+		defaults.Provider = "anthropic"
+	}
+	channels := map[string]llmConfig{}
+	if config := os.Getenv("LLM_CHANNELS"); config != "" {
+		if err := json.Unmarshal([]byte(config), &channels); err != nil {
+			return nil, errors.Wrap(err, "failed to parse LLM_CHANNELS")
+		}
+	}
+	return newLLMRouter(providers, defaults, channels)
+}
+
+func (r *llmRouter) llm(ctx context.Context) LLMInterface {
+	if llm, ok := r.channels[channelFromContext(ctx)]; ok {
+		return llm
+	}
+	return r.defaultLLM
+}
+
+// Prompt implements the LLMInterface for llmRouter.
+func (r *llmRouter) Prompt(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+	return r.llm(ctx).Prompt(ctx, messages, messageStore, conversationID)
+}
+
+// Summarize implements the LLMInterface for llmRouter.
+func (r *llmRouter) Summarize(ctx context.Context, messages []anthropic.MessageParam) (string, error) {
+	return r.llm(ctx).Summarize(ctx, messages)
+}
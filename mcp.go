@@ -0,0 +1,919 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/getsentry/sentry-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// mcpProtocolVersion is the Model Context Protocol revision the client
+// speaks, servers answer with the revision they picked.
+const mcpProtocolVersion = "2025-06-18"
+
+// mcpToolNameMax is the longest tool name both anthropic and openai accept.
+const mcpToolNameMax = 64
+
+// mcpServerConfig is one entry of the MCP_SERVERS env var. A server is
+// either a command speaking MCP on stdin and stdout, or the URL of a
+// streamable HTTP server.
+type mcpServerConfig struct {
+	Name    string            `json:"name"`
+	Command []string          `json:"command"`
+	Env     map[string]string `json:"env"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// Allow and Deny are path.Match patterns on the server's tool names,
+	// without Allow every tool is allowed. Deny wins.
+	Allow   []string `json:"allow"`
+	Deny    []string `json:"deny"`
+	Timeout string   `json:"timeout"`
+}
+
+var mcpServerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// parseMCPServers parses MCP_SERVERS, a JSON array such as
+//
+//	[{"name": "github", "command": ["github-mcp-server", "stdio"], "env": {"GITHUB_TOKEN": "${GITHUB_TOKEN}"}},
+//	 {"name": "docs", "url": "https://docs.example.com/mcp", "deny": ["delete_*"]}]
+func parseMCPServers(config string) ([]mcpServerConfig, error) {
+	var servers []mcpServerConfig
+	if err := json.Unmarshal([]byte(config), &servers); err != nil {
+		return nil, errors.Wrap(err, "failed to parse mcp servers")
+	}
+	names := map[string]bool{}
+	for _, server := range servers {
+		if !mcpServerNamePattern.MatchString(server.Name) {
+			return nil, errors.Errorf("mcp server name %q has to be letters, digits, _ or -", server.Name)
+		}
+		if names[server.Name] {
+			return nil, errors.Errorf("mcp server %s is configured twice", server.Name)
+		}
+		names[server.Name] = true
+		if (len(server.Command) == 0) == (server.URL == "") {
+			return nil, errors.Errorf("mcp server %s needs either a command or a url", server.Name)
+		}
+		for _, pattern := range append(append([]string{}, server.Allow...), server.Deny...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "mcp server %s: pattern %q", server.Name, pattern)
+			}
+		}
+		if server.Timeout != "" {
+			if _, err := time.ParseDuration(server.Timeout); err != nil {
+				return nil, errors.Wrapf(err, "mcp server %s", server.Name)
+			}
+		}
+	}
+	return servers, nil
+}
+
+// allows reports whether the server's tool may be given to the model.
+func (c mcpServerConfig) allows(tool string) bool {
+	for _, pattern := range c.Deny {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range c.Allow {
+		if ok, _ := path.Match(pattern, tool); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c mcpServerConfig) timeout() time.Duration {
+	if timeout, err := time.ParseDuration(c.Timeout); err == nil {
+		return timeout
+	}
+	return envDuration("MCP_TIMEOUT", 60*time.Second)
+}
+
+// mcpToolsFromEnv connects to the servers in MCP_SERVERS and returns their
+// tools, leaving out any whose name is taken by builtin or an earlier server.
+// A server that can't be reached is reported and left out so the bot still
+// starts, only a malformed MCP_SERVERS is an error. The returned func closes
+// the connections.
+func mcpToolsFromEnv(ctx context.Context, builtin []ToolHandler) ([]ToolHandler, func(), error) {
+	config := os.Getenv("MCP_SERVERS")
+	if config == "" {
+		return nil, func() {}, nil
+	}
+	servers, err := parseMCPServers(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	taken := map[string]bool{}
+	for _, tool := range builtin {
+		taken[tool.GetName()] = true
+	}
+	tools := []ToolHandler{}
+	clients := []*mcpClient{}
+	for _, server := range servers {
+		client, serverTools, err := connectMCPServer(ctx, server, taken)
+		if err != nil {
+			sentry.CaptureException(err)
+			log.WithFields(log.Fields{"server": server.Name, "error": err}).Error("failed to connect to mcp server")
+			continue
+		}
+		log.WithFields(log.Fields{"server": server.Name, "tools": len(serverTools)}).Info("connected to mcp server")
+		clients = append(clients, client)
+		tools = append(tools, serverTools...)
+	}
+	return tools, func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}, nil
+}
+
+// connectMCPServer starts or connects to server, and turns the tools it
+// allows into tool handlers named <server>__<tool>. Names in taken are left
+// out, the names used are added to it.
+func connectMCPServer(ctx context.Context, server mcpServerConfig, taken map[string]bool) (*mcpClient, []ToolHandler, error) {
+	var transport mcpTransport
+	if server.URL != "" {
+		headers := map[string]string{}
+		for key, value := range server.Headers {
+			headers[key] = os.ExpandEnv(value)
+		}
+		transport = newMCPHTTPTransport(server.URL, headers)
+	} else {
+		env := map[string]string{}
+		for key, value := range server.Env {
+			env[key] = os.ExpandEnv(value)
+		}
+		var err error
+		transport, err = newMCPStdioTransport(server.Name, server.Command, env)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	client := &mcpClient{server: server.Name, transport: transport, timeout: server.timeout()}
+
+	ctx, cancel := context.WithTimeout(ctx, client.timeout)
+	defer cancel()
+	if err := client.Initialize(ctx); err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+	tools, err := client.ListTools(ctx)
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	handlers := []ToolHandler{}
+	for _, tool := range tools {
+		if !server.allows(tool.Name) {
+			continue
+		}
+		name := mcpToolName(server.Name, tool.Name)
+		if taken[name] {
+			log.WithFields(log.Fields{"server": server.Name, "tool": tool.Name, "name": name}).Warn("mcp tool name is taken, leaving it out")
+			continue
+		}
+		handler, err := client.toolHandler(name, tool)
+		if err != nil {
+			log.WithFields(log.Fields{"server": server.Name, "tool": tool.Name, "error": err}).Warn("leaving out mcp tool")
+			continue
+		}
+		taken[name] = true
+		handlers = append(handlers, handler)
+	}
+	return client, handlers, nil
+}
+
+var mcpToolNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// mcpToolName namespaces a server's tool so servers can't clash with each
+// other or with the built in tools.
+func mcpToolName(server string, tool string) string {
+	name := mcpToolNameInvalid.ReplaceAllString(server+"__"+tool, "_")
+	if len(name) > mcpToolNameMax {
+		name = name[:mcpToolNameMax]
+	}
+	return name
+}
+
+// mcpMessage is a JSON-RPC 2.0 request, notification or response.
+type mcpMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *mcpError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.Code)
+}
+
+// isRequest reports whether m is a request the other side expects an
+// answer to, as opposed to a notification or a response.
+func (m mcpMessage) isRequest() bool {
+	return m.Method != "" && len(m.ID) > 0
+}
+
+// mcpTransport carries messages to an MCP server.
+type mcpTransport interface {
+	// RoundTrip sends a request and waits for the response with its id.
+	RoundTrip(ctx context.Context, request mcpMessage) (mcpMessage, error)
+	// Notify sends a notification, nothing comes back.
+	Notify(ctx context.Context, notification mcpMessage) error
+	Close() error
+}
+
+// mcpClient calls an MCP server. Server to client features such as
+// sampling aren't offered, only tools are used.
+type mcpClient struct {
+	server    string
+	transport mcpTransport
+	timeout   time.Duration
+	nextID    atomic.Int64
+}
+
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+type mcpContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	MimeType string `json:"mimeType"`
+	URI      string `json:"uri"`
+	Resource *struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"resource"`
+}
+
+type mcpToolResult struct {
+	Content           []mcpContent    `json:"content"`
+	StructuredContent json.RawMessage `json:"structuredContent"`
+	IsError           bool            `json:"isError"`
+}
+
+func (c *mcpClient) call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode %s params", method)
+	}
+	request := mcpMessage{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage(fmt.Sprint(c.nextID.Add(1))),
+		Method:  method,
+		Params:  rawParams,
+	}
+	response, err := c.transport.RoundTrip(ctx, request)
+	if err != nil {
+		return errors.Wrapf(err, "mcp server %s: %s", c.server, method)
+	}
+	if response.Error != nil {
+		return errors.Wrapf(response.Error, "mcp server %s: %s", c.server, method)
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return errors.Wrapf(err, "mcp server %s: invalid %s result", c.server, method)
+	}
+	return nil
+}
+
+// Initialize agrees on a protocol version with the server.
+func (c *mcpClient) Initialize(ctx context.Context) error {
+	var result struct {
+		ProtocolVersion string `json:"protocolVersion"`
+		ServerInfo      struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"serverInfo"`
+	}
+	err := c.call(ctx, "initialize", map[string]interface{}{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]interface{}{},
+		"clientInfo":      map[string]string{"name": "lucksacks", "version": "1.0.0"},
+	}, &result)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"server":          c.server,
+		"protocolVersion": result.ProtocolVersion,
+		"serverName":      result.ServerInfo.Name,
+		"serverVersion":   result.ServerInfo.Version,
+	}).Info("mcp server initialized")
+	return c.transport.Notify(ctx, mcpMessage{JSONRPC: "2.0", Method: "notifications/initialized"})
+}
+
+// ListTools pages through tools/list.
+func (c *mcpClient) ListTools(ctx context.Context) ([]mcpTool, error) {
+	tools := []mcpTool{}
+	cursor := ""
+	for {
+		params := map[string]string{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var page struct {
+			Tools      []mcpTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "tools/list", params, &page); err != nil {
+			return nil, err
+		}
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" || page.NextCursor == cursor {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// CallTool runs the server's tool, a result the server marks as an error
+// is returned as an error so the model sees it as one.
+func (c *mcpClient) CallTool(ctx context.Context, name string, arguments json.RawMessage) (string, error) {
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	var result mcpToolResult
+	err := c.call(ctx, "tools/call", map[string]interface{}{"name": name, "arguments": arguments}, &result)
+	if err != nil {
+		return "", err
+	}
+	text := mcpResultText(result)
+	if result.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+// mcpResultText flattens a tool result for the model, text is kept and
+// anything else is named.
+func mcpResultText(result mcpToolResult) string {
+	parts := []string{}
+	for _, content := range result.Content {
+		switch content.Type {
+		case "text":
+			parts = append(parts, content.Text)
+		case "resource":
+			if content.Resource != nil && content.Resource.Text != "" {
+				parts = append(parts, content.Resource.Text)
+			} else if content.Resource != nil {
+				parts = append(parts, "[resource "+content.Resource.URI+"]")
+			}
+		case "resource_link":
+			parts = append(parts, "[resource link "+content.URI+"]")
+		default:
+			parts = append(parts, fmt.Sprintf("[%s %s left out]", content.MimeType, content.Type))
+		}
+	}
+	if len(parts) == 0 && len(result.StructuredContent) > 0 {
+		return string(result.StructuredContent)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// toolHandler exposes the server's tool to the agent under name.
+func (c *mcpClient) toolHandler(name string, tool mcpTool) (ToolHandler, error) {
+	schema, err := mcpInputSchema(tool.InputSchema)
+	if err != nil {
+		return nil, err
+	}
+	description := strings.TrimSpace(tool.Description + " (" + tool.Name + " from the " + c.server + " MCP server)")
+	return newTemplateToolHandler(name, description, schema, func(ctx context.Context, input json.RawMessage) (*string, error) {
+		response, err := c.CallTool(ctx, tool.Name, input)
+		if err != nil {
+			return nil, err
+		}
+		return &response, nil
+	}), nil
+}
+
+// mcpInputSchema converts a tool's JSON schema, keywords such as $defs that
+// the anthropic type has no field for are kept as extra fields.
+func mcpInputSchema(raw json.RawMessage) (anthropic.ToolInputSchemaParam, error) {
+	var schema anthropic.ToolInputSchemaParam
+	if len(raw) == 0 {
+		return schema, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return schema, errors.Wrap(err, "invalid input schema")
+	}
+	if schemaType, ok := fields["type"]; ok && schemaType != "object" {
+		return schema, errors.Errorf("input schema is a %v, not an object", schemaType)
+	}
+	schema.Properties = fields["properties"]
+	if required, ok := fields["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				schema.Required = append(schema.Required, name)
+			}
+		}
+	}
+	for key, value := range fields {
+		switch key {
+		case "type", "properties", "required":
+		default:
+			if schema.ExtraFields == nil {
+				schema.ExtraFields = map[string]interface{}{}
+			}
+			schema.ExtraFields[key] = value
+		}
+	}
+	return schema, nil
+}
+
+func (c *mcpClient) Close() error {
+	return c.transport.Close()
+}
+
+// mcpStdioTransport runs an MCP server as a child process, messages are
+// lines of JSON on its stdin and stdout. The process only gets PATH, HOME
+// and the env of its config, not the bot's tokens. A process that exits is
+// reported and started again on the next message, it is initialized with the
+// same initialize request.
+type mcpStdioTransport struct {
+	server  string
+	command []string
+	env     map[string]string
+
+	mu         sync.Mutex
+	process    *mcpStdioProcess
+	initialize *mcpMessage
+	closed     bool
+}
+
+func newMCPStdioTransport(server string, command []string, env map[string]string) (*mcpStdioTransport, error) {
+	process, err := startMCPStdioProcess(server, command, env)
+	if err != nil {
+		return nil, err
+	}
+	return &mcpStdioTransport{server: server, command: command, env: env, process: process}, nil
+}
+
+// running returns the server's process, starting a new one if it exited.
+func (t *mcpStdioTransport) running(ctx context.Context) (*mcpStdioProcess, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, errors.Errorf("mcp server %s is closed", t.server)
+	}
+	if !t.process.exited() || t.initialize == nil {
+		return t.process, nil
+	}
+	log.WithFields(log.Fields{"server": t.server}).Warn("restarting mcp server")
+	process, err := startMCPStdioProcess(t.server, t.command, t.env)
+	if err != nil {
+		return nil, err
+	}
+	response, err := process.roundTrip(ctx, *t.initialize)
+	if err == nil && response.Error != nil {
+		err = errors.Wrapf(response.Error, "failed to initialize mcp server %s", t.server)
+	}
+	if err == nil {
+		err = process.write(mcpMessage{JSONRPC: "2.0", Method: "notifications/initialized"})
+	}
+	if err != nil {
+		process.close()
+		return nil, err
+	}
+	t.process = process
+	return process, nil
+}
+
+func (t *mcpStdioTransport) RoundTrip(ctx context.Context, request mcpMessage) (mcpMessage, error) {
+	if request.Method == "initialize" {
+		t.mu.Lock()
+		t.initialize = &request
+		t.mu.Unlock()
+	}
+	process, err := t.running(ctx)
+	if err != nil {
+		return mcpMessage{}, err
+	}
+	return process.roundTrip(ctx, request)
+}
+
+func (t *mcpStdioTransport) Notify(ctx context.Context, notification mcpMessage) error {
+	process, err := t.running(ctx)
+	if err != nil {
+		return err
+	}
+	return process.write(notification)
+}
+
+func (t *mcpStdioTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	process := t.process
+	t.mu.Unlock()
+	process.close()
+	return nil
+}
+
+// mcpStdioProcess is one run of a stdio server.
+type mcpStdioProcess struct {
+	server  string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+	// closing is set when the bot stops the process, so exiting isn't
+	// reported.
+	closing atomic.Bool
+
+	mu      sync.Mutex
+	pending map[string]chan mcpMessage
+	// done is closed when the process stops writing, err says why.
+	done chan struct{}
+	err  error
+}
+
+func startMCPStdioProcess(server string, command []string, env map[string]string) (*mcpStdioProcess, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + os.Getenv("HOME")}
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, key+"="+value)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mcp server stdin")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mcp server stdout")
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open mcp server stderr")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed to start mcp server %s", server)
+	}
+	p := &mcpStdioProcess{
+		server:  server,
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[string]chan mcpMessage{},
+		done:    make(chan struct{}),
+	}
+	go p.logStderr(stderr)
+	go p.read(stdout)
+	return p, nil
+}
+
+func (p *mcpStdioProcess) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.WithFields(log.Fields{"server": p.server, "stderr": scanner.Text()}).Info("mcp server log")
+	}
+}
+
+func (p *mcpStdioProcess) read(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var message mcpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			log.WithFields(log.Fields{"server": p.server, "error": err}).Warn("invalid message from mcp server")
+			continue
+		}
+		switch {
+		case message.isRequest():
+			p.answer(message)
+		case message.Method != "":
+			// notifications such as progress or log messages
+		default:
+			p.mu.Lock()
+			ch, ok := p.pending[string(message.ID)]
+			delete(p.pending, string(message.ID))
+			p.mu.Unlock()
+			if ok {
+				ch <- message
+			}
+		}
+	}
+	err := scanner.Err()
+	if waitErr := p.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	if err == nil {
+		err = errors.New("exited")
+	}
+	p.mu.Lock()
+	p.err = errors.Wrapf(err, "mcp server %s stopped", p.server)
+	p.mu.Unlock()
+	if !p.closing.Load() {
+		sentry.CaptureException(p.err)
+		log.WithFields(log.Fields{"server": p.server, "error": p.err}).Error("mcp server exited, it is restarted on the next call")
+	}
+	close(p.done)
+}
+
+func (p *mcpStdioProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// answer replies to requests from the server, ping is the only one the
+// client supports.
+func (p *mcpStdioProcess) answer(request mcpMessage) {
+	response := mcpMessage{JSONRPC: "2.0", ID: request.ID}
+	if request.Method == "ping" {
+		response.Result = json.RawMessage("{}")
+	} else {
+		response.Error = &mcpError{Code: -32601, Message: "method not found"}
+	}
+	if err := p.write(response); err != nil {
+		log.WithFields(log.Fields{"server": p.server, "error": err}).Warn("failed to answer mcp server")
+	}
+}
+
+func (p *mcpStdioProcess) write(message mcpMessage) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode message")
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	_, err = p.stdin.Write(append(line, '\n'))
+	return errors.Wrapf(err, "failed to write to mcp server %s", p.server)
+}
+
+func (p *mcpStdioProcess) roundTrip(ctx context.Context, request mcpMessage) (mcpMessage, error) {
+	ch := make(chan mcpMessage, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return mcpMessage{}, p.err
+	}
+	p.pending[string(request.ID)] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, string(request.ID))
+		p.mu.Unlock()
+	}()
+
+	if err := p.write(request); err != nil {
+		return mcpMessage{}, err
+	}
+	select {
+	case response := <-ch:
+		return response, nil
+	case <-p.done:
+		return mcpMessage{}, p.err
+	case <-ctx.Done():
+		// tell the server to stop working on it
+		params, _ := json.Marshal(map[string]interface{}{"requestId": request.ID, "reason": ctx.Err().Error()})
+		p.write(mcpMessage{JSONRPC: "2.0", Method: "notifications/cancelled", Params: params})
+		return mcpMessage{}, ctx.Err()
+	}
+}
+
+// close closes stdin, which asks the server to exit, and kills it if it
+// doesn't.
+func (p *mcpStdioProcess) close() {
+	p.closing.Store(true)
+	p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-time.After(5 * time.Second):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// errMCPSessionExpired is returned when a streamable HTTP server has
+// forgotten the session, the client has to initialize again.
+var errMCPSessionExpired = errors.New("mcp session expired")
+
+// mcpHTTPTransport posts every message to a streamable HTTP server, which
+// answers with JSON or with a stream of server sent events that ends with
+// the response.
+type mcpHTTPTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+
+	mu              sync.Mutex
+	sessionID       string
+	protocolVersion string
+	// initialize is replayed to start a new session when the server
+	// forgets the old one.
+	initialize *mcpMessage
+}
+
+func newMCPHTTPTransport(url string, headers map[string]string) *mcpHTTPTransport {
+	return &mcpHTTPTransport{url: url, headers: headers, client: &http.Client{}}
+}
+
+func (t *mcpHTTPTransport) RoundTrip(ctx context.Context, request mcpMessage) (mcpMessage, error) {
+	if request.Method == "initialize" {
+		t.mu.Lock()
+		t.initialize = &request
+		t.sessionID, t.protocolVersion = "", ""
+		t.mu.Unlock()
+	}
+	response, err := t.post(ctx, request)
+	if errors.Is(err, errMCPSessionExpired) && request.Method != "initialize" {
+		if err := t.reinitialize(ctx); err != nil {
+			return mcpMessage{}, err
+		}
+		response, err = t.post(ctx, request)
+	}
+	if err != nil {
+		return mcpMessage{}, err
+	}
+	if response == nil {
+		return mcpMessage{}, errors.New("no response from mcp server")
+	}
+	if request.Method == "initialize" && response.Error == nil {
+		var result struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		json.Unmarshal(response.Result, &result)
+		t.mu.Lock()
+		t.protocolVersion = result.ProtocolVersion
+		t.mu.Unlock()
+	}
+	return *response, nil
+}
+
+func (t *mcpHTTPTransport) reinitialize(ctx context.Context) error {
+	t.mu.Lock()
+	initialize := t.initialize
+	t.mu.Unlock()
+	if initialize == nil {
+		return errMCPSessionExpired
+	}
+	response, err := t.RoundTrip(ctx, *initialize)
+	if err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return errors.Wrap(response.Error, "failed to start a new mcp session")
+	}
+	return t.Notify(ctx, mcpMessage{JSONRPC: "2.0", Method: "notifications/initialized"})
+}
+
+func (t *mcpHTTPTransport) Notify(ctx context.Context, notification mcpMessage) error {
+	_, err := t.post(ctx, notification)
+	return err
+}
+
+// post sends message and reads the response to it, nil for notifications.
+func (t *mcpHTTPTransport) post(ctx context.Context, message mcpMessage) (*mcpMessage, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode message")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create mcp request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	t.setHeaders(req)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to reach mcp server")
+	}
+	defer resp.Body.Close()
+	t.mu.Lock()
+	sessionID := t.sessionID
+	if id := resp.Header.Get("Mcp-Session-Id"); id != "" {
+		t.sessionID = id
+	}
+	t.mu.Unlock()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && sessionID != "":
+		return nil, errMCPSessionExpired
+	case resp.StatusCode >= 300:
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 500))
+		return nil, errors.Errorf("mcp server answered %s: %s", resp.Status, strings.TrimSpace(string(snippet)))
+	case !message.isRequest():
+		return nil, nil
+	}
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return readMCPEvents(resp.Body, message.ID)
+	}
+	var response mcpMessage
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, errors.Wrap(err, "invalid response from mcp server")
+	}
+	return &response, nil
+}
+
+func (t *mcpHTTPTransport) setHeaders(req *http.Request) {
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", t.sessionID)
+	}
+	if t.protocolVersion != "" {
+		req.Header.Set("MCP-Protocol-Version", t.protocolVersion)
+	}
+}
+
+// readMCPEvents reads server sent events until the response with id,
+// requests and notifications sent on the way are skipped.
+func readMCPEvents(body io.Reader, id json.RawMessage) (*mcpMessage, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	data := []string{}
+	dispatch := func() *mcpMessage {
+		defer func() { data = data[:0] }()
+		if len(data) == 0 {
+			return nil
+		}
+		var message mcpMessage
+		if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &message); err != nil {
+			return nil
+		}
+		if message.Method == "" && bytes.Equal(message.ID, id) {
+			return &message
+		}
+		return nil
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if message := dispatch(); message != nil {
+				return message, nil
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			data = append(data, strings.TrimPrefix(value, " "))
+		}
+	}
+	if message := dispatch(); message != nil {
+		return message, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read mcp events")
+	}
+	return nil, errors.New("mcp server closed the stream without answering")
+}
+
+// Close ends the session.
+func (t *mcpHTTPTransport) Close() error {
+	t.mu.Lock()
+	sessionID := t.sessionID
+	t.mu.Unlock()
+	if sessionID == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.url, nil)
+	if err != nil {
+		return err
+	}
+	t.setHeaders(req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
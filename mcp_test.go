@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// mcpTestServerEnv makes the test binary serve tinyMCPServer on stdin and
+// stdout, see TestMain.
+const mcpTestServerEnv = "LUCKSACKS_MCP_TEST_SERVER"
+
+// tinyMCPServer has four tools over two pages of tools/list.
+func tinyMCPServer(request mcpMessage) *mcpMessage {
+	if !request.isRequest() {
+		return nil
+	}
+	response := &mcpMessage{JSONRPC: "2.0", ID: request.ID}
+	result := func(v interface{}) *mcpMessage {
+		response.Result, _ = json.Marshal(v)
+		return response
+	}
+	text := func(s string, isError bool) *mcpMessage {
+		return result(map[string]interface{}{"content": []map[string]string{{"type": "text", "text": s}}, "isError": isError})
+	}
+	switch request.Method {
+	case "initialize":
+		return result(map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{}},
+			"serverInfo":      map[string]string{"name": "tiny", "version": "0.1.0"},
+		})
+	case "tools/list":
+		var params struct {
+			Cursor string `json:"cursor"`
+		}
+		json.Unmarshal(request.Params, &params)
+		if params.Cursor == "" {
+			return result(map[string]interface{}{"nextCursor": "page2", "tools": []map[string]interface{}{
+				{"name": "echo", "description": "Says the text back", "inputSchema": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"text": map[string]string{"type": "string"}}, "required": []string{"text"}}},
+				{"name": "add", "description": "Adds two numbers", "inputSchema": map[string]interface{}{"type": "object", "properties": map[string]interface{}{"a": map[string]string{"type": "number"}, "b": map[string]string{"type": "number"}}, "required": []string{"a", "b"}, "additionalProperties": false}},
+			}})
+		}
+		return result(map[string]interface{}{"tools": []map[string]interface{}{
+			{"name": "fail", "inputSchema": map[string]string{"type": "object"}},
+			{"name": "delete_everything", "inputSchema": map[string]string{"type": "object"}},
+		}})
+	case "tools/call":
+		var params struct {
+			Name      string `json:"name"`
+			Arguments struct {
+				Text string  `json:"text"`
+				A    float64 `json:"a"`
+				B    float64 `json:"b"`
+			} `json:"arguments"`
+		}
+		json.Unmarshal(request.Params, &params)
+		switch params.Name {
+		case "echo":
+			return text(params.Arguments.Text, false)
+		case "add":
+			return result(map[string]interface{}{"content": []map[string]string{}, "structuredContent": map[string]float64{"sum": params.Arguments.A + params.Arguments.B}})
+		case "fail":
+			return text("it broke", true)
+		}
+		return text("unknown tool "+params.Name, true)
+	}
+	response.Error = &mcpError{Code: -32601, Message: "method not found"}
+	return response
+}
+
+// serveTestMCPStdio serves tinyMCPServer as a stdio server. It pings the
+// client and sends a log notification first, which the client has to cope
+// with. Calling the exit tool makes it exit without answering.
+func serveTestMCPStdio() {
+	out := json.NewEncoder(os.Stdout)
+	out.Encode(mcpMessage{JSONRPC: "2.0", ID: json.RawMessage(`"server-1"`), Method: "ping"})
+	out.Encode(mcpMessage{JSONRPC: "2.0", Method: "notifications/message", Params: json.RawMessage(`{"level":"info","data":"starting"}`)})
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var request mcpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			fmt.Fprintln(os.Stderr, "bad message:", err)
+			continue
+		}
+		if request.Method == "tools/call" && strings.Contains(string(request.Params), `"name":"exit"`) {
+			os.Exit(1)
+		}
+		if response := tinyMCPServer(request); response != nil {
+			out.Encode(response)
+		}
+	}
+}
+
+// testMCPHTTPServer serves tinyMCPServer over streamable HTTP, tools/call
+// answers as an event stream.
+type testMCPHTTPServer struct {
+	mu       sync.Mutex
+	sessions int
+	session  string
+	deleted  []string
+}
+
+func (s *testMCPHTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method == http.MethodDelete {
+		s.deleted = append(s.deleted, r.Header.Get("Mcp-Session-Id"))
+		return
+	}
+	var request mcpMessage
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Method == "initialize" {
+		s.sessions++
+		s.session = fmt.Sprintf("session-%d", s.sessions)
+		w.Header().Set("Mcp-Session-Id", s.session)
+	} else if r.Header.Get("Mcp-Session-Id") != s.session || s.session == "" {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	} else if r.Header.Get("MCP-Protocol-Version") != mcpProtocolVersion {
+		http.Error(w, "missing protocol version", http.StatusBadRequest)
+		return
+	}
+	response := tinyMCPServer(request)
+	if response == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if request.Method == "tools/call" {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "event: message\ndata: {\"jsonrpc\":\"2.0\",\"method\":\"notifications/progress\",\"params\":{\"progress\":1}}\n\n")
+		b, _ := json.Marshal(response)
+		fmt.Fprintf(w, "event: message\ndata: %s\n\n", b)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *testMCPHTTPServer) forgetSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.session = ""
+}
+
+func Test_connectMCPServer(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &testMCPHTTPServer{}
+	server := httptest.NewServer(httpServer)
+	defer server.Close()
+
+	for _, config := range []mcpServerConfig{
+		{Name: "tiny", Command: []string{executable}, Env: map[string]string{mcpTestServerEnv: "1"}, Deny: []string{"delete_*"}},
+		{Name: "tiny", URL: server.URL, Deny: []string{"delete_*"}},
+	} {
+		transport := "stdio"
+		if config.URL != "" {
+			transport = "http"
+		}
+		t.Run(transport, func(t *testing.T) {
+			client, tools, err := connectMCPServer(context.Background(), config, map[string]bool{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			handlers := map[string]ToolHandler{}
+			names := []string{}
+			for _, tool := range tools {
+				handlers[tool.GetName()] = tool
+				names = append(names, tool.GetName())
+			}
+			if diff := cmp.Diff([]string{"tiny__echo", "tiny__add", "tiny__fail"}, names); diff != "" {
+				t.Fatalf("tools (-want +got):\n%s", diff)
+			}
+			schema := handlers["tiny__add"].GetInputSchema()
+			if diff := cmp.Diff([]string{"a", "b"}, schema.Required); diff != "" || schema.ExtraFields["additionalProperties"] != false {
+				t.Errorf("add schema = %+v, want a and b required and no additional properties", schema)
+			}
+			if b, _ := json.Marshal(schema); !strings.Contains(string(b), `"additionalProperties":false`) {
+				t.Errorf("add schema is sent as %s, want additionalProperties kept", b)
+			}
+			if got := handlers["tiny__echo"].GetDescription(); got != "Says the text back (echo from the tiny MCP server)" {
+				t.Errorf("echo description = %q", got)
+			}
+
+			calls := []struct {
+				tool    string
+				input   string
+				want    string
+				wantErr string
+			}{
+				{tool: "tiny__echo", input: `{"text": "hello"}`, want: "hello"},
+				{tool: "tiny__add", input: `{"a": 2, "b": 3}`, want: `{"sum":5}`},
+				{tool: "tiny__fail", input: `{}`, wantErr: "it broke"},
+			}
+			for _, call := range calls {
+				got, err := handlers[call.tool].HandleTool(context.Background(), json.RawMessage(call.input))
+				if call.wantErr != "" {
+					if err == nil || !strings.Contains(err.Error(), call.wantErr) {
+						t.Errorf("%s error = %v, want %q", call.tool, err, call.wantErr)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: %v", call.tool, err)
+					continue
+				}
+				if strings.TrimSpace(*got) != call.want {
+					t.Errorf("%s = %q, want %q", call.tool, *got, call.want)
+				}
+			}
+		})
+	}
+
+	t.Run("http session expired", func(t *testing.T) {
+		client, tools, err := connectMCPServer(context.Background(), mcpServerConfig{Name: "tiny", URL: server.URL, Allow: []string{"echo"}}, map[string]bool{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tools) != 1 {
+			t.Fatalf("got %d tools, want only echo", len(tools))
+		}
+		httpServer.forgetSessions()
+		got, err := tools[0].HandleTool(context.Background(), json.RawMessage(`{"text": "again"}`))
+		if err != nil || *got != "again" {
+			t.Errorf("echo after the session expired = %v, %v, want a new session", got, err)
+		}
+		client.Close()
+		httpServer.mu.Lock()
+		defer httpServer.mu.Unlock()
+		if last := len(httpServer.deleted) - 1; last < 0 || httpServer.deleted[last] != httpServer.session {
+			t.Errorf("deleted sessions %q, want the current one %s last", httpServer.deleted, httpServer.session)
+		}
+	})
+}
+
+func Test_mcpToolsFromEnv_NameTaken(t *testing.T) {
+	server := httptest.NewServer(&testMCPHTTPServer{})
+	defer server.Close()
+	// both long names are cut to the same 64 characters
+	long := strings.Repeat("x", mcpToolNameMax)
+	config, _ := json.Marshal([]mcpServerConfig{
+		{Name: "tiny", URL: server.URL, Allow: []string{"echo", "add"}},
+		{Name: long + "1", URL: server.URL, Allow: []string{"echo"}},
+		{Name: long + "2", URL: server.URL, Allow: []string{"echo"}},
+	})
+	t.Setenv("MCP_SERVERS", string(config))
+	builtin := []ToolHandler{CreateToolHandler("tiny__echo", "Taken", func(input struct{}) (*string, error) { return nil, nil })}
+
+	tools, closeMCP, err := mcpToolsFromEnv(context.Background(), builtin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeMCP()
+	names := []string{}
+	for _, tool := range tools {
+		names = append(names, tool.GetName())
+	}
+	if diff := cmp.Diff([]string{"tiny__add", long}, names); diff != "" {
+		t.Errorf("tools (-want +got):\n%s", diff)
+	}
+}
+
+func Test_connectMCPServer_Restart(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, tools, err := connectMCPServer(context.Background(), mcpServerConfig{Name: "tiny", Command: []string{executable}, Env: map[string]string{mcpTestServerEnv: "1"}, Allow: []string{"echo"}}, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.CallTool(context.Background(), "exit", nil); err == nil || !strings.Contains(err.Error(), "stopped") {
+		t.Fatalf("exit error = %v, want the server to have stopped", err)
+	}
+	got, err := tools[0].HandleTool(context.Background(), json.RawMessage(`{"text": "again"}`))
+	if err != nil || *got != "again" {
+		t.Errorf("echo after the server exited = %v, %v, want it restarted", got, err)
+	}
+}
+
+func Test_connectMCPServer_Unreachable(t *testing.T) {
+	_, _, err := connectMCPServer(context.Background(), mcpServerConfig{Name: "gone", Command: []string{"/nonexistent/mcp-server"}}, map[string]bool{})
+	if err == nil {
+		t.Error("connecting to a missing command worked, want an error")
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without the env var the test binary runs the tests instead of serving
+	_, _, err = connectMCPServer(context.Background(), mcpServerConfig{Name: "mute", Command: []string{executable, "-test.run=^$"}, Timeout: "5s"}, map[string]bool{})
+	if err == nil {
+		t.Error("connecting to a process that exits worked, want an error")
+	}
+}
+
+func Test_parseMCPServers(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{name: "stdio and http", config: `[{"name": "github", "command": ["github-mcp-server", "stdio"]}, {"name": "docs", "url": "https://docs.example.com/mcp", "deny": ["delete_*"]}]`},
+		{name: "no name", config: `[{"url": "https://docs.example.com/mcp"}]`, wantErr: "has to be letters"},
+		{name: "name with spaces", config: `[{"name": "my docs", "url": "https://docs.example.com/mcp"}]`, wantErr: "has to be letters"},
+		{name: "twice", config: `[{"name": "docs", "url": "https://a"}, {"name": "docs", "url": "https://b"}]`, wantErr: "configured twice"},
+		{name: "command and url", config: `[{"name": "docs", "command": ["docs"], "url": "https://a"}]`, wantErr: "either a command or a url"},
+		{name: "neither", config: `[{"name": "docs"}]`, wantErr: "either a command or a url"},
+		{name: "bad pattern", config: `[{"name": "docs", "url": "https://a", "allow": ["[a-"]}]`, wantErr: "pattern"},
+		{name: "bad timeout", config: `[{"name": "docs", "url": "https://a", "timeout": "soon"}]`, wantErr: "invalid duration"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMCPServers(tt.config)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("parseMCPServers() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_mcpServerConfig_allows(t *testing.T) {
+	config := mcpServerConfig{Allow: []string{"get_*", "search"}, Deny: []string{"get_secret*"}}
+	for tool, want := range map[string]bool{
+		"get_issue":    true,
+		"search":       true,
+		"get_secrets":  false,
+		"create_issue": false,
+	} {
+		if got := config.allows(tool); got != want {
+			t.Errorf("allows(%q) = %v, want %v", tool, got, want)
+		}
+	}
+	if !(mcpServerConfig{Deny: []string{"delete_*"}}).allows("create_issue") {
+		t.Error("without allow every tool that isn't denied should be allowed")
+	}
+}
+
+func Test_mcpToolName(t *testing.T) {
+	tests := []struct {
+		server string
+		tool   string
+		want   string
+	}{
+		{server: "github", tool: "create_issue", want: "github__create_issue"},
+		{server: "docs", tool: "search.pages v2", want: "docs__search_pages_v2"},
+		{server: "docs", tool: strings.Repeat("x", 80), want: "docs__" + strings.Repeat("x", mcpToolNameMax-6)},
+	}
+	for _, tt := range tests {
+		if got := mcpToolName(tt.server, tt.tool); got != tt.want {
+			t.Errorf("mcpToolName(%q, %q) = %q, want %q", tt.server, tt.tool, got, tt.want)
+		}
+	}
+}
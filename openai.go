@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// openAIClient speaks the OpenAI chat completions protocol, which OpenAI and
+// most self-hosted servers (llama.cpp, Ollama, vLLM) implement.
+type openAIClient struct {
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+func newOpenAIClient(baseURL string, apiKey string) *openAIClient {
+	return &openAIClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		apiKey:  apiKey,
+		http:    &http.Client{Timeout: envDuration("OPENAI_TIMEOUT", 5*time.Minute)},
+	}
+}
+
+// openAIClientFromEnv reads OPENAI_BASE_URL and OPENAI_API_KEY. The key falls
+// back to OPENAPI_SECRET_KEY, which /gpt3 used to read, and may be empty for
+// local servers.
+func openAIClientFromEnv() *openAIClient {
+	baseURL := os.Getenv("OPENAI_BASE_URL")
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		apiKey = os.Getenv("OPENAPI_SECRET_KEY")
+	}
+	return newOpenAIClient(baseURL, apiKey)
+}
+
+type openAIChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []openAIMessage `json:"messages"`
+	Tools    []openAITool    `json:"tools,omitempty"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string         `json:"type"`
+	Function openAIFunction `json:"function"`
+}
+
+type openAIFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int64 `json:"prompt_tokens"`
+		CompletionTokens int64 `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// chat posts a chat completion request.
+func (c *openAIClient) chat(ctx context.Context, request openAIChatRequest) (*openAIChatResponse, error) {
+	b, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't encode chat request")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/chat/completions", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "chat request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4_000))
+		return nil, errors.Errorf("chat request failed with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var response openAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, errors.Wrap(err, "couldn't decode chat response")
+	}
+	if len(response.Choices) == 0 {
+		return nil, errors.New("chat response had no choices")
+	}
+	return &response, nil
+}
+
+var _ LLMInterface = &openAILLM{}
+
+// openAILLM runs conversations against an OpenAI compatible server. Replies
+// are not streamed, they arrive in one piece once the model is done.
+type openAILLM struct {
+	client         *openAIClient
+	model          string
+	messageHandler messageHandler
+}
+
+func newOpenAILLM(client *openAIClient, model string, messageHandler messageHandler) *openAILLM {
+	return &openAILLM{
+		client:         client,
+		model:          model,
+		messageHandler: messageHandler,
+	}
+}
+
+// Prompt implements the LLMInterface for openAILLM.
+func (l *openAILLM) Prompt(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+	tools, err := openAITools(l.messageHandler.ToolParams(ctx))
+	if err != nil {
+		return nil, err
+	}
+	response, err := l.client.chat(ctx, openAIChatRequest{
+		Model:    modelFor(ctx, l.model),
+		Messages: openAIMessages(systemPromptFor(ctx), messages),
+		Tools:    tools,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create message")
+	}
+	turn, err := openAITurn(response)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.messageHandler.HandleMessage(ctx, turn, messageStore, conversationID)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't handle message")
+	}
+	return resp, nil
+}
+
+// Summarize implements the LLMInterface for openAILLM.
+func (l *openAILLM) Summarize(ctx context.Context, messages []anthropic.MessageParam) (string, error) {
+	response, err := l.client.chat(ctx, openAIChatRequest{
+		Model: l.model,
+		Messages: []openAIMessage{
+			{Role: "system", Content: summarizePrompt},
+			{Role: "user", Content: summaryTranscript(messages)},
+		},
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't summarize conversation")
+	}
+	summary := strings.TrimSpace(response.Choices[0].Message.Content)
+	if summary == "" {
+		return "", errors.New("the summary was empty")
+	}
+	return summary, nil
+}
+
+// openAITools describes the tools as functions.
+func openAITools(params []anthropic.ToolUnionParam) ([]openAITool, error) {
+	tools := make([]openAITool, 0, len(params))
+	for _, param := range params {
+		if param.OfTool == nil {
+			continue
+		}
+		schema, err := json.Marshal(param.OfTool.InputSchema)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't encode the schema of %s", param.OfTool.Name)
+		}
+		tool := openAITool{Type: "function", Function: openAIFunction{Name: param.OfTool.Name, Parameters: schema}}
+		if param.OfTool.Description.Valid() {
+			tool.Function.Description = param.OfTool.Description.Value
+		}
+		tools = append(tools, tool)
+	}
+	return tools, nil
+}
+
+// openAIMessages converts a stored conversation to chat messages. Tool
+// results become tool messages and thinking is left out.
+func openAIMessages(system []string, messages []anthropic.MessageParam) []openAIMessage {
+	converted := []openAIMessage{{Role: "system", Content: strings.Join(system, "\n")}}
+	for _, message := range messages {
+		texts := []string{}
+		toolCalls := []openAIToolCall{}
+		for _, block := range message.Content {
+			switch {
+			case block.OfText != nil:
+				texts = append(texts, block.OfText.Text)
+			case block.OfToolUse != nil:
+				input, err := json.Marshal(block.OfToolUse.Input)
+				if err != nil {
+					input = []byte("{}")
+				}
+				call := openAIToolCall{ID: block.OfToolUse.ID, Type: "function"}
+				call.Function.Name = block.OfToolUse.Name
+				call.Function.Arguments = string(input)
+				toolCalls = append(toolCalls, call)
+			case block.OfToolResult != nil:
+				result := []string{}
+				for _, c := range block.OfToolResult.Content {
+					if c.OfText != nil {
+						result = append(result, c.OfText.Text)
+					}
+				}
+				converted = append(converted, openAIMessage{
+					Role:       "tool",
+					ToolCallID: block.OfToolResult.ToolUseID,
+					Content:    strings.Join(result, "\n"),
+				})
+			}
+		}
+		if len(texts) == 0 && len(toolCalls) == 0 {
+			continue
+		}
+		converted = append(converted, openAIMessage{
+			Role:      string(message.Role),
+			Content:   strings.Join(texts, "\n\n"),
+			ToolCalls: toolCalls,
+		})
+	}
+	return converted
+}
+
+// openAITurn converts a chat reply. Tool calls without an id are given one,
+// and arguments that are not valid JSON are passed on as a JSON string so
+// the tool fails with an error the model can see.
+func openAITurn(response *openAIChatResponse) (assistantTurn, error) {
+	message := response.Choices[0].Message
+	blocks := []anthropic.ContentBlockParamUnion{}
+	if text := strings.TrimSpace(message.Content); text != "" {
+		blocks = append(blocks, anthropic.NewTextBlock(text))
+	}
+	for _, call := range message.ToolCalls {
+		id := call.ID
+		if id == "" {
+			id = "call_" + uuid.New().String()
+		}
+		input := json.RawMessage(call.Function.Arguments)
+		if strings.TrimSpace(call.Function.Arguments) == "" {
+			input = json.RawMessage("{}")
+		} else if !json.Valid(input) {
+			input, _ = json.Marshal(call.Function.Arguments)
+		}
+		blocks = append(blocks, anthropic.NewToolUseBlock(id, input, call.Function.Name))
+	}
+	if len(blocks) == 0 {
+		return assistantTurn{}, errors.New("the model returned an empty reply")
+	}
+	return assistantTurn{
+		Message:      anthropic.NewAssistantMessage(blocks...),
+		InputTokens:  response.Usage.PromptTokens,
+		OutputTokens: response.Usage.CompletionTokens,
+	}, nil
+}
+
+// complete sends a single prompt without tools or history.
+func (c *openAIClient) complete(ctx context.Context, model string, prompt string) (string, error) {
+	response, err := c.chat(ctx, openAIChatRequest{
+		Model:    model,
+		Messages: []openAIMessage{{Role: "user", Content: prompt}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return response.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// fakeChatServer answers chat completion requests with replies in order, the
+// way a local llama.cpp or Ollama server would, and records the requests.
+func fakeChatServer(t *testing.T, replies []string) (*httptest.Server, func() []openAIChatRequest) {
+	t.Helper()
+	var mu sync.Mutex
+	requests := []openAIChatRequest{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			t.Errorf("unexpected call to %s", r.URL.Path)
+		}
+		var request openAIChatRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request)
+		if len(requests) > len(replies) {
+			http.Error(w, `{"error": "no more replies"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(replies[len(requests)-1]))
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []openAIChatRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]openAIChatRequest{}, requests...)
+	}
+}
+
+func TestOpenAILLM_ToolCalls(t *testing.T) {
+	server, requests := fakeChatServer(t, []string{
+		`{"choices": [{"message": {"role": "assistant", "content": null, "tool_calls": [
+			{"id": "call_1", "type": "function", "function": {"name": "echo", "arguments": "{\"text\": \"hi\"}"}},
+			{"type": "function", "function": {"name": "echo", "arguments": "not json"}}
+		]}}], "usage": {"prompt_tokens": 12, "completion_tokens": 3}}`,
+		`{"choices": [{"message": {"role": "assistant", "content": "echo said hi"}}], "usage": {"prompt_tokens": 20, "completion_tokens": 4}}`,
+	})
+	handler := NewAnthropicMessageHandler([]ToolHandler{
+		CreateToolHandler("echo", "Echo the text back", func(input struct {
+			Text string `json:"text"`
+		}) (*string, error) {
+			return &input.Text, nil
+		}),
+	})
+	store := NewSlackMessageStore(newOpenAILLM(newOpenAIClient(server.URL+"/v1/", ""), "llama3.1", handler))
+
+	resp, err := store.CallLLM(context.Background(), "thread", "say hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Loop || resp.InputTokens != 12 || resp.OutputTokens != 3 {
+		t.Errorf("CallLLM() = %+v, want a tool call loop with the usage", resp)
+	}
+	resp, err = store.Loop(context.Background(), "thread", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Loop || strings.TrimSpace(resp.Message) != "echo said hi" {
+		t.Errorf("Loop() = %+v, want the final answer", resp)
+	}
+
+	sent := requests()
+	if len(sent) != 2 {
+		t.Fatalf("sent %d requests, want 2", len(sent))
+	}
+	first := sent[0]
+	if first.Model != "llama3.1" || len(first.Tools) != 1 || first.Tools[0].Function.Name != "echo" || first.Messages[0].Role != "system" {
+		t.Errorf("first request = %+v, want the model, the echo tool and the system prompt", first)
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(first.Tools[0].Function.Parameters, &schema); err != nil || schema["type"] != "object" {
+		t.Errorf("echo parameters = %s, want an object schema", first.Tools[0].Function.Parameters)
+	}
+
+	// the follow up carries the tool calls and one tool message per call
+	messages := sent[1].Messages
+	if len(messages) < 5 {
+		t.Fatalf("second request has %d messages, want at least 5: %+v", len(messages), messages)
+	}
+	calls := messages[2].ToolCalls
+	if messages[2].Role != "assistant" || len(calls) != 2 || calls[0].ID != "call_1" || calls[1].ID == "" {
+		t.Errorf("assistant message = %+v, want both tool calls with ids", messages[2])
+	}
+	if messages[3].Role != "tool" || messages[3].ToolCallID != "call_1" || messages[3].Content != "hi" {
+		t.Errorf("first tool message = %+v, want hi for call_1", messages[3])
+	}
+	if messages[4].Role != "tool" || messages[4].ToolCallID != calls[1].ID || !strings.HasPrefix(messages[4].Content, "Error:") {
+		t.Errorf("second tool message = %+v, want an error for the invalid arguments", messages[4])
+	}
+
+	// the stored conversation is still valid for the anthropic provider
+	stored := store.GetMessages()["thread"]
+	assertToolPairs(t, stored)
+	if text := stored[len(stored)-1].Content[0].OfText; text == nil || text.Text != "echo said hi" {
+		t.Errorf("last stored message = %+v, want the answer", stored[len(stored)-1])
+	}
+}
+
+func TestLLMRouter(t *testing.T) {
+	providers := llmProviders{openAIClient: newOpenAIClient("http://localhost", "")}
+	router, err := newLLMRouter(providers, llmConfig{Provider: "anthropic", Model: "claude-opus-4-0"}, map[string]llmConfig{
+		"CLOCAL":  {Provider: "openai", Model: "llama3.1"},
+		"COTHER":  {Provider: "openai", Model: "llama3.1"},
+		"CCLAUDE": {Model: "claude-sonnet-4-0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		channel string
+		want    string
+	}{
+		{channel: "", want: "anthropic claude-opus-4-0"},
+		{channel: "CUNKNOWN", want: "anthropic claude-opus-4-0"},
+		{channel: "CLOCAL", want: "openai llama3.1"},
+		{channel: "CCLAUDE", want: "anthropic claude-sonnet-4-0"},
+	}
+	for _, tt := range tests {
+		got := ""
+		switch llm := router.llm(withChannel(context.Background(), tt.channel)).(type) {
+		case *LLM:
+			got = "anthropic " + string(llm.model)
+		case *openAILLM:
+			got = "openai " + llm.model
+		}
+		if got != tt.want {
+			t.Errorf("llm for channel %q = %s, want %s", tt.channel, got, tt.want)
+		}
+	}
+	if router.channels["CLOCAL"] != router.channels["COTHER"] {
+		t.Errorf("channels with the same config got different LLMs")
+	}
+
+	if _, err := newLLMRouter(providers, llmConfig{Provider: "anthropic"}, map[string]llmConfig{"C1": {Provider: "gemini"}}); err == nil {
+		t.Errorf("newLLMRouter() with an unknown provider succeeded")
+	}
+}
+
+func Test_openAIMessages(t *testing.T) {
+	messages := []anthropic.MessageParam{
+		anthropic.NewUserMessage(anthropic.NewTextBlock("hi")),
+		{
+			Role: anthropic.MessageParamRoleAssistant,
+			Content: []anthropic.ContentBlockParamUnion{
+				anthropic.NewThinkingBlock("sig", "the user said hi"),
+				anthropic.NewTextBlock("hello"),
+			},
+		},
+	}
+	got := openAIMessages([]string{"be brief"}, messages)
+	if len(got) != 3 || got[0].Content != "be brief" || got[1].Content != "hi" || got[2].Content != "hello" {
+		t.Errorf("openAIMessages() = %+v, want system, user and assistant without thinking", got)
+	}
+}
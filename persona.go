@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// personaDMScope is the scope of the persona used in direct messages.
+const personaDMScope = "dm"
+
+// personaTeamScope is the scope of a workspace's persona.
+func personaTeamScope(teamID string) string {
+	return "team:" + teamID
+}
+
+// persona is how the agent behaves in a channel, in direct messages or in a
+// workspace. Settings left empty fall back to the deployment's defaults.
+type persona struct {
+	// Scope is a channel id, personaDMScope or a personaTeamScope.
+	Scope string `json:"scope"`
+	// SystemPrompt is added after the built-in slack formatting prompt.
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// Tools the model may use, nil allows every tool.
+	Tools []string `json:"tools,omitempty"`
+	// Model overrides the model of the channel's provider.
+	Model string `json:"model,omitempty"`
+	// ThinkingBudget of 0 uses the default, a negative budget turns extended
+	// thinking off.
+	ThinkingBudget int    `json:"thinking_budget,omitempty"`
+	UpdatedBy      string `json:"updated_by,omitempty"`
+}
+
+// personaStore keeps personas by scope. Get returns nil when the scope has
+// no persona.
+type personaStore interface {
+	Get(ctx context.Context, scope string) (*persona, error)
+	Set(ctx context.Context, p persona) error
+	Delete(ctx context.Context, scope string) error
+	List(ctx context.Context) ([]persona, error)
+}
+
+// newPersonaStore keeps personas next to the conversations: in db, or in
+// memory when db is nil.
+func newPersonaStore(db *sql.DB) (personaStore, error) {
+	if db == nil {
+		return newMemoryPersonaStore(), nil
+	}
+	return newPostgresPersonaStore(db)
+}
+
+// personaScopes are the scopes that apply to a conversation in channel, most
+// specific first.
+func personaScopes(channel string, teamID string) []string {
+	scopes := []string{}
+	if channel != "" {
+		scopes = append(scopes, channel)
+	}
+	if strings.HasPrefix(channel, "D") {
+		scopes = append(scopes, personaDMScope)
+	}
+	if teamID != "" {
+		scopes = append(scopes, personaTeamScope(teamID))
+	}
+	return scopes
+}
+
+// findPersona returns the most specific persona for a conversation in
+// channel, or nil if none is set.
+func findPersona(ctx context.Context, store personaStore, channel string, teamID string) (*persona, error) {
+	for _, scope := range personaScopes(channel, teamID) {
+		p, err := store.Get(ctx, scope)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// resolvePersona is findPersona for the agent. A persona that can't be read
+// is logged and the defaults are used, so the bot still answers.
+func resolvePersona(ctx context.Context, store personaStore, channel string, teamID string) *persona {
+	p, err := findPersona(ctx, store, channel, teamID)
+	if err != nil {
+		log.WithFields(log.Fields{"reqID": reqIDFromContext(ctx), "channel": channel, "error": err}).Error("failed to load persona")
+		return nil
+	}
+	return p
+}
+
+type personaKey struct{}
+
+// withPersona applies p to the agent running in ctx, narrowing the allowed
+// tools if p lists them. A nil persona leaves ctx as it is.
+func withPersona(ctx context.Context, p *persona) context.Context {
+	if p == nil {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, personaKey{}, p)
+	if p.Tools != nil {
+		ctx = withAllowedTools(ctx, p.Tools)
+	}
+	return ctx
+}
+
+func personaFromContext(ctx context.Context) *persona {
+	p, _ := ctx.Value(personaKey{}).(*persona)
+	return p
+}
+
+// systemPromptFor is the system prompt with the persona's prompt, if any,
+// added at the end.
+func systemPromptFor(ctx context.Context) []string {
+	prompt := append([]string{}, systemPrompt...)
+	if p := personaFromContext(ctx); p != nil && strings.TrimSpace(p.SystemPrompt) != "" {
+		prompt = append(prompt, p.SystemPrompt)
+	}
+	return prompt
+}
+
+// modelFor is the persona's model, or def.
+func modelFor(ctx context.Context, def string) string {
+	if p := personaFromContext(ctx); p != nil && p.Model != "" {
+		return p.Model
+	}
+	return def
+}
+
+// thinkingBudgetFor is the persona's thinking budget, or def. 0 means
+// thinking is off.
+func thinkingBudgetFor(ctx context.Context, def int64) int64 {
+	p := personaFromContext(ctx)
+	switch {
+	case p == nil || p.ThinkingBudget == 0:
+		return def
+	case p.ThinkingBudget < 0:
+		return 0
+	default:
+		return int64(p.ThinkingBudget)
+	}
+}
+
+var _ personaStore = &memoryPersonaStore{}
+
+// memoryPersonaStore keeps personas until the process exits.
+type memoryPersonaStore struct {
+	mu       sync.RWMutex
+	personas map[string]persona
+}
+
+func newMemoryPersonaStore() *memoryPersonaStore {
+	return &memoryPersonaStore{personas: make(map[string]persona)}
+}
+
+func (s *memoryPersonaStore) Get(ctx context.Context, scope string) (*persona, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.personas[scope]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+func (s *memoryPersonaStore) Set(ctx context.Context, p persona) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.personas[p.Scope] = p
+	return nil
+}
+
+func (s *memoryPersonaStore) Delete(ctx context.Context, scope string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.personas, scope)
+	return nil
+}
+
+func (s *memoryPersonaStore) List(ctx context.Context) ([]persona, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	personas := make([]persona, 0, len(s.personas))
+	for _, p := range s.personas {
+		personas = append(personas, p)
+	}
+	sort.Slice(personas, func(i, j int) bool { return personas[i].Scope < personas[j].Scope })
+	return personas, nil
+}
+
+const postgresPersonaStoreSchema = `
+CREATE TABLE IF NOT EXISTS agent_personas (
+    scope TEXT PRIMARY KEY,
+    system_prompt TEXT NOT NULL DEFAULT '',
+    tools JSONB,
+    model TEXT NOT NULL DEFAULT '',
+    thinking_budget INTEGER NOT NULL DEFAULT 0,
+    updated_by TEXT NOT NULL DEFAULT '',
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+var _ personaStore = &postgresPersonaStore{}
+
+// postgresPersonaStore keeps personas in the agent_personas table. A NULL
+// tools column allows every tool.
+type postgresPersonaStore struct {
+	db *sql.DB
+}
+
+func newPostgresPersonaStore(db *sql.DB) (*postgresPersonaStore, error) {
+	if _, err := db.Exec(postgresPersonaStoreSchema); err != nil {
+		return nil, errors.Wrap(err, "failed to migrate persona schema")
+	}
+	return &postgresPersonaStore{db: db}, nil
+}
+
+const personaColumns = `scope, system_prompt, tools, model, thinking_budget, updated_by`
+
+type personaScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPersona(row personaScanner) (persona, error) {
+	var p persona
+	var tools []byte
+	if err := row.Scan(&p.Scope, &p.SystemPrompt, &tools, &p.Model, &p.ThinkingBudget, &p.UpdatedBy); err != nil {
+		return p, err
+	}
+	if tools != nil {
+		if err := json.Unmarshal(tools, &p.Tools); err != nil {
+			return p, errors.Wrapf(err, "invalid tools for persona %s", p.Scope)
+		}
+	}
+	return p, nil
+}
+
+func (s *postgresPersonaStore) Get(ctx context.Context, scope string) (*persona, error) {
+	p, err := scanPersona(s.db.QueryRowContext(ctx, `SELECT `+personaColumns+` FROM agent_personas WHERE scope = $1`, scope))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load persona")
+	}
+	return &p, nil
+}
+
+func (s *postgresPersonaStore) Set(ctx context.Context, p persona) error {
+	// a nil interface is written as NULL
+	var tools interface{}
+	if p.Tools != nil {
+		b, err := json.Marshal(p.Tools)
+		if err != nil {
+			return errors.Wrap(err, "failed to encode tools")
+		}
+		tools = string(b)
+	}
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO agent_personas (`+personaColumns+`, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)
+ON CONFLICT (scope) DO UPDATE SET
+    system_prompt = EXCLUDED.system_prompt,
+    tools = EXCLUDED.tools,
+    model = EXCLUDED.model,
+    thinking_budget = EXCLUDED.thinking_budget,
+    updated_by = EXCLUDED.updated_by,
+    updated_at = CURRENT_TIMESTAMP`,
+		p.Scope, p.SystemPrompt, tools, p.Model, p.ThinkingBudget, p.UpdatedBy)
+	return errors.Wrap(err, "failed to save persona")
+}
+
+func (s *postgresPersonaStore) Delete(ctx context.Context, scope string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM agent_personas WHERE scope = $1`, scope)
+	return errors.Wrap(err, "failed to delete persona")
+}
+
+func (s *postgresPersonaStore) List(ctx context.Context) ([]persona, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+personaColumns+` FROM agent_personas ORDER BY scope`)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list personas")
+	}
+	defer rows.Close()
+	personas := []persona{}
+	for rows.Next() {
+		p, err := scanPersona(rows)
+		if err != nil {
+			return nil, err
+		}
+		personas = append(personas, p)
+	}
+	return personas, errors.Wrap(rows.Err(), "failed to list personas")
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+const personaHelp = `configures how the bot behaves in a channel, in DMs or in the whole workspace. the most specific persona wins: channel, then dm, then workspace.
+
+/persona show - the persona used here
+/persona list - every persona, for admins
+/persona set <scope> prompt <text> - extra system prompt
+/persona set <scope> tools <a,b,c|all|none> - tools the bot may use
+/persona set <scope> model <name|default> - model to use
+/persona set <scope> thinking <tokens|off|default> - extended thinking budget
+/persona clear <scope> - remove the persona
+
+<scope> is here, dm, workspace or a #channel. listing and changing personas is limited to workspace admins.`
+
+// personaSetPattern matches set <scope> <setting> <value>, the value can
+// span lines.
+var personaSetPattern = regexp.MustCompile(`(?s)^set\s+\S+\s+(\S+)\s*(.*)$`)
+
+var slackChannelPattern = regexp.MustCompile(`^<#([A-Z0-9]+)(?:\|[^>]*)?>$|^([CDG][A-Z0-9]+)$`)
+
+// personaCommand handles /persona.
+type personaCommand struct {
+	store personaStore
+	api   *slack.Client
+	// tools are the names of the registered tools, used to check tool lists.
+	tools []string
+	// admins may change personas. When it is empty workspace admins and
+	// owners may.
+	admins map[string]bool
+}
+
+func newPersonaCommand(store personaStore, api *slack.Client, tools []ToolHandler) *personaCommand {
+	names := []string{}
+	for _, tool := range tools {
+		names = append(names, tool.GetName())
+	}
+	admins := map[string]bool{}
+	for _, id := range strings.Split(os.Getenv("PERSONA_ADMINS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+	return &personaCommand{store: store, api: api, tools: names, admins: admins}
+}
+
+// Run returns the reply to the command. Errors are meant to be shown to the
+// user.
+func (c *personaCommand) Run(ctx context.Context, s slack.SlashCommand) (string, error) {
+	args := strings.Fields(s.Text)
+	if len(args) == 0 {
+		args = []string{"show"}
+	}
+	switch args[0] {
+	case "show":
+		return c.show(ctx, s)
+	case "list":
+		// personas of private channels and DMs are listed too
+		if err := c.checkAdmin(ctx, s.UserID); err != nil {
+			return "", err
+		}
+		return c.list(ctx)
+	case "set", "clear":
+		if err := c.checkAdmin(ctx, s.UserID); err != nil {
+			return "", err
+		}
+		if len(args) < 2 {
+			return "", errors.Errorf("%s needs a scope\n\n%s", args[0], personaHelp)
+		}
+		scope, err := personaScope(args[1], s)
+		if err != nil {
+			return "", err
+		}
+		if args[0] == "clear" {
+			if err := c.store.Delete(ctx, scope); err != nil {
+				return "", err
+			}
+			return "cleared the persona for " + describeScope(scope), nil
+		}
+		return c.set(ctx, s, scope, strings.TrimSpace(s.Text))
+	default:
+		return personaHelp, nil
+	}
+}
+
+func (c *personaCommand) show(ctx context.Context, s slack.SlashCommand) (string, error) {
+	p, err := findPersona(ctx, c.store, s.ChannelID, s.TeamID)
+	if err != nil {
+		return "", err
+	}
+	if p == nil {
+		return "no persona is set here, the defaults are used", nil
+	}
+	return formatPersona(*p), nil
+}
+
+func (c *personaCommand) list(ctx context.Context) (string, error) {
+	personas, err := c.store.List(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(personas) == 0 {
+		return "no personas are set", nil
+	}
+	lines := []string{}
+	for _, p := range personas {
+		lines = append(lines, formatPersona(p))
+	}
+	return strings.Join(lines, "\n\n"), nil
+}
+
+// set changes one setting of the persona for scope, text is the whole
+// command text so prompts keep their line breaks.
+func (c *personaCommand) set(ctx context.Context, s slack.SlashCommand, scope string, text string) (string, error) {
+	m := personaSetPattern.FindStringSubmatch(text)
+	if m == nil {
+		return "", errors.Errorf("set needs a scope, a setting and a value\n\n%s", personaHelp)
+	}
+	setting, value := m[1], strings.TrimSpace(m[2])
+
+	p, err := c.store.Get(ctx, scope)
+	if err != nil {
+		return "", err
+	}
+	if p == nil {
+		p = &persona{Scope: scope}
+	}
+	switch setting {
+	case "prompt":
+		p.SystemPrompt = value
+	case "tools":
+		tools, err := c.parseTools(value)
+		if err != nil {
+			return "", err
+		}
+		p.Tools = tools
+	case "model":
+		if value == "default" {
+			value = ""
+		}
+		p.Model = value
+	case "thinking":
+		switch value {
+		case "default", "":
+			p.ThinkingBudget = 0
+		case "off":
+			p.ThinkingBudget = -1
+		default:
+			budget, err := strconv.Atoi(value)
+			if err != nil || budget < 1024 {
+				return "", errors.Errorf("thinking takes a number of tokens of at least 1024, off or default, not %q", value)
+			}
+			p.ThinkingBudget = budget
+		}
+	default:
+		return "", errors.Errorf("unknown setting %q, use prompt, tools, model or thinking", setting)
+	}
+	p.UpdatedBy = s.UserID
+	if err := c.store.Set(ctx, *p); err != nil {
+		return "", err
+	}
+	return "updated the persona\n\n" + formatPersona(*p), nil
+}
+
+// parseTools reads a comma separated tool list. "all" allows every tool and
+// "none" allows none.
+func (c *personaCommand) parseTools(value string) ([]string, error) {
+	switch value {
+	case "all", "":
+		return nil, nil
+	case "none":
+		return []string{}, nil
+	}
+	known := map[string]bool{}
+	for _, name := range c.tools {
+		known[name] = true
+	}
+	tools := []string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, errors.Errorf("unknown tool %q, available tools: %s", name, strings.Join(c.tools, ", "))
+		}
+		tools = append(tools, name)
+	}
+	return tools, nil
+}
+
+func (c *personaCommand) checkAdmin(ctx context.Context, userID string) error {
+	if len(c.admins) > 0 {
+		if c.admins[userID] {
+			return nil
+		}
+		return errors.New("only persona admins can list or change personas")
+	}
+	admin, err := workspaceAdmin(ctx, c.api, userID)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return errors.New("only workspace admins can list or change personas")
+	}
+	return nil
+}
+
+// workspaceAdmin reports whether the user is an admin or owner of the
+// workspace.
+func workspaceAdmin(ctx context.Context, api *slack.Client, userID string) (bool, error) {
+	user, err := api.GetUserInfoContext(ctx, userID)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't check if you are an admin")
+	}
+	return user.IsAdmin || user.IsOwner, nil
+}
+
+// personaScope turns the scope argument into a store scope.
+func personaScope(arg string, s slack.SlashCommand) (string, error) {
+	switch arg {
+	case "here":
+		return s.ChannelID, nil
+	case "dm", "dms":
+		return personaDMScope, nil
+	case "workspace":
+		return personaTeamScope(s.TeamID), nil
+	}
+	if m := slackChannelPattern.FindStringSubmatch(arg); m != nil {
+		return m[1] + m[2], nil
+	}
+	return "", errors.Errorf("unknown scope %q, use here, dm, workspace or a #channel", arg)
+}
+
+func describeScope(scope string) string {
+	switch {
+	case scope == personaDMScope:
+		return "direct messages"
+	case strings.HasPrefix(scope, "team:"):
+		return "the workspace"
+	default:
+		return "<#" + scope + ">"
+	}
+}
+
+func formatPersona(p persona) string {
+	lines := []string{"persona for " + describeScope(p.Scope)}
+	prompt := p.SystemPrompt
+	if prompt == "" {
+		prompt = "(default)"
+	}
+	lines = append(lines, "prompt: "+prompt)
+	switch {
+	case p.Tools == nil:
+		lines = append(lines, "tools: all")
+	case len(p.Tools) == 0:
+		lines = append(lines, "tools: none")
+	default:
+		lines = append(lines, "tools: "+strings.Join(p.Tools, ", "))
+	}
+	model := p.Model
+	if model == "" {
+		model = "default"
+	}
+	lines = append(lines, "model: "+model)
+	switch {
+	case p.ThinkingBudget < 0:
+		lines = append(lines, "thinking: off")
+	case p.ThinkingBudget == 0:
+		lines = append(lines, "thinking: default")
+	default:
+		lines = append(lines, fmt.Sprintf("thinking: %d tokens", p.ThinkingBudget))
+	}
+	if p.UpdatedBy != "" {
+		lines = append(lines, "updated by <@"+p.UpdatedBy+">")
+	}
+	return strings.Join(lines, "\n")
+}
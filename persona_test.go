@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/google/go-cmp/cmp"
+	"github.com/slack-go/slack"
+)
+
+func Test_findPersona(t *testing.T) {
+	store := newMemoryPersonaStore()
+	for _, p := range []persona{
+		{Scope: "CDATA", SystemPrompt: "data"},
+		{Scope: personaDMScope, SystemPrompt: "dm"},
+		{Scope: personaTeamScope("T1"), SystemPrompt: "workspace"},
+	} {
+		store.Set(context.Background(), p)
+	}
+	tests := []struct {
+		channel string
+		team    string
+		want    string
+	}{
+		{channel: "CDATA", team: "T1", want: "data"},
+		{channel: "D123", team: "T1", want: "dm"},
+		{channel: "CSOCIAL", team: "T1", want: "workspace"},
+		{channel: "CSOCIAL", team: "T2", want: ""},
+	}
+	for _, tt := range tests {
+		p, err := findPersona(context.Background(), store, tt.channel, tt.team)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if p != nil {
+			got = p.SystemPrompt
+		}
+		if got != tt.want {
+			t.Errorf("findPersona(%s, %s) = %q, want %q", tt.channel, tt.team, got, tt.want)
+		}
+	}
+}
+
+func Test_personaCommand(t *testing.T) {
+	store := newMemoryPersonaStore()
+	cmd := &personaCommand{
+		store:  store,
+		tools:  []string{"postgres_query", "quickjs", "jwtdecode"},
+		admins: map[string]bool{"UADMIN": true},
+	}
+	command := func(user string, text string) slack.SlashCommand {
+		return slack.SlashCommand{UserID: user, ChannelID: "CDATA", TeamID: "T1", Text: text}
+	}
+	steps := []struct {
+		user    string
+		text    string
+		want    string
+		wantErr string
+	}{
+		{user: "UADMIN", text: "", want: "no persona is set here"},
+		{user: "UALICE", text: "set here prompt be casual", wantErr: "only persona admins"},
+		{user: "UADMIN", text: "set here prompt you answer questions about the warehouse.\nprefer SQL.", want: "prompt: you answer questions about the warehouse.\nprefer SQL."},
+		{user: "UADMIN", text: "set here tools postgres_query, quickjs", want: "tools: postgres_query, quickjs"},
+		{user: "UADMIN", text: "set here tools rm_rf", wantErr: `unknown tool "rm_rf"`},
+		{user: "UADMIN", text: "set here thinking 10", wantErr: "at least 1024"},
+		{user: "UADMIN", text: "set here thinking off", want: "thinking: off"},
+		{user: "UADMIN", text: "set <#CSOCIAL|social> tools none", want: "persona for <#CSOCIAL>\nprompt: (default)\ntools: none"},
+		{user: "UADMIN", text: "set workspace model claude-opus-4-0", want: "model: claude-opus-4-0"},
+		{user: "UALICE", text: "show", want: "persona for <#CDATA>"},
+		{user: "UALICE", text: "list", wantErr: "only persona admins"},
+		{user: "UADMIN", text: "list", want: "persona for <#CSOCIAL>"},
+		{user: "UADMIN", text: "clear here", want: "cleared the persona for <#CDATA>"},
+		{user: "UALICE", text: "show", want: "persona for the workspace"},
+		{user: "UALICE", text: "help", want: "/persona set <scope> prompt"},
+	}
+	for _, step := range steps {
+		got, err := cmd.Run(context.Background(), command(step.user, step.text))
+		if step.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), step.wantErr) {
+				t.Errorf("/persona %s error = %v, want %q", step.text, err, step.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("/persona %s: %v", step.text, err)
+		}
+		if !strings.Contains(got, step.want) {
+			t.Errorf("/persona %s = %q, want it to contain %q", step.text, got, step.want)
+		}
+	}
+
+	p, _ := store.Get(context.Background(), "CSOCIAL")
+	if p == nil || p.Tools == nil || len(p.Tools) != 0 || p.UpdatedBy != "UADMIN" {
+		t.Errorf("stored persona = %+v, want no tools, updated by UADMIN", p)
+	}
+}
+
+func TestLLM_PromptPersona(t *testing.T) {
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = nil
+		json.NewDecoder(r.Body).Decode(&request)
+		message := `{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude", "content": [{"type": "text", "text": "hey"}], "stop_reason": "end_turn", "usage": {"input_tokens": 1, "output_tokens": 1}}`
+		if request["stream"] != true {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(message))
+			return
+		}
+		// opus can't be asked for this many tokens without streaming
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range []string{
+			`{"type": "message_start", "message": {"id": "msg_1", "type": "message", "role": "assistant", "content": [], "model": "claude", "usage": {"input_tokens": 1, "output_tokens": 1}}}`,
+			`{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`,
+			`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "hey"}}`,
+			`{"type": "content_block_stop", "index": 0}`,
+			`{"type": "message_stop"}`,
+		} {
+			eventType := strings.SplitN(strings.SplitN(event, `"type": "`, 2)[1], `"`, 2)[0]
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, event)
+		}
+	}))
+	defer server.Close()
+
+	echo := func(input struct{}) (*string, error) { return nil, nil }
+	llm := NewLLM(
+		anthropic.NewClient(option.WithBaseURL(server.URL), option.WithAPIKey("test")),
+		NewAnthropicMessageHandler([]ToolHandler{
+			CreateToolHandler("postgres_query", "Run SQL", echo),
+			CreateToolHandler("quickjs", "Run JS", echo),
+		}),
+	)
+	store := NewSlackMessageStore(llm)
+
+	tests := []struct {
+		name         string
+		persona      *persona
+		wantModel    string
+		wantTools    []string
+		wantThinking bool
+		wantPrompt   string
+	}{
+		{
+			name:         "defaults",
+			wantModel:    string(anthropic.ModelClaude4Sonnet20250514),
+			wantTools:    []string{"postgres_query", "quickjs"},
+			wantThinking: true,
+		},
+		{
+			name:       "social channel",
+			persona:    &persona{Scope: "CSOCIAL", SystemPrompt: "be casual", Tools: []string{"quickjs"}, Model: "claude-opus-4-0", ThinkingBudget: -1},
+			wantModel:  "claude-opus-4-0",
+			wantTools:  []string{"quickjs"},
+			wantPrompt: "be casual",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := withPersona(context.Background(), tt.persona)
+			resp, err := store.CallLLM(ctx, tt.name, "hi")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.TrimSpace(resp.Message) != "hey" {
+				t.Errorf("CallLLM() = %q, want hey", resp.Message)
+			}
+			if request["model"] != tt.wantModel {
+				t.Errorf("model = %v, want %s", request["model"], tt.wantModel)
+			}
+			tools := []string{}
+			for _, tool := range request["tools"].([]interface{}) {
+				tools = append(tools, tool.(map[string]interface{})["name"].(string))
+			}
+			if diff := cmp.Diff(tt.wantTools, tools); diff != "" {
+				t.Errorf("tools (-want +got):\n%s", diff)
+			}
+			if _, ok := request["thinking"]; ok != tt.wantThinking {
+				t.Errorf("thinking sent = %v, want %v", ok, tt.wantThinking)
+			}
+			system := request["system"].([]interface{})
+			last := system[len(system)-1].(map[string]interface{})["text"]
+			if tt.wantPrompt != "" && last != tt.wantPrompt {
+				t.Errorf("last system prompt = %v, want %q", last, tt.wantPrompt)
+			}
+		})
+	}
+}
+
+func TestPostgresPersonaStore(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := newPostgresPersonaStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer db.Exec(`DELETE FROM agent_personas WHERE scope LIKE 'test:%'`)
+
+	for _, p := range []persona{
+		{Scope: "test:all", SystemPrompt: "all tools", ThinkingBudget: 2048},
+		{Scope: "test:none", Tools: []string{}, Model: "llama3.1", ThinkingBudget: -1, UpdatedBy: "U1"},
+		{Scope: "test:some", Tools: []string{"quickjs"}},
+	} {
+		if err := store.Set(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Get(ctx, p.Scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(&p, got); diff != "" {
+			t.Errorf("Get(%s) (-want +got):\n%s", p.Scope, diff)
+		}
+	}
+	if err := store.Delete(ctx, "test:all"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(ctx, "test:all"); err != nil || got != nil {
+		t.Errorf("Get() after Delete() = %v, %v, want nil", got, err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// postgresQuery runs query against db within the datasource's limits and
+// returns the rows as JSON. Errors from the database are returned as part of
+// the response so the model can fix its query.
+func postgresQuery(ctx context.Context, db *sql.DB, ds datasource, query string) (string, error) {
+	results, moreRows, err := queryRows(ctx, db, ds, query)
+	var qErr queryError
+	if errors.As(err, &qErr) {
+		return fmt.Sprintf("Error: %v", qErr.err), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return formatRows(results, moreRows, ds)
+}
+
+// queryError is an error reported by the database for the query itself, as
+// opposed to a failure to talk to it.
+type queryError struct {
+	err error
+}
+
+func (e queryError) Error() string {
+	return e.err.Error()
+}
+
+// queryRows runs query in a transaction that is read only unless the
+// datasource allows writes, and returns at most ds.MaxRows rows. moreRows is
+// set when rows were left out.
+func queryRows(ctx context.Context, db *sql.DB, ds datasource, query string) (results []map[string]interface{}, moreRows bool, err error) {
+	if ds.StatementTimeout > 0 {
+		var cancel context.CancelFunc
+		// leave the server a moment to report the statement timeout itself
+		ctx, cancel = context.WithTimeout(ctx, ds.StatementTimeout+5*time.Second)
+		defer cancel()
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: !ds.AllowWrites})
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer tx.Rollback()
+
+	if ds.StatementTimeout > 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", ds.StatementTimeout.Milliseconds()))
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to set statement timeout")
+		}
+	}
+
+	// preparing the query uses the extended protocol, which refuses multiple
+	// statements, so "COMMIT; DROP TABLE ..." can't escape the transaction
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, false, queryError{err}
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, false, queryError{err}
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to get columns")
+	}
+
+	results = []map[string]interface{}{}
+	for rows.Next() {
+		if ds.MaxRows > 0 && len(results) >= ds.MaxRows {
+			moreRows = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		valuePtrs := make([]interface{}, len(columns))
+		for i := range columns {
+			valuePtrs[i] = &values[i]
+		}
+
+		if err := rows.Scan(valuePtrs...); err != nil {
+			return nil, false, errors.Wrap(err, "failed to scan row")
+		}
+
+		rowMap := make(map[string]interface{})
+		for i, col := range columns {
+			val := values[i]
+
+			if b, ok := val.([]byte); ok {
+				rowMap[col] = string(b)
+			} else {
+				rowMap[col] = val
+			}
+		}
+		results = append(results, rowMap)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, false, queryError{err}
+	}
+	rows.Close()
+
+	if ds.AllowWrites {
+		if err := tx.Commit(); err != nil {
+			return nil, false, queryError{err}
+		}
+	}
+	return results, moreRows, nil
+}
+
+// formatRows marshals the rows, dropping rows from the end until the JSON
+// fits in ds.MaxBytes. A note is appended when anything was left out.
+func formatRows(results []map[string]interface{}, moreRows bool, ds datasource) (string, error) {
+	total := len(results)
+	jsonResult, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal result to JSON")
+	}
+	for ds.MaxBytes > 0 && len(jsonResult) > ds.MaxBytes && len(results) > 0 {
+		// shrink proportionally, always dropping at least one row
+		keep := len(results) * ds.MaxBytes / len(jsonResult)
+		if keep >= len(results) {
+			keep = len(results) - 1
+		}
+		results = results[:keep]
+		jsonResult, err = json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return "", errors.Wrap(err, "failed to marshal result to JSON")
+		}
+	}
+
+	response := string(jsonResult)
+	switch {
+	case len(results) < total:
+		of := fmt.Sprintf("%d", total)
+		if moreRows {
+			of = "more than " + of
+		}
+		response += fmt.Sprintf("\n\n(truncated: showing %d of %s rows, the output is capped at %d bytes. select fewer columns or add a LIMIT)", len(results), of, ds.MaxBytes)
+	case moreRows:
+		response += fmt.Sprintf("\n\n(truncated: showing the first %d rows, there are more. add a LIMIT or aggregate)", total)
+	}
+	return response, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_formatRows(t *testing.T) {
+	rows := func(n int) []map[string]interface{} {
+		results := []map[string]interface{}{}
+		for i := 0; i < n; i++ {
+			results = append(results, map[string]interface{}{"id": i, "name": fmt.Sprintf("row %d", i)})
+		}
+		return results
+	}
+	tests := []struct {
+		name     string
+		results  []map[string]interface{}
+		moreRows bool
+		maxBytes int
+		wantRows int
+		wantNote string
+	}{
+		{
+			name:     "fits",
+			results:  rows(3),
+			maxBytes: 10_000,
+			wantRows: 3,
+		},
+		{
+			name:     "row limit",
+			results:  rows(3),
+			moreRows: true,
+			maxBytes: 10_000,
+			wantRows: 3,
+			wantNote: "(truncated: showing the first 3 rows, there are more. add a LIMIT or aggregate)",
+		},
+		{
+			name:     "byte cap",
+			results:  rows(100),
+			maxBytes: 500,
+			wantRows: 11,
+			wantNote: "(truncated: showing 11 of 100 rows, the output is capped at 500 bytes. select fewer columns or add a LIMIT)",
+		},
+		{
+			name:     "byte cap and row limit",
+			results:  rows(100),
+			moreRows: true,
+			maxBytes: 500,
+			wantRows: 11,
+			wantNote: "(truncated: showing 11 of more than 100 rows, the output is capped at 500 bytes. select fewer columns or add a LIMIT)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := formatRows(tt.results, tt.moreRows, datasource{MaxBytes: tt.maxBytes})
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, note, _ := strings.Cut(got, "\n\n")
+			if len(body) > tt.maxBytes {
+				t.Errorf("formatRows() returned %d bytes of rows, cap is %d", len(body), tt.maxBytes)
+			}
+			if gotRows := strings.Count(body, `"id"`); gotRows != tt.wantRows {
+				t.Errorf("formatRows() returned %d rows, want %d", gotRows, tt.wantRows)
+			}
+			if note != tt.wantNote {
+				t.Errorf("formatRows() note = %q, want %q", note, tt.wantNote)
+			}
+		})
+	}
+}
+
+func Test_postgresQueryReadOnly(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ds := datasource{StatementTimeout: 100 * time.Millisecond, MaxRows: 5, MaxBytes: 10_000}
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{name: "writes are rejected", query: "CREATE TABLE lucksacks_read_only (id int)", want: "read-only transaction"},
+		{name: "multiple statements are rejected", query: "COMMIT; CREATE TABLE lucksacks_read_only (id int)", want: "multiple commands"},
+		{name: "statement timeout", query: "SELECT pg_sleep(1)", want: "statement timeout"},
+		{name: "row limit", query: "SELECT generate_series(1, 10) AS n", want: "showing the first 5 rows"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := postgresQuery(context.Background(), db, ds, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("postgresQuery() = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
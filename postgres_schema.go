@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// schemaTables selects the tables matching the schema name and table LIKE
+// pattern, an empty filter matches everything. The other catalog queries
+// join against it.
+const schemaTables = `
+WITH tables AS (
+    SELECT c.oid, n.nspname, c.relname, c.relkind, c.reltuples::bigint AS reltuples
+    FROM pg_class c
+    JOIN pg_namespace n ON n.oid = c.relnamespace
+    WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+      AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+      AND n.nspname NOT LIKE 'pg_toast%'
+      AND ($1::text = '' OR n.nspname::text = $1::text)
+      AND ($2::text = '' OR c.relname::text LIKE $2::text)
+)
+`
+
+type schemaTable struct {
+	Schema      string
+	Name        string
+	Kind        string
+	RowEstimate int64
+	Columns     []string
+	Constraints []string
+	Indexes     []string
+}
+
+// postgresSchema describes the tables in db in a compact text format meant
+// for the model: one line per table followed by its columns, keys and
+// indexes.
+func postgresSchema(ctx context.Context, db *sql.DB, ds datasource, schemaName string, tablePattern string) (string, error) {
+	if ds.StatementTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ds.StatementTimeout)
+		defer cancel()
+	}
+
+	tables := []*schemaTable{}
+	byOID := map[int64]*schemaTable{}
+	rows, err := db.QueryContext(ctx, schemaTables+`SELECT oid, nspname, relname, relkind, reltuples FROM tables ORDER BY nspname, relname`, schemaName, tablePattern)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to query tables")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid int64
+		table := &schemaTable{}
+		if err := rows.Scan(&oid, &table.Schema, &table.Name, &table.Kind, &table.RowEstimate); err != nil {
+			return "", errors.Wrap(err, "failed to scan table")
+		}
+		tables = append(tables, table)
+		byOID[oid] = table
+	}
+	if err := rows.Err(); err != nil {
+		return "", errors.Wrap(err, "error during rows iteration")
+	}
+	if len(tables) == 0 {
+		return "no tables found", nil
+	}
+
+	err = eachCatalogRow(ctx, db, schemaName, tablePattern, `
+SELECT a.attrelid::bigint,
+       a.attname || ' ' || format_type(a.atttypid, a.atttypmod)
+       || CASE WHEN a.attnotnull THEN ' not null' ELSE '' END
+       || CASE
+            WHEN d.adbin IS NULL THEN ''
+            WHEN pg_get_expr(d.adbin, d.adrelid) LIKE 'nextval(%' THEN ' serial'
+            ELSE ' default ' || pg_get_expr(d.adbin, d.adrelid)
+          END
+FROM pg_attribute a
+JOIN tables t ON t.oid = a.attrelid
+LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+WHERE a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attrelid, a.attnum`, func(table *schemaTable, line string) {
+		table.Columns = append(table.Columns, line)
+	}, byOID)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to query columns")
+	}
+
+	err = eachCatalogRow(ctx, db, schemaName, tablePattern, `
+SELECT con.conrelid::bigint, pg_get_constraintdef(con.oid)
+FROM pg_constraint con
+JOIN tables t ON t.oid = con.conrelid
+WHERE con.contype IN ('p', 'f', 'u')
+ORDER BY con.conrelid, con.contype DESC, con.conname`, func(table *schemaTable, line string) {
+		table.Constraints = append(table.Constraints, line)
+	}, byOID)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to query constraints")
+	}
+
+	// indexes that back a constraint are already listed with the constraints
+	err = eachCatalogRow(ctx, db, schemaName, tablePattern, `
+SELECT i.indrelid::bigint,
+       'INDEX ' || ic.relname || CASE WHEN i.indisunique THEN ' UNIQUE' ELSE '' END
+       || ' ' || substring(pg_get_indexdef(i.indexrelid) FROM 'USING (.*)$')
+FROM pg_index i
+JOIN tables t ON t.oid = i.indrelid
+JOIN pg_class ic ON ic.oid = i.indexrelid
+WHERE NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = i.indexrelid)
+ORDER BY i.indrelid, ic.relname`, func(table *schemaTable, line string) {
+		table.Indexes = append(table.Indexes, line)
+	}, byOID)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to query indexes")
+	}
+
+	return formatSchema(tables, ds.MaxBytes), nil
+}
+
+// eachCatalogRow runs a query returning (table oid, text) rows and calls fn
+// with the matching table for each one.
+func eachCatalogRow(
+	ctx context.Context,
+	db *sql.DB,
+	schemaName string,
+	tablePattern string,
+	query string,
+	fn func(table *schemaTable, line string),
+	byOID map[int64]*schemaTable,
+) error {
+	rows, err := db.QueryContext(ctx, schemaTables+query, schemaName, tablePattern)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid int64
+		var line string
+		if err := rows.Scan(&oid, &line); err != nil {
+			return err
+		}
+		if table, ok := byOID[oid]; ok {
+			fn(table, line)
+		}
+	}
+	return rows.Err()
+}
+
+var relkindNames = map[string]string{
+	"r": "table",
+	"p": "partitioned table",
+	"v": "view",
+	"m": "materialized view",
+	"f": "foreign table",
+}
+
+// formatSchema renders the tables, leaving out whole tables once maxBytes
+// is reached.
+func formatSchema(tables []*schemaTable, maxBytes int) string {
+	var b strings.Builder
+	for i, table := range tables {
+		var t strings.Builder
+		rowEstimate := "rows unknown"
+		if table.RowEstimate >= 0 && table.Kind != "v" {
+			rowEstimate = fmt.Sprintf("~%d rows", table.RowEstimate)
+		}
+		fmt.Fprintf(&t, "%s.%s (%s, %s)\n", table.Schema, table.Name, relkindNames[table.Kind], rowEstimate)
+		for _, lines := range [][]string{table.Columns, table.Constraints, table.Indexes} {
+			for _, line := range lines {
+				fmt.Fprintf(&t, "  %s\n", line)
+			}
+		}
+		if maxBytes > 0 && b.Len()+t.Len() > maxBytes {
+			fmt.Fprintf(&b, "(truncated: %d more tables, filter by schema or table pattern to see them)\n", len(tables)-i)
+			break
+		}
+		b.WriteString(t.String())
+	}
+	return strings.TrimSpace(b.String())
+}
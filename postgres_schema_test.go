@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_formatSchema(t *testing.T) {
+	tables := []*schemaTable{
+		{
+			Schema:      "public",
+			Name:        "orders",
+			Kind:        "r",
+			RowEstimate: 1200,
+			Columns:     []string{"order_id integer not null serial", "user_id integer"},
+			Constraints: []string{"PRIMARY KEY (order_id)", "FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE"},
+			Indexes:     []string{"INDEX orders_user_id_idx btree (user_id)"},
+		},
+		{
+			Schema:      "public",
+			Name:        "recent_orders",
+			Kind:        "v",
+			RowEstimate: 0,
+			Columns:     []string{"order_id integer"},
+		},
+	}
+	want := `public.orders (table, ~1200 rows)
+  order_id integer not null serial
+  user_id integer
+  PRIMARY KEY (order_id)
+  FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+  INDEX orders_user_id_idx btree (user_id)
+public.recent_orders (view, rows unknown)
+  order_id integer`
+	if got := formatSchema(tables, 0); got != want {
+		t.Errorf("formatSchema() = %s\nwant %s", got, want)
+	}
+
+	truncated := formatSchema(tables, 250)
+	if !strings.HasSuffix(truncated, "(truncated: 1 more tables, filter by schema or table pattern to see them)") {
+		t.Errorf("formatSchema() with a byte cap = %s", truncated)
+	}
+}
+
+func Test_postgresSchema(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`
+DROP TABLE IF EXISTS lucksacks_schema_items;
+DROP TABLE IF EXISTS lucksacks_schema_orders;
+CREATE TABLE lucksacks_schema_orders (order_id SERIAL PRIMARY KEY, note TEXT);
+CREATE TABLE lucksacks_schema_items (
+    item_id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES lucksacks_schema_orders(order_id)
+);
+CREATE INDEX lucksacks_schema_items_order_id ON lucksacks_schema_items (order_id);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := postgresSchema(context.Background(), db, datasource{}, "", "lucksacks_schema_%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"public.lucksacks_schema_items (table,",
+		"  order_id integer not null",
+		"  FOREIGN KEY (order_id) REFERENCES lucksacks_schema_orders(order_id)",
+		"  INDEX lucksacks_schema_items_order_id btree (order_id)",
+		"  PRIMARY KEY (order_id)",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("postgresSchema() = %s\nwant it to contain %q", got, want)
+		}
+	}
+}
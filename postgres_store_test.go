@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestPostgresMessageStore_Persists(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	llm := &mockLLM{fn: func(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+		return &LLMResponse{Message: "test", Loop: false}, nil
+	}}
+	store, err := NewPostgresMessageStore(db, llm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM agent_conversations WHERE conversation_id = $1`, "persist"); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := []anthropic.MessageParam{
+		anthropic.NewUserMessage(anthropic.NewTextBlock("what is 1+1")),
+		anthropic.NewAssistantMessage(anthropic.NewToolUseBlock("toolu_1", json.RawMessage(`{"code":"1+1"}`), "quickjs")),
+		anthropic.NewUserMessage(anthropic.NewToolResultBlock("toolu_1", "2", false)),
+	}
+	if err := store.AppendMessages("persist", messages); err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh store has an empty cache, so this reads back from the database
+	restarted, err := NewPostgresMessageStore(db, llm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := restarted.load("persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(messages) {
+		t.Fatalf("load() returned %d messages, want %d", len(got), len(messages))
+	}
+	if got[1].Content[0].OfToolUse == nil || got[1].Content[0].OfToolUse.Name != "quickjs" {
+		t.Errorf("load() tool_use = %v, want quickjs", got[1].Content[0])
+	}
+	if got[2].Content[0].OfToolResult == nil || got[2].Content[0].OfToolResult.ToolUseID != "toolu_1" {
+		t.Errorf("load() tool_result = %v, want toolu_1", got[2].Content[0])
+	}
+}
+
+func TestPostgresMessageStore_CacheEviction(t *testing.T) {
+	store := &PostgresMessageStore{cache: make(map[string]*cachedConversation), cacheSize: 2}
+	message := []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock("hi"))}
+	for _, step := range []func(){
+		func() { store.setCached("a", message) },
+		func() { store.setCached("b", message) },
+		func() { store.cached("a") },
+		func() { store.setCached("c", message) },
+	} {
+		step()
+		// lastUsed has to differ between steps
+		time.Sleep(time.Millisecond)
+	}
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := store.cached(id); ok != want {
+			t.Errorf("cached(%q) = %v, want %v", id, ok, want)
+		}
+	}
+}
+
+func Test_checkMessageStoreDatabase(t *testing.T) {
+	datasources, err := newDatasourceRegistry([]datasource{{Name: "default", URL: "postgres://localhost/shop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer datasources.Close()
+	tests := []struct {
+		store   string
+		dbURL   string
+		wantErr string
+	}{
+		{store: "", dbURL: ""},
+		{store: "postgres", dbURL: "", wantErr: "needs MESSAGE_STORE_DATABASE_URL"},
+		{store: "postgres", dbURL: "postgres://localhost:5432/shop?sslmode=disable", wantErr: "also datasource default"},
+		{store: "postgres", dbURL: "postgres://localhost/agent"},
+	}
+	for _, tt := range tests {
+		t.Setenv("MESSAGE_STORE", tt.store)
+		t.Setenv("MESSAGE_STORE_DATABASE_URL", tt.dbURL)
+		err := checkMessageStoreDatabase(datasources)
+		if (tt.wantErr == "" && err != nil) || (tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr))) {
+			t.Errorf("checkMessageStoreDatabase() with %q %q error = %v, want %q", tt.store, tt.dbURL, err, tt.wantErr)
+		}
+	}
+}
@@ -5,46 +5,34 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/pkg/errors"
 	"github.com/slack-go/slack"
 )
 
-func qrngSlackCommand(w http.ResponseWriter, s slack.SlashCommand, url string) {
-	// fetch random 2 digit hex from https://qrng.anu.edu.au/
-	var randNumSourceUrl = url
-	var numRequests int
-	var err error
-
-	if s.Text == "" {
-		numRequests = 1
-	} else {
+// qrng fetches from one of the https://qrng.anu.edu.au/ endpoints, s.Text
+// times.
+func qrng(s slack.SlashCommand, url string) (string, error) {
+	numRequests := 1
+	if s.Text != "" {
+		var err error
 		numRequests, err = strconv.Atoi(s.Text)
 		if err != nil {
-			msg := "invalid input: " + s.Text
-			logErrMsgSlack(w, msg)
+			return "", errors.New("invalid input: " + s.Text)
 		}
-
 	}
 
-	i := 0
 	msg := ""
-	for i < numRequests {
-		resp, err := http.Get(randNumSourceUrl)
+	for i := 0; i < numRequests; i++ {
+		resp, err := http.Get(url)
 		if err != nil {
-			msg := "error fetching " + randNumSourceUrl
-			logErrMsgSlack(w, msg)
-			return
-		} else {
-			defer resp.Body.Close()
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				logErrMsgSlack(w, "error reading body from "+randNumSourceUrl)
-				return
-			} else {
-				msg = msg + string(body)
-			}
+			return "", errors.New("error fetching " + url)
 		}
-		i = i + 1
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", errors.New("error reading body from " + url)
+		}
+		msg = msg + string(body)
 	}
-	logErrMsgSlack(w, msg)
-
+	return msg, nil
 }
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rosbit/go-quickjs"
+	log "github.com/sirupsen/logrus"
+)
+
+// jsSandboxEnv is set in the environment of the sandbox process, its value is
+// the memory limit in bytes. main checks for it before doing anything else.
+const jsSandboxEnv = "LUCKSACKS_JS_SANDBOX"
+
+// jsMaxConsoleBytes caps the console output returned for one evaluation.
+const jsMaxConsoleBytes = 10_000
+
+// jsPrelude runs once in every new context. It replaces console with one that
+// records its output for the sandbox to collect after each evaluation, and
+// wraps the __host bridge in the host functions scripts see, see newJSHost.
+const jsPrelude = `
+globalThis.__lucksacks = (function () {
+  var lines = [], size = 0, dropped = 0;
+  function show(v) {
+    if (typeof v === "string") return v;
+    if (v === undefined || typeof v === "function" || typeof v === "symbol") return String(v);
+    try {
+      var s = JSON.stringify(v);
+      return s === undefined ? String(v) : s;
+    } catch (e) {
+      return String(v);
+    }
+  }
+  function log() {
+    var line = Array.prototype.map.call(arguments, show).join(" ");
+    if (size + line.length > MAX_CONSOLE_BYTES) {
+      dropped++;
+      return;
+    }
+    size += line.length;
+    lines.push(line);
+  }
+  globalThis.console = { log: log, info: log, warn: log, error: log, debug: log };
+  function host(name, args) {
+    var reply = JSON.parse(__host(name, JSON.stringify(args)));
+    (reply.notes || []).forEach(function (note) { log(note); });
+    if (reply.error) throw new Error(name + ": " + reply.error);
+    return reply.value;
+  }
+  function bind(name) {
+    return function () { return host(name, Array.prototype.slice.call(arguments)); };
+  }
+  globalThis.sql = bind("sql");
+  globalThis.units = { convert: bind("units.convert") };
+  globalThis.sha256 = bind("sha256");
+  globalThis.base64 = { encode: bind("base64.encode"), decode: bind("base64.decode") };
+  globalThis.jwt = { decode: bind("jwt.decode") };
+  globalThis.kv = { get: bind("kv.get"), set: bind("kv.set"), delete: bind("kv.delete"), keys: bind("kv.keys") };
+  delete globalThis.print;
+  delete globalThis.scriptArgs;
+  return {
+    reset: function () {
+      lines = [];
+      size = 0;
+      dropped = 0;
+    },
+    console: function () {
+      var out = lines.slice();
+      if (dropped) out.push("(" + dropped + " more lines not shown)");
+      return JSON.stringify(out);
+    },
+  };
+})();
+`
+
+// jsScriptPrefix goes in front of every script. quickjs evaluates code that
+// starts with import or export as a module, which could load the std and os
+// modules, with the prefix an import is a syntax error instead.
+const jsScriptPrefix = "void 0;"
+
+// jsLimits are the sandbox controls for quickjs.
+type jsLimits struct {
+	// Timeout is how long one evaluation may run before the sandbox is
+	// killed.
+	Timeout time.Duration
+	// MemoryLimit caps the memory of the sandbox process in bytes.
+	MemoryLimit int
+}
+
+func jsLimitsFromEnv() jsLimits {
+	return jsLimits{
+		Timeout:     envDuration("JS_TIMEOUT", 5*time.Second),
+		MemoryLimit: envInt("JS_MEMORY_LIMIT_MB", 256) << 20,
+	}
+}
+
+// jsRequest is a line from the bot to the sandbox: code to run, or the reply
+// to a host function the running code called.
+type jsRequest struct {
+	Code  string       `json:"code,omitempty"`
+	Reply *jsHostReply `json:"reply,omitempty"`
+}
+
+// jsMessage is a line from the sandbox to the bot: a host function call, or
+// the result of the evaluation.
+type jsMessage struct {
+	Call   *jsHostCall `json:"call,omitempty"`
+	Result *jsResult   `json:"result,omitempty"`
+}
+
+// jsResult is the outcome of one evaluation.
+type jsResult struct {
+	Value   string   `json:"value,omitempty"`
+	Error   string   `json:"error,omitempty"`
+	Console []string `json:"console,omitempty"`
+}
+
+// String formats the result for the model, the console output follows the
+// value.
+func (r jsResult) String() string {
+	var b strings.Builder
+	if r.Error != "" {
+		b.WriteString("Error: " + r.Error)
+	} else {
+		b.WriteString(r.Value)
+	}
+	if len(r.Console) > 0 {
+		b.WriteString("\n\nconsole:\n" + strings.Join(r.Console, "\n"))
+	}
+	return b.String()
+}
+
+var errJSSandboxClosed = errors.New("the JavaScript sandbox is closed")
+
+// jsSandbox is a quickjs context running in a child process. The process is
+// what enforces the limits: it is killed when an evaluation runs past its
+// deadline, its data segment is capped with setrlimit, and closing it frees
+// everything the context allocated. It starts with an empty environment in a
+// temporary directory so scripts cannot read the bot's secrets.
+type jsSandbox struct {
+	limits jsLimits
+	host   jsHost
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	results *bufio.Scanner
+	stderr  *cappedBuffer
+	exited  chan struct{}
+	closed  bool
+}
+
+func newJSSandbox(limits jsLimits, host jsHost) (*jsSandbox, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find the executable")
+	}
+	results, resultsWriter, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create pipe")
+	}
+	cmd := exec.Command(executable)
+	cmd.Env = []string{fmt.Sprintf("%s=%d", jsSandboxEnv, limits.MemoryLimit)}
+	cmd.Dir = os.TempDir()
+	cmd.ExtraFiles = []*os.File{resultsWriter}
+	stderr := &cappedBuffer{max: 4096}
+	cmd.Stdout = io.Discard
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		results.Close()
+		resultsWriter.Close()
+		return nil, errors.Wrap(err, "failed to create stdin pipe")
+	}
+	if err := cmd.Start(); err != nil {
+		results.Close()
+		resultsWriter.Close()
+		return nil, errors.Wrap(err, "failed to start the JavaScript sandbox")
+	}
+	resultsWriter.Close()
+
+	scanner := bufio.NewScanner(results)
+	scanner.Buffer(nil, 16<<20)
+	s := &jsSandbox{
+		limits:  limits,
+		host:    host,
+		cmd:     cmd,
+		stdin:   stdin,
+		results: scanner,
+		stderr:  stderr,
+		exited:  make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		results.Close()
+		close(s.exited)
+	}()
+	return s, nil
+}
+
+// Eval runs code and returns its value and console output, answering the
+// host function calls it makes along the way. Errors thrown by the script are
+// part of the result, an error means the sandbox is gone: the deadline
+// passed, it ran out of memory or it was closed.
+func (s *jsSandbox) Eval(ctx context.Context, code string) (jsResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return jsResult{}, errJSSandboxClosed
+	}
+
+	evalCtx, cancel := context.WithTimeout(ctx, s.limits.Timeout)
+	defer cancel()
+	if err := s.send(jsRequest{Code: code}); err != nil {
+		return jsResult{}, err
+	}
+	for {
+		line, err := s.receive(evalCtx)
+		if evalCtx.Err() != nil {
+			s.closeLocked()
+			if ctx.Err() != nil {
+				return jsResult{}, errors.Wrap(ctx.Err(), "the script was stopped")
+			}
+			return jsResult{}, errors.Errorf("the script did not finish within %s and was stopped", s.limits.Timeout)
+		}
+		if err != nil {
+			s.closeLocked()
+			return jsResult{}, s.exitError()
+		}
+		var message jsMessage
+		if err := json.Unmarshal(line, &message); err != nil {
+			s.closeLocked()
+			return jsResult{}, errors.Wrap(err, "failed to parse the JavaScript sandbox reply")
+		}
+		switch {
+		case message.Call != nil:
+			reply := s.host.call(evalCtx, *message.Call)
+			if err := s.send(jsRequest{Reply: &reply}); err != nil {
+				return jsResult{}, err
+			}
+		case message.Result != nil:
+			return *message.Result, nil
+		default:
+			s.closeLocked()
+			return jsResult{}, errors.New("empty reply from the JavaScript sandbox")
+		}
+	}
+}
+
+func (s *jsSandbox) send(request jsRequest) error {
+	line, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal request")
+	}
+	if _, err := s.stdin.Write(append(line, '\n')); err != nil {
+		s.closeLocked()
+		return errors.Wrap(err, "failed to write to the JavaScript sandbox")
+	}
+	return nil
+}
+
+// receive reads the next line from the sandbox. When ctx is done first the
+// sandbox is killed so the read returns.
+func (s *jsSandbox) receive(ctx context.Context) ([]byte, error) {
+	type reply struct {
+		line []byte
+		err  error
+	}
+	replies := make(chan reply, 1)
+	go func() {
+		if s.results.Scan() {
+			replies <- reply{line: s.results.Bytes()}
+			return
+		}
+		err := s.results.Err()
+		if err == nil {
+			err = io.EOF
+		}
+		replies <- reply{err: err}
+	}()
+	select {
+	case r := <-replies:
+		return r.line, r.err
+	case <-ctx.Done():
+		s.cmd.Process.Kill()
+		<-replies
+		return nil, ctx.Err()
+	}
+}
+
+// exitError explains why the sandbox process went away.
+func (s *jsSandbox) exitError() error {
+	<-s.exited
+	stderr := s.stderr.String()
+	if strings.Contains(stderr, "out of memory") || strings.Contains(stderr, "cannot allocate memory") {
+		return errors.Errorf("the script ran out of memory, the limit is %d MB", s.limits.MemoryLimit>>20)
+	}
+	log.WithFields(log.Fields{"stderr": stderr}).Error("JavaScript sandbox exited")
+	return errors.New("the JavaScript sandbox exited unexpectedly")
+}
+
+// Close kills the sandbox process, it is safe to call more than once.
+func (s *jsSandbox) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *jsSandbox) closeLocked() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.stdin.Close()
+	s.cmd.Process.Kill()
+}
+
+// runJS evaluates code in a sandbox of its own.
+func runJS(ctx context.Context, limits jsLimits, host jsHost, code string) (string, error) {
+	sandbox, err := newJSSandbox(limits, host)
+	if err != nil {
+		return "", err
+	}
+	defer sandbox.Close()
+	result, err := sandbox.Eval(ctx, code)
+	if err != nil {
+		return "Error: " + err.Error(), nil
+	}
+	return result.String(), nil
+}
+
+// serveJSSandbox is the sandbox process. It reads one request per line from
+// stdin and writes one message per line to fd 3, stdout is left to the
+// interpreter. A host function call writes the call and blocks until the
+// reply comes in on stdin.
+func serveJSSandbox() {
+	// quickjs checks the C stack against where the runtime was created
+	runtime.LockOSThread()
+	if limit, err := strconv.ParseUint(os.Getenv(jsSandboxEnv), 10, 64); err == nil && limit > 0 {
+		if err := syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: limit, Max: limit}); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to set memory limit: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	results := os.NewFile(3, "results")
+	write := func(message jsMessage) {
+		line, _ := json.Marshal(message)
+		if _, err := results.Write(append(line, '\n')); err != nil {
+			os.Exit(1)
+		}
+	}
+	requests := bufio.NewScanner(os.Stdin)
+	requests.Buffer(nil, 16<<20)
+	callHost := func(name string, args string) string {
+		call := jsHostCall{Name: name}
+		if err := json.Unmarshal([]byte(args), &call.Args); err != nil {
+			reply, _ := json.Marshal(jsHostReply{Error: err.Error()})
+			return string(reply)
+		}
+		write(jsMessage{Call: &call})
+		var request jsRequest
+		if !requests.Scan() || json.Unmarshal(requests.Bytes(), &request) != nil || request.Reply == nil {
+			os.Exit(1)
+		}
+		reply, _ := json.Marshal(request.Reply)
+		return string(reply)
+	}
+
+	ctx, err := quickjs.NewContext()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create context: %s\n", err)
+		os.Exit(1)
+	}
+	prelude := strings.Replace(jsPrelude, "MAX_CONSOLE_BYTES", strconv.Itoa(jsMaxConsoleBytes), 1)
+	if _, err := ctx.Eval(prelude, map[string]interface{}{"__host": callHost}); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to run prelude: %s\n", err)
+		os.Exit(1)
+	}
+
+	for requests.Scan() {
+		var request jsRequest
+		result := jsResult{}
+		if err := json.Unmarshal(requests.Bytes(), &request); err != nil {
+			result.Error = err.Error()
+		} else {
+			result = evalJS(ctx, request.Code)
+		}
+		write(jsMessage{Result: &result})
+	}
+}
+
+// evalJS runs code as a global script, so declarations are still there for
+// the next evaluation in the same context.
+func evalJS(ctx *quickjs.JsContext, code string) jsResult {
+	result := jsResult{}
+	if _, err := ctx.Eval("__lucksacks.reset()", nil); err != nil {
+		return jsResult{Error: "the script replaced the sandbox's __lucksacks object"}
+	}
+	value, err := ctx.Eval(jsScriptPrefix+code, nil)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Value = formatJSValue(value)
+	}
+	console, err := ctx.Eval("__lucksacks.console()", nil)
+	if s, ok := console.(string); err == nil && ok {
+		json.Unmarshal([]byte(s), &result.Console)
+	}
+	return result
+}
+
+// formatJSValue renders a value converted from JavaScript, objects and arrays
+// as JSON.
+func formatJSValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "undefined"
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	if reflect.TypeOf(value).Kind() == reflect.Func {
+		return "function"
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
+
+// cappedBuffer keeps the first max bytes written to it.
+type cappedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if room := b.max - b.buf.Len(); room > 0 {
+		if len(p) > room {
+			b.buf.Write(p[:room])
+		} else {
+			b.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// jsHostFunction is a Go function scripts can call. Tool is the tool whose
+// permissions it shares: a script can only call it where the model could
+// call the tool itself.
+type jsHostFunction struct {
+	Tool string
+	Call func(ctx context.Context, args []json.RawMessage) (interface{}, error)
+}
+
+// jsHost are the host functions available to scripts, by the name the
+// sandbox calls them with.
+type jsHost map[string]jsHostFunction
+
+// jsHostCall is a script calling a host function.
+type jsHostCall struct {
+	Name string            `json:"name"`
+	Args []json.RawMessage `json:"args"`
+}
+
+// jsHostReply is what the host function returned, notes are shown on the
+// script's console.
+type jsHostReply struct {
+	Value json.RawMessage `json:"value,omitempty"`
+	Error string          `json:"error,omitempty"`
+	Notes []string        `json:"notes,omitempty"`
+}
+
+// jsNoted is a host function result that comes with notes for the console.
+type jsNoted struct {
+	Value interface{}
+	Notes []string
+}
+
+func (h jsHost) call(ctx context.Context, call jsHostCall) jsHostReply {
+	fn, ok := h[call.Name]
+	if !ok {
+		return jsHostReply{Error: fmt.Sprintf("%s is not available", call.Name)}
+	}
+	if !toolAllowed(ctx, fn.Tool) {
+		return jsHostReply{Error: fmt.Sprintf("%s is not allowed here", call.Name)}
+	}
+	start := time.Now()
+	value, err := fn.Call(ctx, call.Args)
+	log.WithFields(log.Fields{
+		"reqID":    reqIDFromContext(ctx),
+		"function": call.Name,
+		"duration": time.Since(start).String(),
+		"error":    err,
+	}).Info("quickjs host call")
+	if err != nil {
+		return jsHostReply{Error: err.Error()}
+	}
+	reply := jsHostReply{}
+	if noted, ok := value.(jsNoted); ok {
+		value = noted.Value
+		reply.Notes = noted.Notes
+	}
+	reply.Value, err = json.Marshal(value)
+	if err != nil {
+		return jsHostReply{Error: errors.Wrap(err, "failed to marshal result").Error()}
+	}
+	return reply
+}
+
+// jsArgs unmarshals the arguments of a host call into dst, missing and null
+// arguments leave the zero value.
+func jsArgs(args []json.RawMessage, dst ...interface{}) error {
+	for i, d := range dst {
+		if i >= len(args) || string(args[i]) == "null" {
+			continue
+		}
+		if err := json.Unmarshal(args[i], d); err != nil {
+			return errors.Wrapf(err, "argument %d", i+1)
+		}
+	}
+	return nil
+}
+
+// newJSHost builds the host functions. sql is left out when there are no
+// datasources.
+func newJSHost(datasources *datasourceRegistry, kv *jsKV) jsHost {
+	host := jsHost{
+		"units.convert": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var value float64
+			var from, to string
+			if err := jsArgs(args, &value, &from, &to); err != nil {
+				return nil, err
+			}
+			return convertUnits(value, from, to)
+		}},
+		"sha256": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var text string
+			if err := jsArgs(args, &text); err != nil {
+				return nil, err
+			}
+			return sha256Hex(text), nil
+		}},
+		"base64.encode": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var text string
+			if err := jsArgs(args, &text); err != nil {
+				return nil, err
+			}
+			return base64Encode(text), nil
+		}},
+		"base64.decode": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var text string
+			if err := jsArgs(args, &text); err != nil {
+				return nil, err
+			}
+			return base64Decode(text)
+		}},
+		"jwt.decode": {Tool: "jwtdecode", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var token string
+			if err := jsArgs(args, &token); err != nil {
+				return nil, err
+			}
+			return jwtClaims(token)
+		}},
+		"kv.get": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var key string
+			if err := jsArgs(args, &key); err != nil {
+				return nil, err
+			}
+			return kv.Get(conversationIDFromContext(ctx), key)
+		}},
+		"kv.set": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var key string
+			var value json.RawMessage
+			if err := jsArgs(args, &key, &value); err != nil {
+				return nil, err
+			}
+			return nil, kv.Set(conversationIDFromContext(ctx), key, value)
+		}},
+		"kv.delete": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var key string
+			if err := jsArgs(args, &key); err != nil {
+				return nil, err
+			}
+			return nil, kv.Delete(conversationIDFromContext(ctx), key)
+		}},
+		"kv.keys": {Tool: "quickjs", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			return kv.Keys(conversationIDFromContext(ctx))
+		}},
+	}
+	if datasources != nil {
+		host["sql"] = jsHostFunction{Tool: "postgres_query", Call: func(ctx context.Context, args []json.RawMessage) (interface{}, error) {
+			var query, name string
+			if err := jsArgs(args, &query, &name); err != nil {
+				return nil, err
+			}
+			db, ds, err := datasources.Get(name)
+			if err != nil {
+				return nil, err
+			}
+			// scripts only ever read, even from datasources that allow writes
+			ds.AllowWrites = false
+			rows, moreRows, err := queryRows(ctx, db, ds, query)
+			if err != nil {
+				return nil, err
+			}
+			if moreRows {
+				return jsNoted{Value: rows, Notes: []string{fmt.Sprintf("sql: only the first %d rows were returned, add a LIMIT or aggregate", len(rows))}}, nil
+			}
+			return rows, nil
+		}}
+	}
+	return host
+}
+
+// jsKV is the key-value store scripts reach through kv, every thread has its
+// own keys. It lives in memory, threads that have not used it within ttl are
+// dropped.
+type jsKV struct {
+	maxKeys       int
+	maxValueBytes int
+	ttl           time.Duration
+
+	mu      sync.Mutex
+	threads map[string]*jsKVThread
+}
+
+type jsKVThread struct {
+	values   map[string]json.RawMessage
+	lastUsed time.Time
+}
+
+func newJSKV(maxKeys int, maxValueBytes int, ttl time.Duration) *jsKV {
+	return &jsKV{
+		maxKeys:       maxKeys,
+		maxValueBytes: maxValueBytes,
+		ttl:           ttl,
+		threads:       make(map[string]*jsKVThread),
+	}
+}
+
+func jsKVFromEnv() *jsKV {
+	return newJSKV(
+		envInt("JS_KV_MAX_KEYS", 100),
+		envInt("JS_KV_MAX_VALUE_BYTES", 64_000),
+		envDuration("JS_KV_TTL", 24*time.Hour),
+	)
+}
+
+// thread returns the values for thread, creating them if create is set.
+// The caller must hold kv.mu.
+func (kv *jsKV) thread(thread string, create bool) (*jsKVThread, error) {
+	if thread == "" {
+		return nil, errors.New("the key-value store is only available in a thread")
+	}
+	now := time.Now()
+	t, ok := kv.threads[thread]
+	if ok && kv.ttl > 0 && now.Sub(t.lastUsed) > kv.ttl {
+		delete(kv.threads, thread)
+		t, ok = nil, false
+	}
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		for key, other := range kv.threads {
+			if kv.ttl > 0 && now.Sub(other.lastUsed) > kv.ttl {
+				delete(kv.threads, key)
+			}
+		}
+		t = &jsKVThread{values: make(map[string]json.RawMessage)}
+		kv.threads[thread] = t
+	}
+	t.lastUsed = now
+	return t, nil
+}
+
+// Get returns the value stored under key, null when there is none.
+func (kv *jsKV) Get(thread string, key string) (json.RawMessage, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	t, err := kv.thread(thread, false)
+	if err != nil || t == nil {
+		return json.RawMessage("null"), err
+	}
+	if value, ok := t.values[key]; ok {
+		return value, nil
+	}
+	return json.RawMessage("null"), nil
+}
+
+func (kv *jsKV) Set(thread string, key string, value json.RawMessage) error {
+	if kv.maxValueBytes > 0 && len(value) > kv.maxValueBytes {
+		return errors.Errorf("value for %s is %d bytes, the limit is %d", key, len(value), kv.maxValueBytes)
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	t, err := kv.thread(thread, true)
+	if err != nil {
+		return err
+	}
+	if _, ok := t.values[key]; !ok && kv.maxKeys > 0 && len(t.values) >= kv.maxKeys {
+		return errors.Errorf("this thread already has %d keys, delete some first", kv.maxKeys)
+	}
+	if value == nil {
+		value = json.RawMessage("null")
+	}
+	t.values[key] = value
+	return nil
+}
+
+func (kv *jsKV) Delete(thread string, key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	t, err := kv.thread(thread, false)
+	if err != nil || t == nil {
+		return err
+	}
+	delete(t.values, key)
+	return nil
+}
+
+// Keys lists the keys stored for thread in order.
+func (kv *jsKV) Keys(thread string) ([]string, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	keys := []string{}
+	t, err := kv.thread(thread, false)
+	if err != nil || t == nil {
+		return keys, err
+	}
+	for key := range t.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsSessions keeps a long-lived sandbox per conversation so functions and
+// variables defined by one quickjs call can be used by the next. Sessions
+// idle for longer than idle are closed, and once max sessions are live the
+// least recently used one is closed to make room.
+type jsSessions struct {
+	limits jsLimits
+	host   jsHost
+	idle   time.Duration
+	max    int
+
+	mu       sync.Mutex
+	sessions map[string]*jsSession
+}
+
+type jsSession struct {
+	sandbox  *jsSandbox
+	lastUsed time.Time
+}
+
+func newJSSessions(limits jsLimits, host jsHost, idle time.Duration, max int) *jsSessions {
+	return &jsSessions{
+		limits:   limits,
+		host:     host,
+		idle:     idle,
+		max:      max,
+		sessions: make(map[string]*jsSession),
+	}
+}
+
+// jsSessionsFromEnv returns nil unless JS_SESSIONS is true, quickjs calls
+// then each get a fresh context.
+func jsSessionsFromEnv(limits jsLimits, host jsHost) *jsSessions {
+	if os.Getenv("JS_SESSIONS") != "true" {
+		return nil
+	}
+	return newJSSessions(
+		limits,
+		host,
+		envDuration("JS_SESSION_IDLE_TIMEOUT", 30*time.Minute),
+		envInt("JS_MAX_SESSIONS", 20),
+	)
+}
+
+// Eval runs code in the session for key, starting one if there is none. A
+// sandbox that was stopped, for running too long or out of memory, is
+// dropped so the next call starts over.
+func (s *jsSessions) Eval(ctx context.Context, key string, code string) (string, error) {
+	session, evicted, err := s.session(key)
+	for _, e := range evicted {
+		e.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	result, err := session.Eval(ctx, code)
+	s.touch(key, session)
+	if err != nil {
+		s.remove(key, session)
+		return "Error: " + err.Error() + ". The session was reset, anything defined by earlier calls is gone.", nil
+	}
+	return result.String(), nil
+}
+
+func (s *jsSessions) session(key string) (*jsSandbox, []*jsSandbox, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[key]; ok {
+		session.lastUsed = time.Now()
+		return session.sandbox, nil, nil
+	}
+	evicted := []*jsSandbox{}
+	for s.max > 0 && len(s.sessions) >= s.max {
+		oldest := ""
+		for k, session := range s.sessions {
+			if oldest == "" || session.lastUsed.Before(s.sessions[oldest].lastUsed) {
+				oldest = k
+			}
+		}
+		evicted = append(evicted, s.sessions[oldest].sandbox)
+		delete(s.sessions, oldest)
+	}
+	sandbox, err := newJSSandbox(s.limits, s.host)
+	if err != nil {
+		return nil, evicted, err
+	}
+	s.sessions[key] = &jsSession{sandbox: sandbox, lastUsed: time.Now()}
+	return sandbox, evicted, nil
+}
+
+func (s *jsSessions) touch(key string, sandbox *jsSandbox) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[key]; ok && session.sandbox == sandbox {
+		session.lastUsed = time.Now()
+	}
+}
+
+func (s *jsSessions) remove(key string, sandbox *jsSandbox) {
+	s.mu.Lock()
+	if session, ok := s.sessions[key]; ok && session.sandbox == sandbox {
+		delete(s.sessions, key)
+	}
+	s.mu.Unlock()
+	sandbox.Close()
+}
+
+// Expire closes the sessions that have not been used since before now minus
+// the idle timeout.
+func (s *jsSessions) Expire(now time.Time) {
+	s.mu.Lock()
+	expired := []*jsSandbox{}
+	for key, session := range s.sessions {
+		if now.Sub(session.lastUsed) > s.idle {
+			expired = append(expired, session.sandbox)
+			delete(s.sessions, key)
+		}
+	}
+	s.mu.Unlock()
+	for _, sandbox := range expired {
+		sandbox.Close()
+	}
+}
+
+// WatchIdle runs Expire every interval until ctx is done.
+func (s *jsSessions) WatchIdle(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.Expire(now)
+		}
+	}
+}
+
+// Len is the number of live sessions.
+func (s *jsSessions) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_jsSessions(t *testing.T) {
+	sessions := newJSSessions(jsLimits{Timeout: time.Second}, nil, time.Minute, 2)
+	ctx := context.Background()
+	eval := func(key string, code string) string {
+		t.Helper()
+		got, err := sessions.Eval(ctx, key, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	eval("a", "const double = (n) => n * 2; let total = 1; function inc() { return ++total }")
+	if got := eval("a", "inc(); double(total)"); got != "4" {
+		t.Errorf("second call in a session = %q, want 4", got)
+	}
+	if got := eval("b", "var mark = 1; typeof double"); got != "undefined" {
+		t.Errorf("another session sees the first one's helpers: typeof double = %q", got)
+	}
+
+	if got := eval("a", "while (true) {}"); !strings.Contains(got, "The session was reset") {
+		t.Errorf("timed out call = %q, want it to say the session was reset", got)
+	}
+	if got := eval("a", "typeof double"); got != "undefined" {
+		t.Errorf("typeof double after a reset = %q, want undefined", got)
+	}
+
+	eval("c", "1")
+	if got := sessions.Len(); got != 2 {
+		t.Errorf("Len() = %d with a cap of 2", got)
+	}
+	if got := eval("b", "typeof mark"); got != "undefined" {
+		t.Errorf("the least recently used session was kept, typeof mark = %q", got)
+	}
+
+	sessions.Expire(time.Now().Add(2 * time.Minute))
+	if got := sessions.Len(); got != 0 {
+		t.Errorf("Len() = %d after the idle timeout, want 0", got)
+	}
+}
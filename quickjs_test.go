@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary act as the JavaScript sandbox process, the
+// same way main does, and as a tiny MCP server for the stdio tests.
+func TestMain(m *testing.M) {
+	if os.Getenv(jsSandboxEnv) != "" {
+		serveJSSandbox()
+		return
+	}
+	if os.Getenv(mcpTestServerEnv) != "" {
+		serveTestMCPStdio()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func Test_runJS(t *testing.T) {
+	tests := []struct {
+		name        string
+		code        string
+		memoryLimit int
+		want        string
+	}{
+		{name: "value", code: "1 + 2", want: "3"},
+		{name: "objects are JSON", code: "({a: [1, 2]})", want: `{"a":[1,2]}`},
+		{name: "console", code: `console.log("hello", {n: 1}); "done"`, want: "done\n\nconsole:\nhello {\"n\":1}"},
+		{name: "thrown errors", code: `console.log("before"); throw new Error("boom")`, want: "Error: Error: boom"},
+		{name: "infinite loop", code: "while (true) {}", want: "Error: the script did not finish within 2s and was stopped"},
+		{name: "memory limit", code: "var a = []; while (true) { a.push(new Array(1e6).fill(1)) }", memoryLimit: 256 << 20, want: "memory"},
+		{name: "no environment", code: `typeof process + " " + typeof print`, want: "undefined undefined"},
+		{name: "no modules", code: `import * as os from "os"; 1`, want: "Error: SyntaxError"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runJS(context.Background(), jsLimits{Timeout: 2 * time.Second, MemoryLimit: tt.memoryLimit}, nil, tt.code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(got, tt.want) {
+				t.Errorf("runJS() = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import "context"
+
+type reqIDKey struct{}
+
+// withReqID tags ctx with the id of the slack event being handled, so work
+// done for it can be traced back in the logs.
+func withReqID(ctx context.Context, reqID string) context.Context {
+	return context.WithValue(ctx, reqIDKey{}, reqID)
+}
+
+func reqIDFromContext(ctx context.Context) string {
+	reqID, _ := ctx.Value(reqIDKey{}).(string)
+	return reqID
+}
+
+type conversationIDKey struct{}
+
+// withConversationID tags ctx with the conversation a tool is called from,
+// tools that keep state per thread use it as their key.
+func withConversationID(ctx context.Context, conversationID string) context.Context {
+	return context.WithValue(ctx, conversationIDKey{}, conversationID)
+}
+
+func conversationIDFromContext(ctx context.Context) string {
+	conversationID, _ := ctx.Value(conversationIDKey{}).(string)
+	return conversationID
+}
+
+type allowedToolsKey struct{}
+
+// withAllowedTools narrows the tools that may be called in ctx to names.
+func withAllowedTools(ctx context.Context, names []string) context.Context {
+	allowed := make(map[string]bool, len(names))
+	for _, name := range names {
+		allowed[name] = true
+	}
+	return context.WithValue(ctx, allowedToolsKey{}, allowed)
+}
+
+// toolAllowed reports whether the named tool may be called in ctx. Every tool
+// is allowed unless withAllowedTools narrowed them. Tool calls from the model
+// and host functions called from quickjs both go through it.
+func toolAllowed(ctx context.Context, name string) bool {
+	allowed, ok := ctx.Value(allowedToolsKey{}).(map[string]bool)
+	return !ok || allowed[name]
+}
+
+type channelKey struct{}
+
+// withChannel tags ctx with the slack channel a conversation is in.
+func withChannel(ctx context.Context, channel string) context.Context {
+	return context.WithValue(ctx, channelKey{}, channel)
+}
+
+func channelFromContext(ctx context.Context) string {
+	channel, _ := ctx.Value(channelKey{}).(string)
+	return channel
+}
+
+type threadKey struct{}
+
+// withThread tags ctx with the slack thread a conversation is in.
+func withThread(ctx context.Context, thread string) context.Context {
+	return context.WithValue(ctx, threadKey{}, thread)
+}
+
+func threadFromContext(ctx context.Context) string {
+	thread, _ := ctx.Value(threadKey{}).(string)
+	return thread
+}
+
+type userKey struct{}
+
+// withUser tags ctx with the slack user whose message the agent is answering.
+func withUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+func userFromContext(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
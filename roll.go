@@ -1,16 +1,14 @@
 package main
 
 import (
-	"log"
 	"math/rand"
-	"net/http"
 	"strconv"
-	"time"
 
+	"github.com/pkg/errors"
 	"github.com/slack-go/slack"
 )
 
-func roll(s slack.SlashCommand, w http.ResponseWriter) {
+func roll(s slack.SlashCommand) (string, error) {
 	if s.Text == "" || s.Text == "help" {
 		msg := `returns a random number between 1 and N
 
@@ -20,22 +18,23 @@ Example:
 
 -> 1
 `
-		logErrMsgSlack(w, msg)
-		return
+		return msg, nil
 	}
 	i, err := strconv.Atoi(s.Text)
 	if err != nil {
-		logErrMsgSlack(w, "Invalid input: "+s.Text)
-		return
+		return "", errors.New("Invalid input: " + s.Text)
 	}
-	if i <= 0 {
-		logErrMsgSlack(w, "provide integer greater than 0")
-		return
-	}
-	rand.Seed(time.Now().UnixNano())
-	randInt := rand.Intn(i) + 1
-	err = msgSlack(strconv.Itoa(randInt), w)
+	randInt, err := rollDie(i)
 	if err != nil {
-		log.Println(err)
+		return "", err
+	}
+	return strconv.Itoa(randInt), nil
+}
+
+// rollDie returns a random number between 1 and sides.
+func rollDie(sides int) (int, error) {
+	if sides <= 0 {
+		return 0, errors.New("provide integer greater than 0")
 	}
+	return rand.Intn(sides) + 1, nil
 }
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"net/http"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/comprehend"
+	"github.com/pkg/errors"
 	"github.com/slack-go/slack"
 )
 
@@ -20,7 +20,7 @@ func unquoteCodePoint(s string) (string, error) {
 
 }
 
-func sentiment(s slack.SlashCommand, w http.ResponseWriter) {
+func sentiment(s slack.SlashCommand) (string, error) {
 	// s.Text
 	sess := session.Must(session.NewSession(&aws.Config{
 		Region: aws.String("us-east-2"),
@@ -37,8 +37,7 @@ func sentiment(s slack.SlashCommand, w http.ResponseWriter) {
 
 	err := req.Send()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return "", errors.Wrap(err, "failed to detect sentiment")
 	}
 
 	// https://stackoverflow.com/questions/55700149/print-emoji-from-unicode-literal-loaded-from-file
@@ -52,6 +51,5 @@ func sentiment(s slack.SlashCommand, w http.ResponseWriter) {
 	expressionless, _ := unquoteCodePoint("0001f611")
 	sentEmoji["NEUTRAL"] = expressionless
 
-	msg := sentEmoji[*resp.Sentiment] + " " + *resp.Sentiment
-	logErrMsgSlack(w, msg)
+	return sentEmoji[*resp.Sentiment] + " " + *resp.Sentiment, nil
 }
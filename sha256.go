@@ -3,15 +3,11 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
-
-	"net/http"
-
-	"github.com/slack-go/slack"
 )
 
-func mysha256(s slack.SlashCommand, w http.ResponseWriter) {
+// sha256Hex is the hex encoded SHA-256 digest of text.
+func sha256Hex(text string) string {
 	h := sha256.New()
-	h.Write([]byte(s.Text))
-	msg := hex.EncodeToString(h.Sum(nil))
-	logErrMsgSlack(w, msg)
+	h.Write([]byte(text))
+	return hex.EncodeToString(h.Sum(nil))
 }
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/slack-go/slack"
+)
+
+// Block Kit limits for a message.
+const (
+	slackSectionMaxChars = 3_000
+	slackMaxBlocks       = 50
+)
+
+// renderSlack converts the markdown the model writes to slack mrkdwn text and
+// Block Kit blocks. Headings become their own bold section, tables become
+// aligned code blocks and links become <url|text>. The text is the fallback
+// slack shows in notifications. blocks is nil when the message needs more
+// blocks than slack allows, the text is posted on its own then.
+func renderSlack(markdown string) (string, []slack.Block) {
+	parts := parseMarkdown(markdown)
+	texts := []string{}
+	for _, part := range parts {
+		if part.kind != mdDivider {
+			texts = append(texts, part.text)
+		}
+	}
+	text := strings.Join(texts, "\n\n")
+
+	blocks := []slack.Block{}
+	section := []string{}
+	size := 0
+	flush := func() {
+		if len(section) > 0 {
+			blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, strings.Join(section, "\n\n"), false, false), nil, nil))
+		}
+		section, size = nil, 0
+	}
+	for _, part := range parts {
+		switch part.kind {
+		case mdDivider:
+			flush()
+			blocks = append(blocks, slack.NewDividerBlock())
+			continue
+		case mdHeading:
+			flush()
+		}
+		for _, chunk := range part.chunks(slackSectionMaxChars) {
+			if size+len(chunk)+2 > slackSectionMaxChars {
+				flush()
+			}
+			section = append(section, chunk)
+			size += len(chunk) + 2
+		}
+		if part.kind == mdHeading {
+			flush()
+		}
+	}
+	flush()
+	if len(blocks) == 0 || len(blocks) > slackMaxBlocks {
+		return text, nil
+	}
+	return text, blocks
+}
+
+// renderSlackText is renderSlack for when only text can be sent, such as
+// while a reply is streamed.
+func renderSlackText(markdown string) string {
+	text, _ := renderSlack(markdown)
+	return text
+}
+
+type mdKind int
+
+const (
+	mdParagraph mdKind = iota
+	mdHeading
+	mdCode
+	mdDivider
+)
+
+// mdPart is a converted markdown block. text is mrkdwn, for code it is the
+// fenced block and lines are the escaped lines inside the fence.
+type mdPart struct {
+	kind  mdKind
+	text  string
+	lines []string
+}
+
+// chunks splits the part into pieces of at most max bytes. Code is split
+// between lines and every piece is fenced.
+func (p mdPart) chunks(max int) []string {
+	if len(p.text) <= max {
+		return []string{p.text}
+	}
+	var lines []string
+	wrap := func(s string) string { return s }
+	if p.kind == mdCode {
+		lines = p.lines
+		wrap = func(s string) string { return "```\n" + s + "\n```" }
+		max -= len("```\n\n```")
+	} else {
+		lines = strings.Split(p.text, "\n")
+	}
+	chunks := []string{}
+	current := ""
+	for _, line := range lines {
+		for len(line) > max {
+			if current != "" {
+				chunks = append(chunks, wrap(current))
+				current = ""
+			}
+			head := truncateText(line, max)
+			chunks = append(chunks, wrap(head))
+			line = line[len(head):]
+		}
+		if current != "" && len(current)+1+len(line) > max {
+			chunks = append(chunks, wrap(current))
+			current = ""
+		}
+		if current == "" {
+			current = line
+		} else {
+			current += "\n" + line
+		}
+	}
+	if current != "" {
+		chunks = append(chunks, wrap(current))
+	}
+	return chunks
+}
+
+var (
+	mdFencePattern         = regexp.MustCompile("^\\s{0,3}(```+|~~~+)")
+	mdHeadingPattern       = regexp.MustCompile(`^\s{0,3}#{1,6}\s+(.*?)(?:\s+#+)?\s*$`)
+	mdSetextPattern        = regexp.MustCompile(`^\s{0,3}(=+|-+)\s*$`)
+	mdRulePattern          = regexp.MustCompile(`^\s{0,3}(?:(?:-\s*){3,}|(?:\*\s*){3,}|(?:_\s*){3,})$`)
+	mdTableDividerPattern  = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+	mdBulletPattern        = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	mdTaskPattern          = regexp.MustCompile(`^\[([ xX])\]\s+(.*)$`)
+	mdOrderedPattern       = regexp.MustCompile(`^(\s*)(\d+)[.)]\s+(.*)$`)
+	mdQuotePattern         = regexp.MustCompile(`^\s{0,3}>\s?(.*)$`)
+	mdImagePattern         = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	mdLinkPattern          = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	mdSlackTokenPattern    = regexp.MustCompile(`<(?:[@#!][^>\s]+|(?:https?|mailto):[^>\s]+)>`)
+	mdBoldPattern          = regexp.MustCompile(`\*\*(\S(?:.*?\S)?)\*\*|__(\S(?:.*?\S)?)__`)
+	mdItalicPattern        = regexp.MustCompile(`(^|[^\w*])\*(\S(?:[^*]*?\S)?)\*`)
+	mdStrikePattern        = regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`)
+	mdPlaceholderPattern   = regexp.MustCompile("\x00(\\d+)\x00")
+	slackEscaper           = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	mdHeadingMarkerRemover = strings.NewReplacer("**", "", "__", "")
+)
+
+// parseMarkdown splits markdown into converted blocks.
+func parseMarkdown(markdown string) []mdPart {
+	lines := strings.Split(strings.ReplaceAll(markdown, "\r\n", "\n"), "\n")
+	parts := []mdPart{}
+	paragraph := []string{}
+	// raw is the unconverted last paragraph line, for setext headings
+	raw := ""
+	flush := func() {
+		if len(paragraph) > 0 {
+			parts = append(parts, mdPart{kind: mdParagraph, text: strings.Join(paragraph, "\n")})
+		}
+		paragraph, raw = nil, ""
+	}
+	heading := func(text string) {
+		flush()
+		text = strings.TrimSpace(mdHeadingMarkerRemover.Replace(text))
+		if text != "" {
+			parts = append(parts, mdPart{kind: mdHeading, text: "*" + inlineMrkdwn(text) + "*"})
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case mdFencePattern.MatchString(line):
+			flush()
+			fence := mdFencePattern.FindStringSubmatch(line)[1]
+			code := []string{}
+			for i++; i < len(lines); i++ {
+				if strings.HasPrefix(strings.TrimSpace(lines[i]), fence[:3]) && strings.Trim(strings.TrimSpace(lines[i]), fence[:1]) == "" {
+					break
+				}
+				code = append(code, slackEscaper.Replace(lines[i]))
+			}
+			if i == len(lines) {
+				// an unclosed fence runs to the end, without the blank lines
+				// the message ends with
+				for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+					code = code[:len(code)-1]
+				}
+			}
+			parts = append(parts, codePart(code))
+		case mdHeadingPattern.MatchString(line):
+			heading(mdHeadingPattern.FindStringSubmatch(line)[1])
+		case raw != "" && !isListLine(raw) && mdSetextPattern.MatchString(line):
+			// the last paragraph line was a heading
+			paragraph = paragraph[:len(paragraph)-1]
+			heading(raw)
+		case mdRulePattern.MatchString(line):
+			flush()
+			parts = append(parts, mdPart{kind: mdDivider})
+		case strings.Contains(line, "|") && i+1 < len(lines) && mdTableDividerPattern.MatchString(lines[i+1]) && strings.Contains(lines[i+1], "-"):
+			flush()
+			rows := [][]string{splitTableRow(line)}
+			align := tableAlignment(splitTableRow(lines[i+1]))
+			for i += 2; i < len(lines) && strings.Contains(lines[i], "|") && strings.TrimSpace(lines[i]) != ""; i++ {
+				rows = append(rows, splitTableRow(lines[i]))
+			}
+			i--
+			parts = append(parts, codePart(renderTable(rows, align)))
+		case strings.TrimSpace(line) == "":
+			flush()
+		default:
+			paragraph = append(paragraph, blockMrkdwn(line))
+			raw = line
+		}
+	}
+	flush()
+	return parts
+}
+
+func isListLine(line string) bool {
+	return mdBulletPattern.MatchString(line) || mdOrderedPattern.MatchString(line) || mdQuotePattern.MatchString(line)
+}
+
+func codePart(lines []string) mdPart {
+	return mdPart{kind: mdCode, text: "```\n" + strings.Join(lines, "\n") + "\n```", lines: lines}
+}
+
+// blockMrkdwn converts one paragraph line, keeping list and quote markers.
+func blockMrkdwn(line string) string {
+	if m := mdQuotePattern.FindStringSubmatch(line); m != nil {
+		return strings.TrimRight("> "+blockMrkdwn(m[1]), " ")
+	}
+	if m := mdBulletPattern.FindStringSubmatch(line); m != nil {
+		item := m[2]
+		bullet := "•"
+		if task := mdTaskPattern.FindStringSubmatch(item); task != nil {
+			bullet = "☐"
+			if task[1] != " " {
+				bullet = "☑"
+			}
+			item = task[2]
+		}
+		return listIndent(m[1]) + bullet + " " + inlineMrkdwn(item)
+	}
+	if m := mdOrderedPattern.FindStringSubmatch(line); m != nil {
+		return listIndent(m[1]) + m[2] + ". " + inlineMrkdwn(m[3])
+	}
+	return inlineMrkdwn(strings.TrimSpace(line))
+}
+
+// listIndent keeps the indentation of nested list items, with tabs as four
+// spaces.
+func listIndent(indent string) string {
+	return strings.ReplaceAll(indent, "\t", "    ")
+}
+
+// inlineMrkdwn converts emphasis, links and code spans and escapes the
+// characters slack treats as markup. Slack's own <@U123>, <#C123> and <url>
+// tokens are kept.
+func inlineMrkdwn(text string) string {
+	out := strings.Builder{}
+	for text != "" {
+		start := strings.Index(text, "`")
+		if start < 0 {
+			out.WriteString(emphasisMrkdwn(text))
+			break
+		}
+		ticks := len(text[start:]) - len(strings.TrimLeft(text[start:], "`"))
+		end := strings.Index(text[start+ticks:], strings.Repeat("`", ticks))
+		if end < 0 {
+			out.WriteString(emphasisMrkdwn(text))
+			break
+		}
+		out.WriteString(emphasisMrkdwn(text[:start]))
+		code := strings.TrimSpace(text[start+ticks : start+ticks+end])
+		out.WriteString("`" + slackEscaper.Replace(code) + "`")
+		text = text[start+ticks+end+ticks:]
+	}
+	return out.String()
+}
+
+func emphasisMrkdwn(text string) string {
+	// \x00 and \x01 mark placeholders and bold below, drop any in the input
+	// so they can't be mistaken for ours
+	text = strings.NewReplacer("\x00", "", "\x01", "").Replace(text)
+	kept := []string{}
+	keep := func(s string) string {
+		kept = append(kept, s)
+		return fmt.Sprintf("\x00%d\x00", len(kept)-1)
+	}
+	text = mdSlackTokenPattern.ReplaceAllStringFunc(text, keep)
+	text = mdImagePattern.ReplaceAllStringFunc(text, func(s string) string {
+		m := mdImagePattern.FindStringSubmatch(s)
+		label := m[1]
+		if label == "" {
+			label = m[2]
+		}
+		return keep(slackLink(m[2], label))
+	})
+	text = mdLinkPattern.ReplaceAllStringFunc(text, func(s string) string {
+		m := mdLinkPattern.FindStringSubmatch(s)
+		return keep(slackLink(m[2], emphasisMrkdwn(m[1])))
+	})
+	text = slackEscaper.Replace(text)
+	// bold is marked with \x01 until italics are converted, slack uses a
+	// single * for bold
+	text = mdBoldPattern.ReplaceAllString(text, "\x01$1$2\x01")
+	text = mdItalicPattern.ReplaceAllString(text, "${1}_${2}_")
+	text = mdStrikePattern.ReplaceAllString(text, "~$1~")
+	text = strings.ReplaceAll(text, "\x01", "*")
+	return mdPlaceholderPattern.ReplaceAllStringFunc(text, func(s string) string {
+		i, err := strconv.Atoi(strings.Trim(s, "\x00"))
+		if err != nil || i >= len(kept) {
+			return s
+		}
+		return kept[i]
+	})
+}
+
+// slackLink is a <url|label> link, label is already mrkdwn.
+func slackLink(url string, label string) string {
+	url = slackEscaper.Replace(url)
+	if label == "" || label == url {
+		return "<" + url + ">"
+	}
+	return "<" + url + "|" + strings.ReplaceAll(label, "|", "¦") + ">"
+}
+
+// splitTableRow splits a markdown table row into its cells.
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = line[:len(line)-1]
+	}
+	cells := []string{}
+	cell := strings.Builder{}
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line) && line[i+1] == '|':
+			cell.WriteByte('|')
+			i++
+		case line[i] == '|':
+			cells = append(cells, strings.TrimSpace(cell.String()))
+			cell.Reset()
+		default:
+			cell.WriteByte(line[i])
+		}
+	}
+	return append(cells, strings.TrimSpace(cell.String()))
+}
+
+type tableAlign int
+
+const (
+	alignLeft tableAlign = iota
+	alignRight
+	alignCenter
+)
+
+func tableAlignment(divider []string) []tableAlign {
+	align := make([]tableAlign, len(divider))
+	for i, cell := range divider {
+		left, right := strings.HasPrefix(cell, ":"), strings.HasSuffix(cell, ":")
+		switch {
+		case left && right:
+			align[i] = alignCenter
+		case right:
+			align[i] = alignRight
+		}
+	}
+	return align
+}
+
+// plainCell strips inline markdown from a table cell, it is shown in a code
+// block where slack doesn't format anything.
+func plainCell(cell string) string {
+	cell = mdImagePattern.ReplaceAllString(cell, "$1")
+	cell = mdLinkPattern.ReplaceAllString(cell, "$1 ($2)")
+	cell = mdBoldPattern.ReplaceAllString(cell, "$1$2")
+	cell = mdStrikePattern.ReplaceAllString(cell, "$1")
+	cell = mdItalicPattern.ReplaceAllString(cell, "$1$2")
+	return strings.ReplaceAll(cell, "`", "")
+}
+
+// renderTable lays the rows out as aligned, escaped text lines.
+func renderTable(rows [][]string, align []tableAlign) []string {
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	widths := make([]int, columns)
+	for r, row := range rows {
+		for c := range row {
+			row[c] = plainCell(row[c])
+			if n := utf8.RuneCountInString(row[c]); n > widths[c] {
+				widths[c] = n
+			}
+		}
+		rows[r] = row
+	}
+	pad := func(cell string, width int, a tableAlign) string {
+		space := width - utf8.RuneCountInString(cell)
+		switch a {
+		case alignRight:
+			return strings.Repeat(" ", space) + cell
+		case alignCenter:
+			return strings.Repeat(" ", space/2) + cell + strings.Repeat(" ", space-space/2)
+		default:
+			return cell + strings.Repeat(" ", space)
+		}
+	}
+	lines := []string{}
+	for r, row := range rows {
+		cells := make([]string, columns)
+		for c := 0; c < columns; c++ {
+			cell := ""
+			if c < len(row) {
+				cell = row[c]
+			}
+			a := alignLeft
+			if c < len(align) {
+				a = align[c]
+			}
+			cells[c] = pad(cell, widths[c], a)
+		}
+		lines = append(lines, slackEscaper.Replace(strings.TrimRight(strings.Join(cells, " | "), " ")))
+		if r == 0 {
+			dashes := make([]string, columns)
+			for c := range dashes {
+				dashes[c] = strings.Repeat("-", widths[c])
+			}
+			lines = append(lines, strings.Join(dashes, "-+-"))
+		}
+	}
+	return lines
+}
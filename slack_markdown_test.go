@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/slack-go/slack"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// Test_renderSlack renders every testdata/slack_markdown/*.md file and
+// compares the text and blocks to the .golden file next to it. Run the tests
+// with -update to rewrite the golden files after changing the renderer.
+func Test_renderSlack(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/slack_markdown/*.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no testdata")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".md")
+		t.Run(name, func(t *testing.T) {
+			markdown, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			text, blocks := renderSlack(string(markdown))
+			var buf bytes.Buffer
+			encoder := json.NewEncoder(&buf)
+			encoder.SetEscapeHTML(false)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(struct {
+				Text   string        `json:"text"`
+				Blocks []slack.Block `json:"blocks"`
+			}{text, blocks})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := buf.Bytes()
+
+			golden := strings.TrimSuffix(input, ".md") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(want), string(got)); diff != "" {
+				t.Errorf("renderSlack(%s) (-want +got):\n%s", input, diff)
+			}
+
+			for i, block := range blocks {
+				if section, ok := block.(*slack.SectionBlock); ok && len(section.Text.Text) > slackSectionMaxChars {
+					t.Errorf("block %d has %d characters, slack allows %d", i, len(section.Text.Text), slackSectionMaxChars)
+				}
+			}
+			if len(blocks) > slackMaxBlocks {
+				t.Errorf("%d blocks, slack allows %d", len(blocks), slackMaxBlocks)
+			}
+		})
+	}
+}
+
+// Test_renderSlack_Control renders input with the control characters the
+// renderer uses as placeholders, it used to panic.
+func Test_renderSlack_Control(t *testing.T) {
+	inputs := []string{
+		"000000000|\n       -\x0000\x0000",
+		"**bold \x01** and \x000\x00",
+	}
+	for _, input := range inputs {
+		text, _ := renderSlack(input)
+		if strings.ContainsAny(text, "\x00\x01") {
+			t.Errorf("renderSlack(%q) = %q, want no control characters", input, text)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// slackPoster posts text that may be too long for one slack message. Text
+// over SplitChars is split into numbered replies in the thread, text over
+// UploadChars is uploaded as a file with a short preview.
+type slackPoster struct {
+	api         *slack.Client
+	SplitChars  int
+	UploadChars int
+	// PreviewChars is how much of an uploaded text the preview shows.
+	PreviewChars int
+}
+
+func newSlackPoster(api *slack.Client) *slackPoster {
+	return &slackPoster{
+		api:          api,
+		SplitChars:   envInt("SLACK_SPLIT_CHARS", 3_500),
+		UploadChars:  envInt("SLACK_UPLOAD_CHARS", 20_000),
+		PreviewChars: 1_000,
+	}
+}
+
+// partNumberChars is the room left in every part for its "(1/3)" line.
+const partNumberChars = 16
+
+// Post posts the markdown text to channel, in thread if it is set. When the
+// text is split or uploaded and there is no thread, the rest goes in the
+// thread of the first message. first, if not nil, posts the first message
+// instead, a streamed reply uses it to edit its placeholder. filename names
+// the file when the text is uploaded. opts are added to every message.
+func (p *slackPoster) Post(ctx context.Context, channel string, thread string, text string, filename string, first func(text string) error, opts ...slack.MsgOption) error {
+	if first == nil {
+		first = func(text string) error {
+			posted, ts, err := p.postMessage(ctx, channel, thread, text, opts...)
+			if err != nil {
+				return err
+			}
+			// a message to a user id lands in the dm channel, files have to
+			// be shared there
+			channel = posted
+			if thread == "" {
+				thread = ts
+			}
+			return nil
+		}
+	}
+
+	if p.UploadChars > 0 && len(text) > p.UploadChars {
+		preview := splitMarkdown(text, p.PreviewChars)[0]
+		preview += fmt.Sprintf("\n\n_... the full reply is %d characters, it is in the attached %s_", len(text), filename)
+		if err := first(preview); err != nil {
+			return err
+		}
+		_, err := p.api.UploadFileV2Context(ctx, slack.UploadFileV2Parameters{
+			Channel:         channel,
+			ThreadTimestamp: thread,
+			Filename:        filename,
+			Title:           filename,
+			Content:         text,
+			FileSize:        len(text),
+		})
+		return errors.Wrap(err, "couldn't upload reply")
+	}
+
+	parts := []string{text}
+	if p.SplitChars > 0 && len(text) > p.SplitChars {
+		parts = splitMarkdown(text, p.SplitChars-partNumberChars)
+	}
+	for i, part := range parts {
+		if len(parts) > 1 {
+			part = fmt.Sprintf("(%d/%d)\n%s", i+1, len(parts), part)
+		}
+		if i == 0 {
+			if err := first(part); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, _, err := p.postMessage(ctx, channel, thread, part, opts...); err != nil {
+			return errors.Wrapf(err, "couldn't post part %d of %d", i+1, len(parts))
+		}
+	}
+	return nil
+}
+
+// postMessage renders the markdown text and posts it, returning the channel
+// and timestamp of the message.
+func (p *slackPoster) postMessage(ctx context.Context, channel string, thread string, text string, opts ...slack.MsgOption) (string, string, error) {
+	text, blocks := renderSlack(text)
+	options := append([]slack.MsgOption{
+		slack.MsgOptionText(text, false),
+		slack.MsgOptionBlocks(blocks...),
+	}, opts...)
+	if thread != "" {
+		options = append(options, slack.MsgOptionTS(thread))
+	}
+	return p.api.PostMessageContext(ctx, channel, options...)
+}
+
+// splitMarkdown splits text into parts of at most max bytes. It splits
+// between paragraphs where it can, then between lines, and only cuts a line
+// if it is longer than max. Code fences split over parts are closed at the
+// end of one and opened again at the start of the next.
+func splitMarkdown(text string, max int) []string {
+	if len(text) <= max {
+		return []string{text}
+	}
+	pieces := []string{}
+	for _, paragraph := range markdownParagraphs(text) {
+		if len(paragraph) <= max {
+			pieces = append(pieces, paragraph)
+			continue
+		}
+		pieces = append(pieces, splitLines(paragraph, max)...)
+	}
+
+	parts := []string{}
+	current := ""
+	for _, piece := range pieces {
+		if current != "" && len(current)+2+len(piece) > max {
+			parts = append(parts, current)
+			current = ""
+		}
+		if current == "" {
+			current = piece
+		} else {
+			current += "\n\n" + piece
+		}
+	}
+	if current != "" {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// markdownParagraphs splits text at blank lines, keeping fenced code blocks
+// whole.
+func markdownParagraphs(text string) []string {
+	paragraphs := []string{}
+	current := []string{}
+	fence := ""
+	flush := func() {
+		if len(current) > 0 {
+			paragraphs = append(paragraphs, strings.Join(current, "\n"))
+		}
+		current = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		if m := mdFencePattern.FindStringSubmatch(line); m != nil {
+			if fence == "" {
+				fence = m[1]
+			} else if strings.HasPrefix(strings.TrimSpace(line), fence) {
+				fence = ""
+			}
+		}
+		if fence == "" && strings.TrimSpace(line) == "" {
+			flush()
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+	return paragraphs
+}
+
+// splitLines splits a paragraph that is over max between lines. If it is a
+// fenced code block every piece is fenced.
+func splitLines(paragraph string, max int) []string {
+	lines := strings.Split(paragraph, "\n")
+	open, close := "", ""
+	if m := mdFencePattern.FindStringSubmatch(lines[0]); m != nil {
+		open, close = strings.TrimSpace(lines[0]), m[1]
+		lines = lines[1:]
+		if len(lines) > 0 && strings.HasPrefix(strings.TrimSpace(lines[len(lines)-1]), close) {
+			lines = lines[:len(lines)-1]
+		}
+	}
+	wrap := func(s string) string {
+		if open == "" {
+			return s
+		}
+		return open + "\n" + s + "\n" + close
+	}
+	room := max
+	if open != "" {
+		room -= len(open) + len(close) + 2
+	}
+
+	pieces := []string{}
+	current := ""
+	add := func(line string) {
+		if current != "" && len(current)+1+len(line) > room {
+			pieces = append(pieces, wrap(current))
+			current = ""
+		}
+		if current == "" {
+			current = line
+		} else {
+			current += "\n" + line
+		}
+	}
+	for _, line := range lines {
+		for len(line) > room {
+			head := truncateText(line, room)
+			add(head)
+			line = line[len(head):]
+		}
+		add(line)
+	}
+	if current != "" {
+		pieces = append(pieces, wrap(current))
+	}
+	return pieces
+}
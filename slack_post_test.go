@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/slack-go/slack"
+)
+
+func Test_splitMarkdown(t *testing.T) {
+	code := "```go\n" + strings.Repeat("fmt.Println(1)\n", 6) + "```"
+	tests := []struct {
+		name string
+		text string
+		max  int
+		want []string
+	}{
+		{
+			name: "short",
+			text: "hello",
+			max:  100,
+			want: []string{"hello"},
+		},
+		{
+			name: "paragraphs",
+			text: "first paragraph\n\nsecond paragraph\n\nthird",
+			max:  35,
+			want: []string{"first paragraph\n\nsecond paragraph", "third"},
+		},
+		{
+			name: "code block kept whole",
+			text: "intro\n\n" + code + "\n\nend",
+			max:  110,
+			want: []string{"intro\n\n" + code, "end"},
+		},
+		{
+			name: "long code block fenced in every part",
+			text: code,
+			max:  50,
+			want: []string{
+				"```go\nfmt.Println(1)\nfmt.Println(1)\n```",
+				"```go\nfmt.Println(1)\nfmt.Println(1)\n```",
+				"```go\nfmt.Println(1)\nfmt.Println(1)\n```",
+			},
+		},
+		{
+			name: "blank lines in code",
+			text: "```\na\n\nb\n```\n\nafter",
+			max:  12,
+			want: []string{"```\na\n\nb\n```", "after"},
+		},
+		{
+			name: "long line",
+			text: strings.Repeat("x", 25),
+			max:  10,
+			want: []string{"xxxxxxxxxx", "xxxxxxxxxx", "xxxxx"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitMarkdown(tt.text, tt.max)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("splitMarkdown() (-want +got):\n%s", diff)
+			}
+			for _, part := range got {
+				if len(part) > tt.max {
+					t.Errorf("part is %d bytes, want at most %d", len(part), tt.max)
+				}
+			}
+		})
+	}
+}
+
+// fakeSlackPosts records chat.postMessage calls and file uploads.
+type fakeSlackPosts struct {
+	mu       sync.Mutex
+	messages []map[string]string
+	uploaded string
+	shared   string
+}
+
+func (f *fakeSlackPosts) server(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		response := map[string]interface{}{"ok": true}
+		switch r.URL.Path {
+		case "/chat.postMessage":
+			r.ParseForm()
+			channel := r.Form.Get("channel")
+			f.messages = append(f.messages, map[string]string{"channel": channel, "thread_ts": r.Form.Get("thread_ts"), "text": r.Form.Get("text")})
+			// messages to a user go to the dm with them
+			response["channel"] = strings.Replace(channel, "U", "D", 1)
+			response["ts"] = fmt.Sprintf("2000.%06d", len(f.messages))
+		case "/files.getUploadURLExternal":
+			response["upload_url"] = server.URL + "/upload"
+			response["file_id"] = "F1"
+		case "/upload":
+			r.ParseMultipartForm(1 << 20)
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				t.Errorf("upload without a file: %v", err)
+				break
+			}
+			b, _ := io.ReadAll(file)
+			f.uploaded = string(b)
+		case "/files.completeUploadExternal":
+			r.ParseForm()
+			f.shared = r.Form.Get("channel_id") + " " + r.Form.Get("thread_ts")
+			response["files"] = []map[string]string{{"id": "F1", "title": "reply.md"}}
+		default:
+			t.Errorf("unexpected call to %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	return server
+}
+
+func Test_slackPoster_Post(t *testing.T) {
+	paragraph := strings.Repeat("word ", 15)
+	long := strings.TrimSpace(strings.Repeat(paragraph+"\n\n", 4))
+
+	t.Run("split into numbered replies", func(t *testing.T) {
+		fake := &fakeSlackPosts{}
+		server := fake.server(t)
+		defer server.Close()
+		poster := &slackPoster{api: slack.New("token", slack.OptionAPIURL(server.URL+"/")), SplitChars: 200, UploadChars: 1_000, PreviewChars: 100}
+
+		if err := poster.Post(context.Background(), "UALICE", "", long, "reply.md", nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.messages) != 2 {
+			t.Fatalf("posted %d messages, want 2: %v", len(fake.messages), fake.messages)
+		}
+		if m := fake.messages[0]; m["channel"] != "UALICE" || m["thread_ts"] != "" || !strings.HasPrefix(m["text"], "(1/2)\n") {
+			t.Errorf("first message = %v, want (1/2) posted to UALICE", m)
+		}
+		if m := fake.messages[1]; m["channel"] != "DALICE" || m["thread_ts"] != "2000.000001" || !strings.HasPrefix(m["text"], "(2/2)\n") {
+			t.Errorf("second message = %v, want (2/2) in the dm thread of the first", m)
+		}
+	})
+
+	t.Run("uploaded as a file", func(t *testing.T) {
+		fake := &fakeSlackPosts{}
+		server := fake.server(t)
+		defer server.Close()
+		poster := &slackPoster{api: slack.New("token", slack.OptionAPIURL(server.URL+"/")), SplitChars: 50, UploadChars: 200, PreviewChars: 100}
+
+		if err := poster.Post(context.Background(), "UALICE", "1000.1", long, "reply.md", nil); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.messages) != 1 {
+			t.Fatalf("posted %d messages, want a preview: %v", len(fake.messages), fake.messages)
+		}
+		preview := fake.messages[0]["text"]
+		if !strings.HasPrefix(preview, strings.TrimSpace(paragraph)) || !strings.Contains(preview, "attached reply.md") || len(preview) > 300 {
+			t.Errorf("preview = %q", preview)
+		}
+		if fake.uploaded != long {
+			t.Errorf("uploaded %q, want the whole text", fake.uploaded)
+		}
+		if fake.shared != "DALICE 1000.1" {
+			t.Errorf("file shared to %q, want the thread 1000.1", fake.shared)
+		}
+	})
+}
@@ -30,31 +30,16 @@ func (nd nameDays) Days() int {
 	return int(end.Sub(start).Hours() / 24)
 }
 
-func streak(s slack.SlashCommand) (string, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
-		o.Region = AWSRegion
-	})
+func streak(streakTable StreakTable, s slack.SlashCommand) (string, error) {
 	text := strings.TrimSpace(s.Text)
-	streakTable := StreakTable{
-		TableName:      "streaks",
-		DynamoDbClient: client,
-	}
-
-	// todo should prob do this somewhere else but for now it's fine
-	_, _ = streakTable.CreateTable()
 
 	// if text is empty, return list of all streaks
 	if text == "" {
-		strks, err := streakTable.ListStreaks(s.UserID)
+		msg, err := listStreaks(streakTable, s.UserID)
 		if err != nil {
-			return "", errors.Wrap(err, "failed to list streaks")
+			return "", err
 		}
-		msg := "Streaks for " + s.UserName + ":\n"
-		for _, strk := range strks {
-			msg += strk.Name() + ": " + fmt.Sprintf("%d", nameDays{streakEntry: strk}.Days()) + " days\n"
-		}
-		return msg, nil
+		return "Streaks for " + s.UserName + ":\n" + msg, nil
 	}
 
 	streakEntry := streakEntry{
@@ -64,7 +49,7 @@ func streak(s slack.SlashCommand) (string, error) {
 
 	// if text begins with "delete", delete streak by name
 	if strings.HasPrefix(text, "delete") {
-		err = streakTable.DeleteStreak(streakEntry)
+		err := streakTable.DeleteStreak(streakEntry)
 		if err != nil {
 			return "", errors.Wrap(err, "failed to delete streak")
 		}
@@ -72,14 +57,47 @@ func streak(s slack.SlashCommand) (string, error) {
 	}
 	// if text begins with "add", add streak by name
 	if strings.HasPrefix(text, "add") {
-		err = streakTable.AddStreak(streakEntry)
+		err := streakTable.AddStreak(streakEntry)
 		if err != nil {
 			return "", errors.Wrap(err, "failed to add streak")
 		}
 		return "Added streak " + streakEntry.Name(), nil
 	}
 
-	return "", nil
+	return "", errors.New("usage: /streak [add <name> | delete <name>]")
+}
+
+// newStreakTable connects to the streaks table in DynamoDB and creates it if
+// it doesn't exist, it is called once on startup.
+func newStreakTable(ctx context.Context) (StreakTable, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return StreakTable{}, errors.Wrap(err, "failed to load aws config")
+	}
+	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+		o.Region = AWSRegion
+	})
+	streakTable := StreakTable{
+		TableName:      "streaks",
+		DynamoDbClient: client,
+	}
+
+	// fails when the table is already there
+	_, _ = streakTable.CreateTable()
+	return streakTable, nil
+}
+
+// listStreaks is a line per streak of user with how many days it has run.
+func listStreaks(streakTable StreakTable, user string) (string, error) {
+	strks, err := streakTable.ListStreaks(user)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list streaks")
+	}
+	msg := ""
+	for _, strk := range strks {
+		msg += strk.Name() + ": " + fmt.Sprintf("%d", nameDays{streakEntry: strk}.Days()) + " days\n"
+	}
+	return msg, nil
 }
 
 type streakEntry struct {
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+// streamUpdateInterval is the minimum time between chat.update calls for a
+// single reply, chat.update is rate limited to roughly one call per second.
+var streamUpdateInterval = time.Second
+
+const streamPlaceholder = "_thinking..._"
+
+type textStreamKey struct{}
+
+// withTextStream returns a context that makes the LLM stream its reply,
+// calling onText with every text delta.
+func withTextStream(ctx context.Context, onText func(text string)) context.Context {
+	return context.WithValue(ctx, textStreamKey{}, onText)
+}
+
+func textStreamFromContext(ctx context.Context) func(text string) {
+	onText, _ := ctx.Value(textStreamKey{}).(func(text string))
+	return onText
+}
+
+// streamReplies reports whether agent replies should be streamed into slack,
+// set STREAM_REPLIES=true to enable it.
+func streamReplies() bool {
+	return os.Getenv("STREAM_REPLIES") == "true"
+}
+
+// slackReply is a single bot reply in a thread. When streaming it posts a
+// placeholder right away and edits it with chat.update as text arrives,
+// otherwise the reply is posted once Finish is called.
+type slackReply struct {
+	api     *slack.Client
+	channel string
+	thread  string
+	reqID   string
+	poster  *slackPoster
+	// thinking is how the model's thinking is shown.
+	thinking thinkingVisibility
+
+	mu         sync.Mutex
+	stream     bool
+	ts         string
+	text       strings.Builder
+	lastUpdate time.Time
+}
+
+func newSlackReply(api *slack.Client, channel string, thread string, reqID string, stream bool) *slackReply {
+	return &slackReply{
+		api:      api,
+		channel:  channel,
+		thread:   thread,
+		reqID:    reqID,
+		poster:   newSlackPoster(api),
+		thinking: thinkingVisibilityFromEnv(),
+		stream:   stream,
+	}
+}
+
+// Context returns ctx with the reply attached as the text stream. If the
+// placeholder can't be posted the reply falls back to posting on Finish.
+func (r *slackReply) Context(ctx context.Context) context.Context {
+	if !r.stream {
+		return ctx
+	}
+	_, ts, err := r.api.PostMessage(
+		r.channel,
+		slack.MsgOptionText(streamPlaceholder, false),
+		slack.MsgOptionTS(r.thread),
+	)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"reqID": r.reqID, "error": err, "stack": fmt.Sprintf("%+v", err)}).Error("Failed to post placeholder reply")
+		r.stream = false
+		return ctx
+	}
+	r.ts = ts
+	r.lastUpdate = time.Now()
+	return withTextStream(ctx, r.write)
+}
+
+func (r *slackReply) write(text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.text.WriteString(text)
+	if time.Since(r.lastUpdate) < streamUpdateInterval {
+		return
+	}
+	r.update(renderSlackText(r.text.String()), nil)
+}
+
+// update edits the placeholder, r.mu must be held. blocks may be nil.
+func (r *slackReply) update(text string, blocks []slack.Block) {
+	r.lastUpdate = time.Now()
+	_, _, _, err := r.api.UpdateMessage(
+		r.channel,
+		r.ts,
+		slack.MsgOptionText(text, false),
+		slack.MsgOptionBlocks(blocks...),
+	)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"reqID": r.reqID, "error": err, "stack": fmt.Sprintf("%+v", err)}).Error("Failed to update streamed reply")
+	}
+}
+
+// Finish replaces the streamed text with the final message, or posts it when
+// the reply isn't streamed. The message is markdown and is rendered for
+// slack. Long messages are split over several replies or uploaded as a
+// file. An empty message removes the placeholder. thinking is posted under
+// the reply when the thinking visibility allows.
+func (r *slackReply) Finish(text string, thinking string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if strings.TrimSpace(text) == "" {
+		if r.stream {
+			if _, _, err := r.api.DeleteMessage(r.channel, r.ts); err != nil {
+				log.WithFields(log.Fields{"reqID": r.reqID, "error": err}).Error("Failed to delete placeholder reply")
+			}
+		}
+		return
+	}
+	thread := r.thread
+	var first func(text string) error
+	if r.stream {
+		if thread == "" {
+			thread = r.ts
+		}
+		first = func(text string) error {
+			r.update(renderSlack(text))
+			return nil
+		}
+	}
+	err := r.poster.Post(context.Background(), r.channel, thread, text, "reply.md", first)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"reqID": r.reqID, "error": err, "stack": fmt.Sprintf("%+v", err)}).Error("Failed to reply in thread (message event)")
+		return
+	}
+	if r.thinking != thinkingContext || strings.TrimSpace(thinking) == "" {
+		return
+	}
+	_, _, err = r.api.PostMessage(
+		r.channel,
+		slack.MsgOptionText("reasoning", false),
+		slack.MsgOptionBlocks(thinkingBlocks(thinking)...),
+		slack.MsgOptionTS(thread),
+	)
+	if err != nil {
+		log.WithFields(log.Fields{"reqID": r.reqID, "error": err}).Error("Failed to post reasoning")
+	}
+}
+
+var _ agentOutput = &slackAgentOutput{}
+
+// slackAgentOutput posts every agent loop response as its own reply in the
+// thread.
+type slackAgentOutput struct {
+	api     *slack.Client
+	channel string
+	thread  string
+	reqID   string
+	stream  bool
+}
+
+func (o *slackAgentOutput) Reply(ctx context.Context) (context.Context, func(text string, thinking string)) {
+	reply := newSlackReply(o.api, o.channel, o.thread, o.reqID, o.stream)
+	return reply.Context(ctx), reply.Finish
+}
+
+func (o *slackAgentOutput) Status(text string) {
+	newSlackReply(o.api, o.channel, o.thread, o.reqID, false).Finish(text, "")
+}
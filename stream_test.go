@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/slack-go/slack"
+)
+
+// newSSEServer replays events as a server-sent event stream for every request.
+func newSSEServer(t *testing.T, events []string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range events {
+			eventType := strings.SplitN(strings.SplitN(event, `"type": "`, 2)[1], `"`, 2)[0]
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", eventType, event)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLLM_PromptStreaming(t *testing.T) {
+	server := newSSEServer(t, []string{
+		`{"type": "message_start", "message": {"id": "msg_1", "type": "message", "role": "assistant", "content": [], "model": "claude", "usage": {"input_tokens": 1, "output_tokens": 1}}}`,
+		`{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "let me "}}`,
+		`{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "check"}}`,
+		`{"type": "content_block_stop", "index": 0}`,
+		`{"type": "content_block_start", "index": 1, "content_block": {"type": "tool_use", "id": "toolu_1", "name": "echo", "input": {}}}`,
+		`{"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": "{\"text\":"}}`,
+		`{"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": " \"hi\"}"}}`,
+		`{"type": "content_block_stop", "index": 1}`,
+		`{"type": "message_delta", "delta": {"stop_reason": "tool_use"}, "usage": {"output_tokens": 10}}`,
+		`{"type": "message_stop"}`,
+	})
+
+	llm := NewLLM(
+		anthropic.NewClient(option.WithBaseURL(server.URL), option.WithAPIKey("test")),
+		NewAnthropicMessageHandler([]ToolHandler{
+			CreateToolHandler("echo", "Echo the text back", func(input struct {
+				Text string `json:"text"`
+			}) (*string, error) {
+				return &input.Text, nil
+			}),
+		}),
+	)
+	store := NewSlackMessageStore(llm)
+
+	var deltas []string
+	ctx := withTextStream(context.Background(), func(text string) {
+		deltas = append(deltas, text)
+	})
+	resp, err := store.CallLLM(ctx, "test", "say hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(deltas, "|"); got != "let me |check" {
+		t.Errorf("streamed deltas = %q, want %q", got, "let me |check")
+	}
+	if !resp.Loop {
+		t.Errorf("CallLLM() Loop = false, want true")
+	}
+	messages := store.GetMessages()["test"]
+	if len(messages) < 3 {
+		t.Fatalf("stored %d messages, want at least 3", len(messages))
+	}
+	toolUse := messages[1].Content[1].OfToolUse
+	if toolUse == nil || toolUse.Name != "echo" || toolUse.ID != "toolu_1" {
+		t.Errorf("stored tool_use = %v, want echo toolu_1", messages[1].Content[1])
+	}
+	toolResult := messages[2].Content[0].OfToolResult
+	if toolResult == nil || toolResult.Content[0].OfText.Text != "hi" {
+		t.Errorf("stored tool_result = %v, want hi", messages[2].Content[0])
+	}
+}
+
+func TestSlackReply_Throttled(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		mu.Lock()
+		calls[r.URL.Path] = append(calls[r.URL.Path], r.Form.Get("text"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok": true, "channel": "C1", "ts": "2.0"}`)
+	}))
+	defer server.Close()
+	defer func(interval time.Duration) { streamUpdateInterval = interval }(streamUpdateInterval)
+	streamUpdateInterval = time.Hour
+
+	api := slack.New("token", slack.OptionAPIURL(server.URL+"/"))
+	reply := newSlackReply(api, "C1", "1.0", "req", true)
+	onText := textStreamFromContext(reply.Context(context.Background()))
+	if onText == nil {
+		t.Fatal("Context() did not attach a text stream")
+	}
+	onText("a")
+	onText("b")
+	reply.Finish("ab done", "hmm")
+
+	if got := calls["/chat.postMessage"]; len(got) != 1 || got[0] != streamPlaceholder {
+		t.Errorf("chat.postMessage calls = %q, want the placeholder once", got)
+	}
+	if got := calls["/chat.update"]; len(got) != 1 || got[0] != "ab done" {
+		t.Errorf("chat.update calls = %q, want only the final message", got)
+	}
+}
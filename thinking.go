@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+// redactedThinkingNote stands in for redacted_thinking blocks, their content
+// is encrypted.
+const redactedThinkingNote = "_(part of the reasoning was redacted)_"
+
+// thinkingContextMaxChars keeps the reasoning under slack's 3000 character
+// limit for context block text.
+const thinkingContextMaxChars = 2_900
+
+// thinkingVisibility is how extended thinking is shown in slack.
+type thinkingVisibility string
+
+const (
+	// thinkingHidden never shows thinking.
+	thinkingHidden thinkingVisibility = "hidden"
+	// thinkingContext posts thinking as a small context block under the
+	// reply.
+	thinkingContext thinkingVisibility = "context"
+)
+
+// thinkingVisibilityFromEnv reads THINKING_VISIBILITY, thinking is hidden
+// unless it is set to "context".
+func thinkingVisibilityFromEnv() thinkingVisibility {
+	switch v := thinkingVisibility(os.Getenv("THINKING_VISIBILITY")); v {
+	case "", thinkingHidden:
+		return thinkingHidden
+	case thinkingContext:
+		return v
+	default:
+		log.WithFields(log.Fields{"value": v}).Warn("unknown THINKING_VISIBILITY, thinking is hidden")
+		return thinkingHidden
+	}
+}
+
+// thinkingBlocks renders thinking as a context block, cut to fit.
+func thinkingBlocks(thinking string) []slack.Block {
+	text := renderSlackText(thinking)
+	if len(text) > thinkingContextMaxChars {
+		text = truncateText(text, thinkingContextMaxChars) + " ..."
+	}
+	return []slack.Block{
+		slack.NewContextBlock("",
+			slack.NewTextBlockObject(slack.MarkdownType, ":thought_balloon: "+text, false, false),
+		),
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+	"github.com/slack-go/slack"
+)
+
+func TestLLM_PromptThinking(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude", "content": [
+			{"type": "thinking", "thinking": "the user wants a greeting", "signature": "sig_1"},
+			{"type": "redacted_thinking", "data": "encrypted"},
+			{"type": "text", "text": "let me check"},
+			{"type": "tool_use", "id": "toolu_1", "name": "echo", "input": {"text": "hi"}}
+		], "stop_reason": "tool_use", "usage": {"input_tokens": 1, "output_tokens": 1}}`)
+	}))
+	defer server.Close()
+
+	llm := NewLLM(
+		anthropic.NewClient(option.WithBaseURL(server.URL), option.WithAPIKey("test")),
+		NewAnthropicMessageHandler([]ToolHandler{
+			CreateToolHandler("echo", "Echo the text back", func(input struct {
+				Text string `json:"text"`
+			}) (*string, error) {
+				return &input.Text, nil
+			}),
+		}),
+	)
+	store := NewSlackMessageStore(llm)
+	resp, err := store.CallLLM(context.Background(), "test", "say hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(resp.Message, "greeting") {
+		t.Errorf("CallLLM() Message = %q, want it without the thinking", resp.Message)
+	}
+	if want := "the user wants a greeting\n\n" + redactedThinkingNote; resp.Thinking != want {
+		t.Errorf("CallLLM() Thinking = %q, want %q", resp.Thinking, want)
+	}
+
+	messages := store.GetMessages()["test"]
+	if len(messages) != 3 {
+		t.Fatalf("stored %d messages, want the prompt, the turn and the tool results", len(messages))
+	}
+	turn := messages[1].Content
+	if turn[0].OfThinking == nil || turn[0].OfThinking.Thinking != "the user wants a greeting" || turn[0].OfThinking.Signature != "sig_1" {
+		t.Errorf("stored block 0 = %+v, want the signed thinking", turn[0])
+	}
+	if turn[1].OfRedactedThinking == nil || turn[1].OfRedactedThinking.Data != "encrypted" {
+		t.Errorf("stored block 1 = %+v, want the redacted thinking", turn[1])
+	}
+	if messages[2].Role != anthropic.MessageParamRoleUser {
+		t.Errorf("last stored message is from %s, want the user's tool results", messages[2].Role)
+	}
+}
+
+func TestSlackReply_FinishThinking(t *testing.T) {
+	tests := []struct {
+		name       string
+		visibility thinkingVisibility
+		wantPosts  int
+	}{
+		{name: "hidden", visibility: thinkingHidden, wantPosts: 1},
+		{name: "context", visibility: thinkingContext, wantPosts: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var posts []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				posts = append(posts, r.Form.Get("blocks"))
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"ok": true, "channel": "C1", "ts": "2.0"}`)
+			}))
+			defer server.Close()
+
+			reply := newSlackReply(slack.New("token", slack.OptionAPIURL(server.URL+"/")), "C1", "1.0", "req", false)
+			reply.thinking = tt.visibility
+			reply.Finish("hello", "the user wants a **greeting**")
+
+			if len(posts) != tt.wantPosts {
+				t.Fatalf("posted %d messages, want %d", len(posts), tt.wantPosts)
+			}
+			if tt.wantPosts == 2 && (!strings.Contains(posts[1], `"type":"context"`) || !strings.Contains(posts[1], "*greeting*")) {
+				t.Errorf("reasoning blocks = %s, want a context block with slack formatting", posts[1])
+			}
+		})
+	}
+}
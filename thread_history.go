@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/pkg/errors"
+	"github.com/slack-go/slack"
+)
+
+// threadHistoryHeader starts the user turn that carries a thread's earlier
+// messages.
+const threadHistoryHeader = "Earlier messages in this Slack thread, oldest first. They were written before you were mentioned:"
+
+// threadHistoryMaxMessages caps how many of a thread's most recent messages
+// are kept while paging through conversations.replies.
+const threadHistoryMaxMessages = 2000
+
+var slackMentionPattern = regexp.MustCompile(`<@([A-Z0-9]+)(?:\|[^>]*)?>`)
+
+// threadHydrator gives the agent the messages of a Slack thread that were
+// written before it was first mentioned there. Only the most recent messages
+// that fit in maxChars are kept.
+type threadHydrator struct {
+	api         *slack.Client
+	maxChars    int
+	maxMessages int
+
+	mu        sync.Mutex
+	names     map[string]string
+	botUserID string
+}
+
+func newThreadHydrator(api *slack.Client) *threadHydrator {
+	return &threadHydrator{
+		api:         api,
+		maxChars:    envInt("THREAD_HISTORY_MAX_CHARS", 20_000),
+		maxMessages: threadHistoryMaxMessages,
+		names:       make(map[string]string),
+	}
+}
+
+// Hydrate stores the messages of the thread before beforeTS as one user turn,
+// unless the store already has the conversation or there are none.
+func (h *threadHydrator) Hydrate(ctx context.Context, store MessageStore, conversationID string, channel string, threadTS string, beforeTS string) error {
+	seen, err := store.HasConversation(conversationID)
+	if err != nil {
+		return err
+	}
+	if seen {
+		return nil
+	}
+	replies, dropped, err := h.replies(ctx, channel, threadTS, beforeTS)
+	if err != nil {
+		return err
+	}
+	message, ok := h.message(ctx, replies, dropped)
+	if !ok {
+		return nil
+	}
+	return store.AppendMessages(conversationID, []anthropic.MessageParam{message})
+}
+
+// replies returns the newest maxMessages messages of the thread before
+// beforeTS, oldest first, and how many older ones were dropped. Slack pages
+// oldest first, so the whole thread is read.
+func (h *threadHydrator) replies(ctx context.Context, channel string, threadTS string, beforeTS string) (replies []slack.Message, dropped int, err error) {
+	cursor := ""
+	for {
+		msgs, hasMore, next, err := h.api.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+			ChannelID: channel,
+			Timestamp: threadTS,
+			Cursor:    cursor,
+			Latest:    beforeTS,
+			Limit:     200,
+		})
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "couldn't get thread replies")
+		}
+		for _, msg := range msgs {
+			if msg.Timestamp < beforeTS {
+				replies = append(replies, msg)
+			}
+		}
+		if len(replies) > h.maxMessages {
+			dropped += len(replies) - h.maxMessages
+			replies = append([]slack.Message{}, replies[len(replies)-h.maxMessages:]...)
+		}
+		if !hasMore || next == "" {
+			return replies, dropped, nil
+		}
+		cursor = next
+	}
+}
+
+// message turns replies into a user message with one text block per Slack
+// message, prefixed by who wrote it. dropped older messages are counted as
+// left out. ok is false if there is nothing to add.
+func (h *threadHydrator) message(ctx context.Context, replies []slack.Message, dropped int) (message anthropic.MessageParam, ok bool) {
+	lines := []string{}
+	size := 0
+	left := dropped
+	for i := len(replies) - 1; i >= 0; i-- {
+		text := strings.TrimSpace(replies[i].Text)
+		if text == "" {
+			continue
+		}
+		line := fmt.Sprintf("%s: %s", h.author(ctx, replies[i]), h.resolveMentions(ctx, text))
+		if size+len(line) > h.maxChars {
+			left += i + 1
+			break
+		}
+		size += len(line)
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return message, false
+	}
+	header := threadHistoryHeader
+	if left > 0 {
+		header += fmt.Sprintf("\n(%d earlier messages were left out)", left)
+	}
+	blocks := []anthropic.ContentBlockParamUnion{anthropic.NewTextBlock(header)}
+	for i := len(lines) - 1; i >= 0; i-- {
+		blocks = append(blocks, anthropic.NewTextBlock(lines[i]))
+	}
+	return anthropic.NewUserMessage(blocks...), true
+}
+
+// author names who wrote msg. The bot's own messages are labelled as such so
+// the model can tell them apart.
+func (h *threadHydrator) author(ctx context.Context, msg slack.Message) string {
+	if msg.User != "" && msg.User == h.selfID(ctx) {
+		return "You (earlier)"
+	}
+	if msg.User != "" {
+		return h.displayName(ctx, msg.User)
+	}
+	if msg.BotProfile != nil && msg.BotProfile.Name != "" {
+		return msg.BotProfile.Name + " (bot)"
+	}
+	if msg.Username != "" {
+		return msg.Username + " (bot)"
+	}
+	return "unknown"
+}
+
+func (h *threadHydrator) selfID(ctx context.Context) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.botUserID == "" {
+		if auth, err := h.api.AuthTestContext(ctx); err == nil {
+			h.botUserID = auth.UserID
+		}
+	}
+	return h.botUserID
+}
+
+// displayName looks up a user's display name, falling back to the real name,
+// the username and the ID. Names are cached for the life of the process.
+func (h *threadHydrator) displayName(ctx context.Context, userID string) string {
+	h.mu.Lock()
+	name, ok := h.names[userID]
+	h.mu.Unlock()
+	if ok {
+		return name
+	}
+	name = userID
+	if user, err := h.api.GetUserInfoContext(ctx, userID); err == nil {
+		for _, n := range []string{user.Profile.DisplayName, user.RealName, user.Name} {
+			if n != "" {
+				name = n
+				break
+			}
+		}
+	} else {
+		// not cached so the lookup is tried again next time
+		return name
+	}
+	h.mu.Lock()
+	h.names[userID] = name
+	h.mu.Unlock()
+	return name
+}
+
+// resolveMentions replaces <@U123> with @name.
+func (h *threadHydrator) resolveMentions(ctx context.Context, text string) string {
+	return slackMentionPattern.ReplaceAllStringFunc(text, func(mention string) string {
+		userID := slackMentionPattern.FindStringSubmatch(mention)[1]
+		if userID == h.selfID(ctx) {
+			return "@you"
+		}
+		return "@" + h.displayName(ctx, userID)
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+// fakeSlackThread serves conversations.replies in pages of two, users.info
+// and auth.test.
+func fakeSlackThread(t *testing.T, replies []map[string]interface{}) *httptest.Server {
+	users := map[string]map[string]interface{}{
+		"UALICE": {"id": "UALICE", "name": "alice", "real_name": "Alice Real", "profile": map[string]interface{}{"display_name": "alice"}},
+		"UBOB":   {"id": "UBOB", "name": "bob", "real_name": "Bob Jones", "profile": map[string]interface{}{}},
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		response := map[string]interface{}{"ok": true}
+		switch r.URL.Path {
+		case "/auth.test":
+			response["user_id"] = "UBOT"
+		case "/users.info":
+			user, ok := users[r.Form.Get("user")]
+			if !ok {
+				response = map[string]interface{}{"ok": false, "error": "user_not_found"}
+				break
+			}
+			response["user"] = user
+		case "/conversations.replies":
+			start, _ := strconv.Atoi(r.Form.Get("cursor"))
+			end := start + 2
+			if end >= len(replies) {
+				end = len(replies)
+			} else {
+				response["has_more"] = true
+				response["response_metadata"] = map[string]string{"next_cursor": strconv.Itoa(end)}
+			}
+			response["messages"] = replies[start:end]
+		default:
+			t.Errorf("unexpected call to %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+}
+
+func Test_threadHydrator_Hydrate(t *testing.T) {
+	replies := []map[string]interface{}{
+		{"ts": "1000.000001", "user": "UALICE", "text": "the nightly import failed again"},
+		{"ts": "1000.000002", "user": "UBOB", "text": "<@UALICE> same error as last week?"},
+		{"ts": "1000.000003", "bot_id": "B1", "username": "deploybot", "text": "deploy 42 finished"},
+		{"ts": "1000.000004", "user": "UBOT", "text": "I looked at this yesterday"},
+		{"ts": "1000.000005", "user": "UALICE", "text": "<@UBOT> can you check the logs?"},
+	}
+	server := fakeSlackThread(t, replies)
+	defer server.Close()
+	api := slack.New("token", slack.OptionAPIURL(server.URL+"/"))
+
+	tests := []struct {
+		name        string
+		maxChars    int
+		maxMessages int
+		seen        bool
+		want        []string
+	}{
+		{
+			name:     "whole thread",
+			maxChars: 10_000,
+			want: []string{
+				threadHistoryHeader,
+				"alice: the nightly import failed again",
+				"Bob Jones: @alice same error as last week?",
+				"deploybot (bot): deploy 42 finished",
+				"You (earlier): I looked at this yesterday",
+			},
+		},
+		{
+			name:     "capped",
+			maxChars: 80,
+			want: []string{
+				threadHistoryHeader + "\n(2 earlier messages were left out)",
+				"deploybot (bot): deploy 42 finished",
+				"You (earlier): I looked at this yesterday",
+			},
+		},
+		{
+			name:        "newest messages",
+			maxChars:    10_000,
+			maxMessages: 3,
+			want: []string{
+				threadHistoryHeader + "\n(1 earlier messages were left out)",
+				"Bob Jones: @alice same error as last week?",
+				"deploybot (bot): deploy 42 finished",
+				"You (earlier): I looked at this yesterday",
+			},
+		},
+		{
+			name:     "already seen",
+			maxChars: 10_000,
+			seen:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewSlackMessageStore(&mockLLM{})
+			if tt.seen {
+				store.AppendMessages("1000.000001", toolTurn(0, 10))
+			}
+			hydrator := newThreadHydrator(api)
+			hydrator.maxChars = tt.maxChars
+			if tt.maxMessages > 0 {
+				hydrator.maxMessages = tt.maxMessages
+			}
+			// the mention itself is left out, CallLLM adds it
+			err := hydrator.Hydrate(context.Background(), store, "1000.000001", "C1", "1000.000001", "1000.000005")
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages := store.GetMessages()["1000.000001"]
+			if tt.seen {
+				if len(messages) != 4 {
+					t.Errorf("Hydrate() changed a conversation that was already stored")
+				}
+				return
+			}
+			if len(messages) != 1 {
+				t.Fatalf("Hydrate() stored %d messages, want 1", len(messages))
+			}
+			got := []string{}
+			for _, block := range messages[0].Content {
+				got = append(got, block.OfText.Text)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Hydrate() stored\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// keyedMutex is a set of mutexes keyed by string, entries are removed once
+// nobody holds or waits on them.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock locks key and returns the function that unlocks it.
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedMutexEntry)
+	}
+	entry, ok := k.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		k.locks[key] = entry
+	}
+	entry.refs++
+	k.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+		k.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// threadQueue runs at most one agent turn per thread. Messages that arrive
+// while a turn is in flight are queued and folded into the next turn.
+type threadQueue struct {
+	mu sync.Mutex
+	// pending has an entry for every thread with a turn in flight.
+	pending map[string][]queuedTurn
+}
+
+// queuedTurn is a message waiting for its thread, run answers it as the user
+// who sent it.
+type queuedTurn struct {
+	user string
+	text string
+	run  func(text string)
+}
+
+func newThreadQueue() *threadQueue {
+	return &threadQueue{
+		pending: make(map[string][]queuedTurn),
+	}
+}
+
+// Submit calls run with text, or queues text if the thread is busy. The
+// goroutine running the thread's turn keeps going until the queue is empty.
+// Each turn takes the messages at the front of the queue that were sent by
+// the same user, joins them and calls the run of the first one, so every
+// turn runs as the user who wrote it. Empty text resumes the conversation,
+// it is dropped when folded with other messages.
+func (q *threadQueue) Submit(thread string, user string, text string, run func(text string)) {
+	q.mu.Lock()
+	if queued, busy := q.pending[thread]; busy {
+		q.pending[thread] = append(queued, queuedTurn{user: user, text: text, run: run})
+		q.mu.Unlock()
+		return
+	}
+	q.pending[thread] = []queuedTurn{}
+	q.mu.Unlock()
+
+	for {
+		run(text)
+
+		q.mu.Lock()
+		queued := q.pending[thread]
+		if len(queued) == 0 {
+			delete(q.pending, thread)
+			q.mu.Unlock()
+			return
+		}
+		next := queued[0]
+		texts := []string{}
+		n := 0
+		for ; n < len(queued) && queued[n].user == next.user; n++ {
+			if queued[n].text != "" {
+				texts = append(texts, queued[n].text)
+			}
+		}
+		q.pending[thread] = queued[n:]
+		q.mu.Unlock()
+		run, text = next.run, strings.Join(texts, "\n\n")
+	}
+}
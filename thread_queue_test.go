@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Run with -race, CallLLM and Loop hammer the same conversations and every
+// tool_use must still be followed directly by its tool_result.
+func TestMessageStore_ConcurrentTurns(t *testing.T) {
+	conversations := []string{"race-1", "race-2", "race-3"}
+	var inFlight sync.Map
+	var calls atomic.Int64
+	llm := &mockLLM{fn: func(ctx context.Context, messages []anthropic.MessageParam, messageStore MessageStore, conversationID string) (*LLMResponse, error) {
+		counter, _ := inFlight.LoadOrStore(conversationID, new(atomic.Int32))
+		if counter.(*atomic.Int32).Add(1) > 1 {
+			t.Errorf("concurrent turns for %s", conversationID)
+		}
+		defer counter.(*atomic.Int32).Add(-1)
+
+		id := fmt.Sprintf("toolu_%d", calls.Add(1))
+		err := messageStore.AppendMessages(conversationID, []anthropic.MessageParam{
+			anthropic.NewAssistantMessage(anthropic.NewToolUseBlock(id, json.RawMessage(`{}`), "echo")),
+			anthropic.NewUserMessage(anthropic.NewToolResultBlock(id, "ok", false)),
+		})
+		return &LLMResponse{Message: id, Loop: true}, err
+	}}
+
+	for storeName, store := range newTestMessageStores(t, nil, llm, conversations...) {
+		t.Run(storeName, func(t *testing.T) {
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				for _, conversationID := range conversations {
+					wg.Add(2)
+					go func() {
+						defer wg.Done()
+						if _, err := store.CallLLM(context.Background(), conversationID, "hello"); err != nil {
+							t.Error(err)
+						}
+					}()
+					go func() {
+						defer wg.Done()
+						if _, err := store.Loop(context.Background(), conversationID, nil, "req"); err != nil {
+							t.Error(err)
+						}
+						store.GetMessages()
+					}()
+				}
+			}
+			wg.Wait()
+
+			for _, conversationID := range conversations {
+				messages := store.GetMessages()[conversationID]
+				// 20 user messages plus a tool_use and tool_result pair per call
+				if len(messages) != 20*5 {
+					t.Errorf("%s has %d messages, want %d", conversationID, len(messages), 20*5)
+				}
+				for i, message := range messages {
+					toolUse := message.Content[0].OfToolUse
+					if toolUse == nil {
+						continue
+					}
+					if i+1 >= len(messages) || messages[i+1].Content[0].OfToolResult == nil || messages[i+1].Content[0].OfToolResult.ToolUseID != toolUse.ID {
+						t.Errorf("%s: tool_use %s at %d is not followed by its tool_result", conversationID, toolUse.ID, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestThreadQueue_Submit(t *testing.T) {
+	q := newThreadQueue()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var runs []string
+	done := make(chan struct{})
+	runAs := func(user string) func(text string) {
+		return func(text string) { runs = append(runs, user+":"+text) }
+	}
+
+	go func() {
+		q.Submit("thread", "A", "first", func(text string) {
+			runs = append(runs, "A:"+text)
+			close(started)
+			<-release
+		})
+		close(done)
+	}()
+	<-started
+	q.Submit("thread", "A", "second", runAs("A"))
+	q.Submit("thread", "A", "third", runAs("A"))
+	q.Submit("thread", "B", "fourth", runAs("B"))
+	q.Submit("thread", "A", "fifth", runAs("A"))
+	close(release)
+	<-done
+
+	want := []string{"A:first", "A:second\n\nthird", "B:fourth", "A:fifth"}
+	if fmt.Sprintf("%q", runs) != fmt.Sprintf("%q", want) {
+		t.Errorf("Submit() ran %q, want %q", runs, want)
+	}
+	if _, busy := q.pending["thread"]; busy {
+		t.Errorf("thread is still marked busy")
+	}
+}
+
+func TestThreadQueue_SubmitResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued []string
+		want   []string
+	}{
+		{name: "resume alone", queued: []string{""}, want: []string{"first", ""}},
+		{name: "resume and message", queued: []string{"", "second"}, want: []string{"first", "second"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newThreadQueue()
+			started := make(chan struct{})
+			release := make(chan struct{})
+			var runs []string
+			done := make(chan struct{})
+			run := func(text string) { runs = append(runs, text) }
+
+			go func() {
+				q.Submit("thread", "A", "first", func(text string) {
+					runs = append(runs, text)
+					close(started)
+					<-release
+				})
+				close(done)
+			}()
+			<-started
+			for _, text := range tt.queued {
+				q.Submit("thread", "A", text, run)
+			}
+			close(release)
+			<-done
+
+			if fmt.Sprintf("%q", runs) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("Submit() ran %q, want %q", runs, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/getsentry/sentry-go"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/slack-go/slack"
+)
+
+const (
+	approveToolActionID = "tool_approval_approve"
+	rejectToolActionID  = "tool_approval_reject"
+)
+
+// approvalInputMaxChars keeps a call's input under slack's 3000 character
+// limit for section text.
+const approvalInputMaxChars = 2_500
+
+type approvalStatus string
+
+const (
+	approvalPending  approvalStatus = "pending"
+	approvalApproved approvalStatus = "approved"
+	approvalRejected approvalStatus = "rejected"
+	// approvalExpired is set when the conversation went on, or the card
+	// couldn't be posted, before anyone decided.
+	approvalExpired approvalStatus = "expired"
+)
+
+// toolApproval is a turn paused until someone approves its tool calls. The
+// turn's tool_use blocks are stored in the conversation, their tool_result
+// blocks are added once the approval is decided.
+type toolApproval struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	Channel        string `json:"channel"`
+	Thread         string `json:"thread"`
+	// RequestedBy is the user whose message the paused turn was answering.
+	RequestedBy string `json:"requested_by,omitempty"`
+	// Calls are all the tool calls of the turn, Pending are the ids of the
+	// ones that need approval. The others run when the approval is decided
+	// either way.
+	Calls     []toolCall     `json:"calls"`
+	Pending   []string       `json:"pending"`
+	Status    approvalStatus `json:"status"`
+	MessageTS string         `json:"message_ts,omitempty"`
+	DecidedBy string         `json:"decided_by,omitempty"`
+}
+
+func (a toolApproval) needsApproval(toolUseID string) bool {
+	for _, id := range a.Pending {
+		if id == toolUseID {
+			return true
+		}
+	}
+	return false
+}
+
+// approvalPolicy reports whether a call to a tool with input needs approval.
+type approvalPolicy func(input json.RawMessage) bool
+
+func alwaysApprove(input json.RawMessage) bool { return true }
+
+// toolApprovals pauses turns that call sensitive tools until an approver
+// clicks Approve or Reject on the card posted in the thread.
+type toolApprovals struct {
+	store        approvalStore
+	api          *slack.Client
+	handler      *AnthropicMessageHandler
+	messageStore MessageStore
+	// personas narrow the tools decided calls may use, like they did for
+	// the paused turn.
+	personas personaStore
+	// policies has an entry for every tool that may need approval.
+	policies map[string]approvalPolicy
+	// approvers may decide. When it is empty workspace admins and owners
+	// may.
+	approvers map[string]bool
+	// resume carries on with the conversation after a decision.
+	resume func(ctx context.Context, approval toolApproval, teamID string)
+	// conversations is held while a conversation's tool results are added.
+	conversations keyedMutex
+}
+
+// newToolApprovals reads TOOL_APPROVAL, a comma separated list of tools whose
+// calls always need approval, and TOOL_APPROVERS, the user ids that may
+// decide. More policies can be added with Require.
+func newToolApprovals(store approvalStore, api *slack.Client, handler *AnthropicMessageHandler, messageStore MessageStore, personas personaStore) *toolApprovals {
+	a := &toolApprovals{
+		store:        store,
+		api:          api,
+		handler:      handler,
+		messageStore: messageStore,
+		personas:     personas,
+		policies:     map[string]approvalPolicy{},
+		approvers:    map[string]bool{},
+		resume:       func(ctx context.Context, approval toolApproval, teamID string) {},
+	}
+	for _, name := range strings.Split(os.Getenv("TOOL_APPROVAL"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			a.Require(name, alwaysApprove)
+		}
+	}
+	for _, id := range strings.Split(os.Getenv("TOOL_APPROVERS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			a.approvers[id] = true
+		}
+	}
+	return a
+}
+
+// Require makes calls to the tool need approval when policy says so. A tool
+// listed in TOOL_APPROVAL keeps needing approval for every call.
+func (a *toolApprovals) Require(tool string, policy approvalPolicy) {
+	if existing, ok := a.policies[tool]; ok {
+		a.policies[tool] = func(input json.RawMessage) bool { return existing(input) || policy(input) }
+		return
+	}
+	a.policies[tool] = policy
+}
+
+// pending returns the ids of the calls that need approval.
+func (a *toolApprovals) pending(ctx context.Context, calls []toolCall) []string {
+	ids := []string{}
+	for _, call := range calls {
+		// calls to tools that aren't allowed fail when they run, there is
+		// nothing to approve
+		if !toolAllowed(ctx, call.Name) {
+			continue
+		}
+		if policy, ok := a.policies[call.Name]; ok && policy(call.Input) {
+			ids = append(ids, call.ID)
+		}
+	}
+	return ids
+}
+
+type toolApprovalsKey struct{}
+
+// withToolApprovals makes turns in ctx ask a for approval before calling
+// sensitive tools. Without it every tool call runs right away.
+func withToolApprovals(ctx context.Context, a *toolApprovals) context.Context {
+	if a == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, toolApprovalsKey{}, a)
+}
+
+func toolApprovalsFromContext(ctx context.Context) *toolApprovals {
+	a, _ := ctx.Value(toolApprovalsKey{}).(*toolApprovals)
+	return a
+}
+
+// Request pauses the turn: turn is stored without tool results and a card
+// asking for approval is posted in the conversation's thread.
+func (a *toolApprovals) Request(ctx context.Context, conversationID string, turn anthropic.MessageParam, calls []toolCall) error {
+	approval := toolApproval{
+		ID:             uuid.New().String(),
+		ConversationID: conversationID,
+		Channel:        channelFromContext(ctx),
+		Thread:         threadFromContext(ctx),
+		RequestedBy:    userFromContext(ctx),
+		Calls:          calls,
+		Pending:        a.pending(ctx, calls),
+		Status:         approvalPending,
+	}
+	unlock := a.conversations.Lock(conversationID)
+	defer unlock()
+	if err := a.messageStore.AppendMessages(conversationID, []anthropic.MessageParam{turn}); err != nil {
+		return errors.Wrap(err, "couldn't store messages")
+	}
+	if err := a.store.Create(ctx, approval); err != nil {
+		return a.abandon(ctx, approval, errors.Wrap(err, "couldn't save approval"))
+	}
+
+	options := []slack.MsgOption{
+		slack.MsgOptionText("a tool call is waiting for approval", false),
+		slack.MsgOptionBlocks(approvalBlocks(approval)...),
+	}
+	if approval.Thread != "" {
+		options = append(options, slack.MsgOptionTS(approval.Thread))
+	}
+	_, ts, err := a.api.PostMessageContext(ctx, approval.Channel, options...)
+	if err != nil {
+		a.store.Decide(ctx, approval.ID, approvalExpired, "")
+		return a.abandon(ctx, approval, errors.Wrap(err, "couldn't post approval card"))
+	}
+	if err := a.store.SetMessage(ctx, approval.ID, ts); err != nil {
+		log.WithFields(log.Fields{"reqID": reqIDFromContext(ctx), "approval": approval.ID, "error": err}).Error("failed to save approval card")
+	}
+	return nil
+}
+
+// abandon answers every call of an approval that can't go ahead with an
+// error, so the stored conversation stays valid, and returns cause.
+func (a *toolApprovals) abandon(ctx context.Context, approval toolApproval, cause error) error {
+	results := []anthropic.ContentBlockParamUnion{}
+	for _, call := range approval.Calls {
+		result, _ := toolOutcome{err: errors.New("the tool call couldn't be sent for approval")}.toolResult(call.ID)
+		results = append(results, result)
+	}
+	if err := a.messageStore.AppendMessages(approval.ConversationID, []anthropic.MessageParam{anthropic.NewUserMessage(results...)}); err != nil {
+		log.WithFields(log.Fields{"reqID": reqIDFromContext(ctx), "approval": approval.ID, "error": err}).Error("failed to store tool results")
+	}
+	return cause
+}
+
+// Decide records userID's decision. If the approval was still pending the
+// calls are answered and the conversation resumes. The returned text tells
+// the user why nothing happened, it is empty when the decision was taken.
+func (a *toolApprovals) Decide(ctx context.Context, id string, approve bool, userID string, teamID string) (string, error) {
+	if len(a.approvers) > 0 && !a.approvers[userID] {
+		return "only tool approvers can decide on tool calls", nil
+	}
+	if len(a.approvers) == 0 {
+		admin, err := workspaceAdmin(ctx, a.api, userID)
+		if err != nil {
+			return "", err
+		}
+		if !admin {
+			return "only workspace admins can decide on tool calls", nil
+		}
+	}
+
+	approval, err := a.store.Get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if approval == nil {
+		return "this tool call doesn't exist anymore", nil
+	}
+	status := approvalRejected
+	if approve {
+		status = approvalApproved
+	}
+	decided, err := a.finish(ctx, approval, status, userID, teamID)
+	if err != nil {
+		return "", err
+	}
+	if !decided {
+		return fmt.Sprintf("this tool call was already %s", approval.Status), nil
+	}
+	a.resume(ctx, *approval, teamID)
+	return "", nil
+}
+
+// Register sends clicks on the approval card's buttons to HandleAction.
+func (a *toolApprovals) Register(r *interactionRouter) {
+	r.OnBlockAction(approveToolActionID, a.HandleAction)
+	r.OnBlockAction(rejectToolActionID, a.HandleAction)
+}
+
+// HandleAction decides on the approval of the clicked card. When the click
+// changes nothing the user is told why in a message only they see.
+func (a *toolApprovals) HandleAction(ctx context.Context, callback slack.InteractionCallback, action *slack.BlockAction) {
+	msg, err := a.Decide(ctx, action.Value, action.ActionID == approveToolActionID, callback.User.ID, callback.Team.ID)
+	if err != nil {
+		sentry.CaptureException(err)
+		log.WithFields(log.Fields{"reqID": reqIDFromContext(ctx), "approval": action.Value, "error": err, "stack": fmt.Sprintf("%+v", err)}).Error("Failed to decide tool approval")
+		msg = "something went wrong, the tool call wasn't decided"
+	}
+	if msg != "" {
+		postEphemeralReply(ctx, a.api, callback, msg)
+	}
+}
+
+// Supersede expires the conversation's pending approval, if it has one. It
+// is called before a new message is added, a reply in the thread moves on
+// from the paused turn.
+func (a *toolApprovals) Supersede(ctx context.Context, conversationID string, teamID string) error {
+	approval, err := a.store.Pending(ctx, conversationID)
+	if err != nil || approval == nil {
+		return err
+	}
+	_, err = a.finish(ctx, approval, approvalExpired, "", teamID)
+	return err
+}
+
+// turnContext is the context the paused turn's tools ran with: its
+// conversation, the persona's allowed tools and the user it answered.
+func (a *toolApprovals) turnContext(ctx context.Context, approval toolApproval, teamID string) context.Context {
+	if reqIDFromContext(ctx) == "" {
+		ctx = withReqID(ctx, uuid.New().String())
+	}
+	ctx = withChannel(withConversationID(ctx, approval.ConversationID), approval.Channel)
+	ctx = withThread(ctx, approval.Thread)
+	ctx = withUser(ctx, approval.RequestedBy)
+	return withPersona(ctx, resolvePersona(ctx, a.personas, approval.Channel, teamID))
+}
+
+// finish moves a pending approval to status, answers its calls and updates
+// the card. It reports false if the approval had already been decided.
+func (a *toolApprovals) finish(ctx context.Context, approval *toolApproval, status approvalStatus, userID string, teamID string) (bool, error) {
+	unlock := a.conversations.Lock(approval.ConversationID)
+	defer unlock()
+	decided, err := a.store.Decide(ctx, approval.ID, status, userID)
+	if err != nil || !decided {
+		if current, _ := a.store.Get(ctx, approval.ID); current != nil {
+			approval.Status = current.Status
+		}
+		return false, err
+	}
+	approval.Status, approval.DecidedBy = status, userID
+
+	ctx = a.turnContext(ctx, *approval, teamID)
+	run := []toolCall{}
+	for _, call := range approval.Calls {
+		if status == approvalApproved || !approval.needsApproval(call.ID) {
+			run = append(run, call)
+		}
+	}
+	outcomes := a.handler.callTools(ctx, run)
+	results := []anthropic.ContentBlockParamUnion{}
+	for _, call := range approval.Calls {
+		outcome := toolOutcome{err: errors.New(approvalRefusal(status))}
+		for i, ran := range run {
+			if ran.ID == call.ID {
+				outcome = outcomes[i]
+			}
+		}
+		result, _ := outcome.toolResult(call.ID)
+		results = append(results, result)
+	}
+	if err := a.messageStore.AppendMessages(approval.ConversationID, []anthropic.MessageParam{anthropic.NewUserMessage(results...)}); err != nil {
+		return true, errors.Wrap(err, "couldn't store tool results")
+	}
+
+	if approval.MessageTS != "" {
+		_, _, _, err := a.api.UpdateMessageContext(ctx, approval.Channel, approval.MessageTS,
+			slack.MsgOptionText("tool call "+string(status), false),
+			slack.MsgOptionBlocks(approvalBlocks(*approval)...),
+		)
+		if err != nil {
+			log.WithFields(log.Fields{"reqID": reqIDFromContext(ctx), "approval": approval.ID, "error": err}).Error("failed to update approval card")
+		}
+	}
+	return true, nil
+}
+
+// approvalRefusal is the tool result the model sees for a call that didn't
+// run.
+func approvalRefusal(status approvalStatus) string {
+	if status == approvalRejected {
+		return "the tool call was rejected by a reviewer, don't retry it without asking"
+	}
+	return "the tool call wasn't approved before the conversation went on"
+}
+
+// approvalBlocks is the approval card: the calls waiting for approval and
+// buttons while it is pending, who decided once it isn't.
+func approvalBlocks(approval toolApproval) []slack.Block {
+	blocks := []slack.Block{
+		slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, ":lock: the agent wants to run a tool that needs approval", false, false), nil, nil),
+	}
+	for _, call := range approval.Calls {
+		if !approval.needsApproval(call.ID) {
+			continue
+		}
+		input := string(call.Input)
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, call.Input, "", "  "); err == nil {
+			input = pretty.String()
+		}
+		if len(input) > approvalInputMaxChars {
+			input = truncateText(input, approvalInputMaxChars) + "\n..."
+		}
+		text := fmt.Sprintf("*%s*\n```%s```", call.Name, slackEscaper.Replace(input))
+		blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil))
+	}
+
+	var outcome string
+	switch approval.Status {
+	case approvalPending:
+		approve := slack.NewButtonBlockElement(approveToolActionID, approval.ID, slack.NewTextBlockObject(slack.PlainTextType, "Approve", false, false))
+		approve.Style = slack.StylePrimary
+		reject := slack.NewButtonBlockElement(rejectToolActionID, approval.ID, slack.NewTextBlockObject(slack.PlainTextType, "Reject", false, false))
+		reject.Style = slack.StyleDanger
+		return append(blocks, slack.NewActionBlock("tool_approval", approve, reject))
+	case approvalApproved:
+		outcome = ":white_check_mark: approved by <@" + approval.DecidedBy + ">"
+	case approvalRejected:
+		outcome = ":x: rejected by <@" + approval.DecidedBy + ">"
+	default:
+		outcome = ":hourglass: expired, the conversation went on without it"
+	}
+	return append(blocks, slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, outcome, false, false)))
+}
+
+// approvalStore keeps approvals so a paused turn survives restarts.
+type approvalStore interface {
+	Create(ctx context.Context, approval toolApproval) error
+	// Get returns nil when there is no approval with the id.
+	Get(ctx context.Context, id string) (*toolApproval, error)
+	// Pending returns the conversation's pending approval, or nil.
+	Pending(ctx context.Context, conversationID string) (*toolApproval, error)
+	SetMessage(ctx context.Context, id string, ts string) error
+	// Decide moves a pending approval to status, it reports false when the
+	// approval wasn't pending anymore.
+	Decide(ctx context.Context, id string, status approvalStatus, userID string) (bool, error)
+}
+
+// newApprovalStore keeps approvals next to the conversations: in db, or in
+// memory when db is nil.
+func newApprovalStore(db *sql.DB) (approvalStore, error) {
+	if db == nil {
+		return newMemoryApprovalStore(), nil
+	}
+	return newPostgresApprovalStore(db)
+}
+
+var _ approvalStore = &memoryApprovalStore{}
+
+// memoryApprovalStore keeps approvals until the process exits.
+type memoryApprovalStore struct {
+	mu        sync.Mutex
+	approvals map[string]toolApproval
+}
+
+func newMemoryApprovalStore() *memoryApprovalStore {
+	return &memoryApprovalStore{approvals: make(map[string]toolApproval)}
+}
+
+func (s *memoryApprovalStore) Create(ctx context.Context, approval toolApproval) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.approvals[approval.ID] = approval
+	return nil
+}
+
+func (s *memoryApprovalStore) Get(ctx context.Context, id string) (*toolApproval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	approval, ok := s.approvals[id]
+	if !ok {
+		return nil, nil
+	}
+	return &approval, nil
+}
+
+func (s *memoryApprovalStore) Pending(ctx context.Context, conversationID string) (*toolApproval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, approval := range s.approvals {
+		if approval.ConversationID == conversationID && approval.Status == approvalPending {
+			return &approval, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *memoryApprovalStore) SetMessage(ctx context.Context, id string, ts string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if approval, ok := s.approvals[id]; ok {
+		approval.MessageTS = ts
+		s.approvals[id] = approval
+	}
+	return nil
+}
+
+func (s *memoryApprovalStore) Decide(ctx context.Context, id string, status approvalStatus, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	approval, ok := s.approvals[id]
+	if !ok || approval.Status != approvalPending {
+		return false, nil
+	}
+	approval.Status, approval.DecidedBy = status, userID
+	s.approvals[id] = approval
+	return true, nil
+}
+
+const postgresApprovalStoreSchema = `
+CREATE TABLE IF NOT EXISTS agent_tool_approvals (
+    id TEXT PRIMARY KEY,
+    conversation_id TEXT NOT NULL,
+    channel TEXT NOT NULL,
+    thread TEXT NOT NULL DEFAULT '',
+    calls JSONB NOT NULL,
+    pending JSONB NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    message_ts TEXT NOT NULL DEFAULT '',
+    decided_by TEXT NOT NULL DEFAULT '',
+    requested_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    decided_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS agent_tool_approvals_pending ON agent_tool_approvals (conversation_id) WHERE status = 'pending';
+`
+
+var _ approvalStore = &postgresApprovalStore{}
+
+// postgresApprovalStore keeps approvals in the agent_tool_approvals table.
+type postgresApprovalStore struct {
+	db *sql.DB
+}
+
+func newPostgresApprovalStore(db *sql.DB) (*postgresApprovalStore, error) {
+	if _, err := db.Exec(postgresApprovalStoreSchema); err != nil {
+		return nil, errors.Wrap(err, "failed to migrate approval schema")
+	}
+	return &postgresApprovalStore{db: db}, nil
+}
+
+const approvalColumns = `id, conversation_id, channel, thread, calls, pending, status, message_ts, decided_by, requested_by`
+
+func scanApproval(row personaScanner) (*toolApproval, error) {
+	var approval toolApproval
+	var calls, pending []byte
+	err := row.Scan(&approval.ID, &approval.ConversationID, &approval.Channel, &approval.Thread, &calls, &pending, &approval.Status, &approval.MessageTS, &approval.DecidedBy, &approval.RequestedBy)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load approval")
+	}
+	if err := json.Unmarshal(calls, &approval.Calls); err != nil {
+		return nil, errors.Wrapf(err, "invalid calls for approval %s", approval.ID)
+	}
+	if err := json.Unmarshal(pending, &approval.Pending); err != nil {
+		return nil, errors.Wrapf(err, "invalid pending calls for approval %s", approval.ID)
+	}
+	return &approval, nil
+}
+
+func (s *postgresApprovalStore) Create(ctx context.Context, approval toolApproval) error {
+	calls, err := json.Marshal(approval.Calls)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode calls")
+	}
+	pending, err := json.Marshal(approval.Pending)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode pending calls")
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO agent_tool_approvals (`+approvalColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		approval.ID, approval.ConversationID, approval.Channel, approval.Thread, string(calls), string(pending), approval.Status, approval.MessageTS, approval.DecidedBy, approval.RequestedBy)
+	return errors.Wrap(err, "failed to save approval")
+}
+
+func (s *postgresApprovalStore) Get(ctx context.Context, id string) (*toolApproval, error) {
+	return scanApproval(s.db.QueryRowContext(ctx, `SELECT `+approvalColumns+` FROM agent_tool_approvals WHERE id = $1`, id))
+}
+
+func (s *postgresApprovalStore) Pending(ctx context.Context, conversationID string) (*toolApproval, error) {
+	return scanApproval(s.db.QueryRowContext(ctx, `SELECT `+approvalColumns+` FROM agent_tool_approvals WHERE conversation_id = $1 AND status = 'pending' ORDER BY created_at DESC LIMIT 1`, conversationID))
+}
+
+func (s *postgresApprovalStore) SetMessage(ctx context.Context, id string, ts string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE agent_tool_approvals SET message_ts = $2 WHERE id = $1`, id, ts)
+	return errors.Wrap(err, "failed to save approval card")
+}
+
+func (s *postgresApprovalStore) Decide(ctx context.Context, id string, status approvalStatus, userID string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+UPDATE agent_tool_approvals SET status = $2, decided_by = $3, decided_at = CURRENT_TIMESTAMP
+WHERE id = $1 AND status = 'pending'`, id, status, userID)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to decide approval")
+	}
+	n, err := result.RowsAffected()
+	return n == 1, errors.Wrap(err, "failed to decide approval")
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/google/go-cmp/cmp"
+	"github.com/slack-go/slack"
+)
+
+// fakeSlackCards records the messages and updates posted to slack.
+type fakeSlackCards struct {
+	mu      sync.Mutex
+	posts   []string
+	updates []string
+}
+
+func (f *fakeSlackCards) server(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch r.URL.Path {
+		case "/chat.postMessage", "/chat.postEphemeral":
+			f.posts = append(f.posts, r.Form.Get("text")+" "+r.Form.Get("blocks"))
+		case "/chat.update":
+			f.updates = append(f.updates, r.Form.Get("blocks"))
+		default:
+			t.Errorf("unexpected call to %s", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"ok": true, "channel": "C1", "ts": "2000.1", "message_ts": "2000.2"}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// pausedTurn asks for approval of a write to the warehouse and a harmless
+// echo in the same turn.
+func pausedTurn(t *testing.T, approvals *toolApprovals, handler *AnthropicMessageHandler) (*LLMResponse, toolApproval) {
+	t.Helper()
+	ctx := withToolApprovals(withThread(withChannel(context.Background(), "C1"), "1000.1"), approvals)
+	turn := anthropic.NewAssistantMessage(
+		anthropic.NewTextBlock("I'll clean that up"),
+		anthropic.NewToolUseBlock("toolu_1", map[string]string{"query": "DELETE FROM orders"}, "postgres_query"),
+		anthropic.NewToolUseBlock("toolu_2", map[string]string{"text": "hi"}, "echo"),
+	)
+	resp, err := handler.HandleMessage(ctx, assistantTurn{Message: turn}, approvals.messageStore, "1000.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approval, err := approvals.store.Pending(ctx, "1000.1")
+	if err != nil || approval == nil {
+		t.Fatalf("Pending() = %v, %v, want the paused turn", approval, err)
+	}
+	return resp, *approval
+}
+
+func newTestToolApprovals(t *testing.T, api *slack.Client) (*toolApprovals, map[string]int) {
+	t.Helper()
+	var mu sync.Mutex
+	calls := map[string]int{}
+	tool := func(name string) ToolHandler {
+		return CreateToolHandler(name, name, func(input struct{}) (*string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls[name]++
+			response := name + " ran"
+			return &response, nil
+		})
+	}
+	handler := NewAnthropicMessageHandler([]ToolHandler{tool("postgres_query"), tool("echo")})
+	approvals := newToolApprovals(newMemoryApprovalStore(), api, handler, NewSlackMessageStore(nil), newMemoryPersonaStore())
+	approvals.Require("postgres_query", alwaysApprove)
+	approvals.approvers = map[string]bool{"UADMIN": true}
+	return approvals, calls
+}
+
+func TestToolApprovals(t *testing.T) {
+	tests := []struct {
+		name        string
+		decide      func(a *toolApprovals, id string) (string, error)
+		wantMessage string
+		wantCalls   map[string]int
+		wantResults []string
+		wantCard    string
+		wantResumed bool
+	}{
+		{
+			name: "approved",
+			decide: func(a *toolApprovals, id string) (string, error) {
+				return a.Decide(context.Background(), id, true, "UADMIN", "T1")
+			},
+			wantCalls:   map[string]int{"postgres_query": 1, "echo": 1},
+			wantResults: []string{"postgres_query ran", "echo ran"},
+			wantCard:    "approved by",
+			wantResumed: true,
+		},
+		{
+			name: "rejected",
+			decide: func(a *toolApprovals, id string) (string, error) {
+				return a.Decide(context.Background(), id, false, "UADMIN", "T1")
+			},
+			wantCalls:   map[string]int{"echo": 1},
+			wantResults: []string{"Error: " + approvalRefusal(approvalRejected), "echo ran"},
+			wantCard:    "rejected by",
+			wantResumed: true,
+		},
+		{
+			name: "not an approver",
+			decide: func(a *toolApprovals, id string) (string, error) {
+				return a.Decide(context.Background(), id, true, "UBOB", "T1")
+			},
+			wantMessage: "only tool approvers can decide on tool calls",
+			wantCalls:   map[string]int{},
+		},
+		{
+			name: "conversation went on",
+			decide: func(a *toolApprovals, id string) (string, error) {
+				return "", a.Supersede(context.Background(), "1000.1", "T1")
+			},
+			wantCalls:   map[string]int{"echo": 1},
+			wantResults: []string{"Error: " + approvalRefusal(approvalExpired), "echo ran"},
+			wantCard:    "expired",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSlackCards{}
+			approvals, calls := newTestToolApprovals(t, slack.New("token", slack.OptionAPIURL(fake.server(t).URL+"/")))
+			resumed := false
+			approvals.resume = func(ctx context.Context, approval toolApproval, teamID string) { resumed = true }
+
+			resp, approval := pausedTurn(t, approvals, approvals.handler)
+			if resp.Loop || strings.TrimSpace(resp.Message) != "I'll clean that up" {
+				t.Errorf("HandleMessage() = %+v, want the text and no loop", resp)
+			}
+			if len(calls) != 0 {
+				t.Errorf("tools ran before approval: %v", calls)
+			}
+			if len(fake.posts) != 1 || !strings.Contains(fake.posts[0], approveToolActionID) || !strings.Contains(fake.posts[0], "DELETE FROM orders") {
+				t.Fatalf("posted %q, want an approval card", fake.posts)
+			}
+			if diff := cmp.Diff([]string{"toolu_1"}, approval.Pending); diff != "" {
+				t.Errorf("pending calls (-want +got):\n%s", diff)
+			}
+
+			msg, err := tt.decide(approvals, approval.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg != tt.wantMessage {
+				t.Errorf("decision message = %q, want %q", msg, tt.wantMessage)
+			}
+			if diff := cmp.Diff(tt.wantCalls, calls); diff != "" {
+				t.Errorf("tool calls (-want +got):\n%s", diff)
+			}
+			if resumed != tt.wantResumed {
+				t.Errorf("resumed = %v, want %v", resumed, tt.wantResumed)
+			}
+
+			messages := approvals.messageStore.GetMessages()["1000.1"]
+			if tt.wantResults == nil {
+				if len(messages) != 1 {
+					t.Errorf("stored %d messages, want only the paused turn", len(messages))
+				}
+				return
+			}
+			if len(messages) != 2 {
+				t.Fatalf("stored %d messages, want the turn and its tool results", len(messages))
+			}
+			results := []string{}
+			for _, block := range messages[1].Content {
+				results = append(results, block.OfToolResult.Content[0].OfText.Text)
+			}
+			if diff := cmp.Diff(tt.wantResults, results); diff != "" {
+				t.Errorf("tool results (-want +got):\n%s", diff)
+			}
+			if len(fake.updates) != 1 || !strings.Contains(fake.updates[0], tt.wantCard) || strings.Contains(fake.updates[0], approveToolActionID) {
+				t.Errorf("card updates = %q, want one without buttons saying %q", fake.updates, tt.wantCard)
+			}
+
+			// a second click changes nothing
+			msg, err = approvals.Decide(context.Background(), approval.ID, true, "UADMIN", "T1")
+			if err != nil || !strings.HasPrefix(msg, "this tool call was already") {
+				t.Errorf("second Decide() = %q, %v, want already decided", msg, err)
+			}
+		})
+	}
+}
+
+func TestToolApprovals_PersonaTools(t *testing.T) {
+	echoOnly := persona{Scope: "C1", Tools: []string{"echo"}}
+	wantResults := []string{`Error: tool "postgres_query" is not allowed here`, "echo ran"}
+	results := func(approvals *toolApprovals) []string {
+		messages := approvals.messageStore.GetMessages()["1000.1"]
+		results := []string{}
+		for _, block := range messages[len(messages)-1].Content {
+			results = append(results, block.OfToolResult.Content[0].OfText.Text)
+		}
+		return results
+	}
+
+	t.Run("disallowed calls aren't sent for approval", func(t *testing.T) {
+		fake := &fakeSlackCards{}
+		approvals, calls := newTestToolApprovals(t, slack.New("token", slack.OptionAPIURL(fake.server(t).URL+"/")))
+		ctx := withPersona(withToolApprovals(withThread(withChannel(context.Background(), "C1"), "1000.1"), approvals), &echoOnly)
+		turn := anthropic.NewAssistantMessage(
+			anthropic.NewToolUseBlock("toolu_1", map[string]string{"query": "DELETE FROM orders"}, "postgres_query"),
+			anthropic.NewToolUseBlock("toolu_2", map[string]string{"text": "hi"}, "echo"),
+		)
+		if _, err := approvals.handler.HandleMessage(ctx, assistantTurn{Message: turn}, approvals.messageStore, "1000.1"); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.posts) != 0 {
+			t.Errorf("posted %q, want no approval card", fake.posts)
+		}
+		if diff := cmp.Diff(map[string]int{"echo": 1}, calls); diff != "" {
+			t.Errorf("tool calls (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantResults, results(approvals)); diff != "" {
+			t.Errorf("tool results (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("approved calls keep the persona", func(t *testing.T) {
+		fake := &fakeSlackCards{}
+		approvals, calls := newTestToolApprovals(t, slack.New("token", slack.OptionAPIURL(fake.server(t).URL+"/")))
+		_, approval := pausedTurn(t, approvals, approvals.handler)
+		// the channel's persona stops allowing the tool before anyone clicks
+		if err := approvals.personas.Set(context.Background(), echoOnly); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := approvals.Decide(context.Background(), approval.ID, true, "UADMIN", "T1"); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(map[string]int{"echo": 1}, calls); diff != "" {
+			t.Errorf("tool calls (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantResults, results(approvals)); diff != "" {
+			t.Errorf("tool results (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func signSlackRequest(r *http.Request, secret string, body string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestToolApprovals_HandleAction(t *testing.T) {
+	fake := &fakeSlackCards{}
+	api := slack.New("token", slack.OptionAPIURL(fake.server(t).URL+"/"))
+	approvals, calls := newTestToolApprovals(t, api)
+	resumed := make(chan string, 1)
+	approvals.resume = func(ctx context.Context, approval toolApproval, teamID string) { resumed <- teamID }
+	_, approval := pausedTurn(t, approvals, approvals.handler)
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"type":    "block_actions",
+		"user":    map[string]string{"id": "UADMIN"},
+		"team":    map[string]string{"id": "T1"},
+		"channel": map[string]string{"id": "C1"},
+		"message": map[string]string{"ts": "2000.1", "thread_ts": "1000.1"},
+		"actions": []map[string]string{{"action_id": approveToolActionID, "block_id": "tool_approval", "value": approval.ID, "type": "button"}},
+	})
+	body := url.Values{"payload": {string(payload)}}.Encode()
+	router := newInteractionRouter("secret")
+	approvals.Register(router)
+
+	r := httptest.NewRequest(http.MethodPost, "/interactions", strings.NewReader(body))
+	signSlackRequest(r, "secret", body)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signed request got %d, want 200", w.Code)
+	}
+	select {
+	case teamID := <-resumed:
+		if teamID != "T1" {
+			t.Errorf("resumed for team %q, want T1", teamID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the conversation wasn't resumed")
+	}
+	if calls["postgres_query"] != 1 {
+		t.Errorf("postgres_query ran %d times, want once", calls["postgres_query"])
+	}
+}
+
+func TestPostgresApprovalStore(t *testing.T) {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store, err := newPostgresApprovalStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	defer db.Exec(`DELETE FROM agent_tool_approvals WHERE conversation_id = 'test:approvals'`)
+
+	approval := toolApproval{
+		ID:             "test-" + strconv.FormatInt(time.Now().UnixNano(), 10),
+		ConversationID: "test:approvals",
+		Channel:        "C1",
+		Thread:         "1000.1",
+		RequestedBy:    "UBOB",
+		Calls:          []toolCall{{ID: "toolu_1", Name: "postgres_query", Input: json.RawMessage(`{"query":"DELETE FROM orders"}`)}},
+		Pending:        []string{"toolu_1"},
+		Status:         approvalPending,
+	}
+	if err := store.Create(ctx, approval); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetMessage(ctx, approval.ID, "2000.1"); err != nil {
+		t.Fatal(err)
+	}
+	approval.MessageTS = "2000.1"
+	got, err := store.Pending(ctx, "test:approvals")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&approval, got); diff != "" {
+		t.Errorf("Pending() (-want +got):\n%s", diff)
+	}
+	for i, want := range []bool{true, false} {
+		decided, err := store.Decide(ctx, approval.ID, approvalApproved, "UADMIN")
+		if err != nil || decided != want {
+			t.Errorf("Decide() #%d = %v, %v, want %v", i+1, decided, err, want)
+		}
+	}
+	if got, err := store.Pending(ctx, "test:approvals"); err != nil || got != nil {
+		t.Errorf("Pending() after Decide() = %v, %v, want nil", got, err)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// inputSchemaFor builds the tool input schema for T, which must be a struct.
+//
+// Fields are named by their json tag and are required unless the tag has
+// omitempty. A `description:"..."` tag documents the field and an
+// `enum:"a,b,c"` tag restricts it to a set of values. Embedded structs,
+// []byte and time.Time are described the way encoding/json reads them.
+func inputSchemaFor[T any]() anthropic.ToolInputSchemaParam {
+	schema := jsonSchema(reflect.TypeOf((*T)(nil)).Elem())
+	inputSchema := anthropic.ToolInputSchemaParam{
+		Properties: schema["properties"],
+	}
+	if required, ok := schema["required"].([]string); ok {
+		inputSchema.Required = required
+	}
+	return inputSchema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	return typeSchema(t, map[reflect.Type]bool{})
+}
+
+// typeSchema is the schema of t. visiting holds the structs being described,
+// a struct that contains itself accepts any object the second time.
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json sends []byte as base64
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), visiting)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			return map[string]interface{}{"type": "object"}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		properties := map[string]interface{}{}
+		required := []string{}
+		structFields(t, visiting, properties, &required)
+		return map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+	default:
+		// interface{} and anything else accepts any json value
+		return map[string]interface{}{}
+	}
+}
+
+// structFields adds the fields of t to properties. Like encoding/json, the
+// fields of embedded structs without a json name are promoted, a field of t
+// wins over a promoted field with the same name.
+func structFields(t reflect.Type, visiting map[reflect.Type]bool, properties map[string]interface{}, required *[]string) {
+	embedded := []reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, hasTag := field.Tag.Lookup("json")
+		parts := strings.Split(tag, ",")
+		if parts[0] == "-" {
+			continue
+		}
+		if field.Anonymous && parts[0] == "" {
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Pointer {
+				fieldType = fieldType.Elem()
+			}
+			if fieldType.Kind() == reflect.Struct {
+				embedded = append(embedded, fieldType)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		omitempty := false
+		if hasTag {
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, opt := range parts[1:] {
+				if opt == "omitempty" {
+					omitempty = true
+				}
+			}
+		}
+
+		property := typeSchema(field.Type, visiting)
+		if description, ok := field.Tag.Lookup("description"); ok {
+			property["description"] = description
+		}
+		if enum, ok := field.Tag.Lookup("enum"); ok {
+			property["enum"] = strings.Split(enum, ",")
+		}
+		properties[name] = property
+		if !omitempty {
+			*required = append(*required, name)
+		}
+	}
+
+	for _, embeddedType := range embedded {
+		if visiting[embeddedType] {
+			continue
+		}
+		visiting[embeddedType] = true
+		promoted := map[string]interface{}{}
+		promotedRequired := []string{}
+		structFields(embeddedType, visiting, promoted, &promotedRequired)
+		delete(visiting, embeddedType)
+		for _, name := range promotedRequired {
+			if _, ok := properties[name]; !ok {
+				*required = append(*required, name)
+			}
+		}
+		for name, property := range promoted {
+			if _, ok := properties[name]; !ok {
+				properties[name] = property
+			}
+		}
+	}
+}
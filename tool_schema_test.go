@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func Test_inputSchemaFor(t *testing.T) {
+	type filter struct {
+		Column string `json:"column"`
+		Value  string `json:"value,omitempty"`
+	}
+	schema := inputSchemaFor[struct {
+		Query   string   `json:"query" description:"The query to run"`
+		Format  string   `json:"format,omitempty" enum:"json,csv"`
+		Limit   *int     `json:"limit,omitempty"`
+		Tags    []string `json:"tags,omitempty"`
+		Filter  filter   `json:"filter,omitempty"`
+		Ignored string   `json:"-"`
+		private string
+	}]()
+
+	got, err := json.Marshal(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+		"properties": {
+			"query": {"type": "string", "description": "The query to run"},
+			"format": {"type": "string", "enum": ["json", "csv"]},
+			"limit": {"type": "integer"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"filter": {
+				"type": "object",
+				"properties": {"column": {"type": "string"}, "value": {"type": "string"}},
+				"required": ["column"]
+			}
+		},
+		"required": ["query"],
+		"type": "object"
+	}`
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(wantValue, gotValue); diff != "" {
+		t.Errorf("inputSchemaFor() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+type testSchemaNode struct {
+	Name     string            `json:"name"`
+	Children []testSchemaNode  `json:"children,omitempty"`
+	Parent   *testSchemaNode   `json:"parent,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
+
+type testSchemaPage struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit"`
+}
+
+type testSchemaAudit struct {
+	At time.Time `json:"at"`
+}
+
+func Test_jsonSchema(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{
+			name:  "recursive",
+			value: testSchemaNode{},
+			want: `{
+				"type": "object",
+				"properties": {
+					"name": {"type": "string"},
+					"children": {"type": "array", "items": {"type": "object"}},
+					"parent": {"type": "object"},
+					"labels": {"type": "object", "additionalProperties": {"type": "string"}}
+				},
+				"required": ["name"]
+			}`,
+		},
+		{
+			name: "embedded",
+			value: struct {
+				testSchemaPage
+				*testSchemaAudit
+				Query string `json:"query"`
+				Limit string `json:"limit,omitempty"`
+			}{},
+			want: `{
+				"type": "object",
+				"properties": {
+					"query": {"type": "string"},
+					"limit": {"type": "string"},
+					"cursor": {"type": "string"},
+					"at": {"type": "string", "format": "date-time"}
+				},
+				"required": ["query", "at"]
+			}`,
+		},
+		{
+			name: "bytes and time",
+			value: struct {
+				Data   []byte     `json:"data"`
+				Hash   [4]byte    `json:"hash"`
+				Before *time.Time `json:"before,omitempty"`
+			}{},
+			want: `{
+				"type": "object",
+				"properties": {
+					"data": {"type": "string", "contentEncoding": "base64"},
+					"hash": {"type": "array", "items": {"type": "integer"}},
+					"before": {"type": "string", "format": "date-time"}
+				},
+				"required": ["data", "hash"]
+			}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(jsonSchema(reflect.TypeOf(tt.value)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotValue, wantValue interface{}
+			if err := json.Unmarshal(got, &gotValue); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.want), &wantValue); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(wantValue, gotValue); diff != "" {
+				t.Errorf("jsonSchema() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -1,67 +1,75 @@
 package main
 
 import (
-	"log"
-	"net/http"
-	"strconv"
+	"fmt"
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/slack-go/slack"
 )
 
-func tz(s slack.SlashCommand, w http.ResponseWriter) {
+func tz(s slack.SlashCommand) (string, error) {
 	// TODO: set default timezone
 	// TODO: set default conversion
 	// TODO: only works on military time
 
-	vals := strings.Split(s.Text, " ")
+	vals := strings.Fields(s.Text)
 
-	if vals[0] == "help" {
-		logErrMsgSlack(w, TZ_HELP)
-		return
-	} else if vals[0] == "now" {
-
-		location := vals[1]
-
-		locationOlsenTime := map[string][]string{
-			"usa": {
-				"America/New_York",
-				"America/Chicago",
-				"America/Denver",
-				"America/Phoenix",
-				"America/Los_Angeles",
-			},
-		}
-		names := locationOlsenTime[location]
-		var olsenTimes = make([]*time.Location, len(names))
+	if len(vals) == 0 || vals[0] == "help" {
+		return TZ_HELP, nil
+	}
+	if len(vals) < 2 {
+		return "", errors.New("usage: /tz <hh:mm> <zone>, /tz now usa or /tz help")
+	}
+	if vals[0] == "now" {
+		return tzNow(vals[1], time.Now())
+	}
+	return tzConvert(vals[0], vals[1])
+}
 
-		for i, name := range names {
-			timeLocation, err := time.LoadLocation(name)
-			if err != nil {
-				log.Println(err)
-			}
-			olsenTimes[i] = timeLocation
+// tzNow shows now in the time zones of location, only "usa" is known.
+func tzNow(location string, now time.Time) (string, error) {
+	locationOlsenTime := map[string][]string{
+		"usa": {
+			"America/New_York",
+			"America/Chicago",
+			"America/Denver",
+			"America/Phoenix",
+			"America/Los_Angeles",
+		},
+	}
+	names, ok := locationOlsenTime[location]
+	if !ok {
+		return "", errors.New("unknown location " + location + ", try usa")
+	}
+	var olsenTimes = make([]*time.Location, len(names))
 
+	for i, name := range names {
+		timeLocation, err := time.LoadLocation(name)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to load %s", name)
 		}
-		message := "```"
-		now := time.Now()
-		for _, olsenTime := range olsenTimes {
+		olsenTimes[i] = timeLocation
 
-			message = message + now.In(olsenTime).Format("15:04 MST ") + olsenTime.String() + "\n"
+	}
+	message := "```"
+	for _, olsenTime := range olsenTimes {
 
-		}
-		message = message + "```"
-		logErrMsgSlack(w, message)
-		return
+		message = message + now.In(olsenTime).Format("15:04 MST ") + olsenTime.String() + "\n"
 
 	}
+	message = message + "```"
+	return message, nil
+}
 
-	timeString := vals[0]
-
+// tzConvert shows timeString, a 24 hour time such as 14:30 in zoneFrom, in
+// the US time zones. zoneFrom is an abbreviation such as EST or a tz
+// database name such as Europe/Paris.
+func tzConvert(timeString string, zoneFrom string) (string, error) {
+	zoneName := zoneFrom
 	var layout = "15:04"
 
-	zoneFrom := vals[1]
 	if len(zoneFrom) == 3 {
 		// probably EST as est or something like that
 		zoneFrom = strings.ToUpper(zoneFrom)
@@ -88,18 +96,24 @@ func tz(s slack.SlashCommand, w http.ResponseWriter) {
 			"PDT": "America/Los_Angeles",
 			"PST": "America/Los_Angeles",
 		}
-		zoneFrom = abbrevOlsenLocation[zoneFrom]
+		if location, ok := abbrevOlsenLocation[zoneFrom]; ok {
+			zoneFrom = location
+		}
 	}
 
 	locationFrom, err := time.LoadLocation(zoneFrom)
 	if err != nil {
-		log.Println(err)
+		return "", errors.New(zoneName + " not a known time zone")
 	}
 
 	t, err := time.ParseInLocation(layout, timeString, locationFrom)
 	if err != nil {
-		log.Println(err)
+		return "", errors.New(timeString + " is not a time like 14:30")
 	}
+	// the parsed time is in year 0, move it to today so zones have their
+	// current offsets
+	today := time.Now().In(locationFrom)
+	t = time.Date(today.Year(), today.Month(), today.Day(), t.Hour(), t.Minute(), 0, 0, locationFrom)
 
 	names := []string{
 		"America/New_York",
@@ -113,7 +127,7 @@ func tz(s slack.SlashCommand, w http.ResponseWriter) {
 	for i, name := range names {
 		timeLocation, err := time.LoadLocation(name)
 		if err != nil {
-			log.Println(err)
+			return "", errors.Wrapf(err, "failed to load %s", name)
 		}
 		olsenTimes[i] = timeLocation
 
@@ -127,10 +141,9 @@ func tz(s slack.SlashCommand, w http.ResponseWriter) {
 	}
 	message := "```\n"
 	for _, olsenTime := range olsenTimes {
-		message = message + strconv.Itoa(t.In(olsenTime).Hour()) + ":" + strconv.Itoa(t.Minute()) + " " + olsenLocationAbbrev[olsenTime.String()] + " " + olsenTime.String() + "\n"
+		message = message + fmt.Sprintf("%d:%02d ", t.In(olsenTime).Hour(), t.In(olsenTime).Minute()) + olsenLocationAbbrev[olsenTime.String()] + " " + olsenTime.String() + "\n"
 	}
 
 	message = message + "```"
-	logErrMsgSlack(w, message)
-
+	return message, nil
 }
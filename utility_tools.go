@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// anagramToolMaxResults caps the anagrams returned to the model, 8 letters
+// can spell thousands.
+const anagramToolMaxResults = 200
+
+// utilityTools are the slash command utilities as agent tools, they call
+// the same functions as the commands in newSlashCommands.
+func utilityTools(streakTable StreakTable) []ToolHandler {
+	return []ToolHandler{
+		CreateToolHandler("convert", "Convert a value between units, such as miles to km or fahrenheit to celsius. Units are given by name or symbol.", func(input struct {
+			Value float64 `json:"value" description:"The value to convert"`
+			From  string  `json:"from" description:"The unit of value, for example mile or mi"`
+			To    string  `json:"to" description:"The unit to convert to, for example kilometer or km"`
+		}) (*string, error) {
+			response, err := describeConversion(input.Value, input.From, input.To)
+			if err != nil {
+				return nil, err
+			}
+			return &response, nil
+		}),
+		CreateToolHandler("tz", "Show a time in the US time zones: Eastern, Central, Mountain, Arizona and Pacific. Leave time out for the current time there.", func(input struct {
+			Time string `json:"time,omitempty" description:"A 24 hour time such as 14:30"`
+			Zone string `json:"zone,omitempty" description:"The time zone of time, an abbreviation such as EST or PDT or a tz database name such as Europe/Paris"`
+		}) (*string, error) {
+			var response string
+			var err error
+			if input.Time == "" {
+				response, err = tzNow("usa", time.Now())
+			} else if input.Zone == "" {
+				return nil, errors.New("zone is needed with time")
+			} else {
+				response, err = tzConvert(input.Time, input.Zone)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &response, nil
+		}),
+		CreateToolHandler("roll", "Roll a die, returns a random number between 1 and sides.", func(input struct {
+			Sides int `json:"sides" description:"The number of sides, for example 6 or 20"`
+		}) (*string, error) {
+			n, err := rollDie(input.Sides)
+			if err != nil {
+				return nil, err
+			}
+			response := strconv.Itoa(n)
+			return &response, nil
+		}),
+		CreateToolHandler("choose", "Pick one of the options at random, optionally weighted.", func(input struct {
+			Options []string `json:"options" description:"The options to pick from"`
+			Weights []int    `json:"weights,omitempty" description:"A weight for each option, an option with weight 3 is three times as likely as one with weight 1"`
+		}) (*string, error) {
+			var response string
+			var err error
+			if len(input.Weights) == 0 {
+				response, err = chooseOne(input.Options)
+			} else if len(input.Weights) != len(input.Options) {
+				return nil, errors.Errorf("got %d weights for %d options", len(input.Weights), len(input.Options))
+			} else {
+				choices := make([]weightedChoice, len(input.Options))
+				for i, option := range input.Options {
+					choices[i] = weightedChoice{choice: option, weight: input.Weights[i]}
+				}
+				response, err = chooseWeighted(choices)
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &response, nil
+		}),
+		CreateToolHandler("sha256", "Hex encoded SHA-256 digest of the text.", func(input struct {
+			Text string `json:"text" description:"The text to hash"`
+		}) (*string, error) {
+			response := sha256Hex(input.Text)
+			return &response, nil
+		}),
+		CreateToolHandler("base64", "Base64 encode text, or decode it.", func(input struct {
+			Text   string `json:"text" description:"The text to encode or decode"`
+			Decode bool   `json:"decode,omitempty" description:"Decode text instead of encoding it"`
+		}) (*string, error) {
+			if !input.Decode {
+				response := base64Encode(input.Text)
+				return &response, nil
+			}
+			response, err := base64Decode(input.Text)
+			if err != nil {
+				return nil, err
+			}
+			return &response, nil
+		}),
+		CreateToolHandler("anagram", "Find every way to spell the letters as one or more English words, one per line. At most 8 letters.", func(input struct {
+			Letters string `json:"letters" description:"The letters to rearrange, such as listen"`
+		}) (*string, error) {
+			anagrams, err := findAnagrams(input.Letters)
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(anagrams)
+			note := ""
+			if len(anagrams) > anagramToolMaxResults {
+				note = fmt.Sprintf("\n(%d more not shown)", len(anagrams)-anagramToolMaxResults)
+				anagrams = anagrams[:anagramToolMaxResults]
+			}
+			if len(anagrams) == 0 {
+				response := "no anagrams found"
+				return &response, nil
+			}
+			response := strings.Join(anagrams, "\n") + note
+			return &response, nil
+		}),
+		CreateContextToolHandler("streaks", "List the streaks of the user who sent the message and how many days each has run. Users start streaks with /streak add <name>.", func(ctx context.Context, input struct{}) (*string, error) {
+			user := userFromContext(ctx)
+			if user == "" {
+				return nil, errors.New("don't know which user is asking")
+			}
+			response, err := listStreaks(streakTable, user)
+			if err != nil {
+				return nil, err
+			}
+			if response == "" {
+				response = "no streaks"
+			}
+			return &response, nil
+		}),
+	}
+}
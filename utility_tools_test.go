@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func Test_utilityTools(t *testing.T) {
+	tools := map[string]ToolHandler{}
+	for _, tool := range utilityTools(StreakTable{}) {
+		tools[tool.GetName()] = tool
+	}
+	slashConvert, _ := convert(slack.SlashCommand{Text: "5 mile km"})
+	slashTZ, _ := tz(slack.SlashCommand{Text: "14:30 est"})
+
+	tests := []struct {
+		tool    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{tool: "convert", input: `{"value": 5, "from": "mile", "to": "km"}`, want: slashConvert},
+		{tool: "convert", input: `{"value": 5, "from": "parsec", "to": "km"}`, wantErr: "parsec not valid unit"},
+		{tool: "tz", input: `{"time": "14:30", "zone": "est"}`, want: slashTZ},
+		{tool: "tz", input: `{"time": "14:30"}`, wantErr: "zone is needed"},
+		{tool: "roll", input: `{"sides": 1}`, want: "1"},
+		{tool: "roll", input: `{"sides": 0}`, wantErr: "greater than 0"},
+		{tool: "choose", input: `{"options": ["pizza"]}`, want: "pizza"},
+		{tool: "choose", input: `{"options": ["pizza", "tacos"], "weights": [0, 2]}`, want: "tacos"},
+		{tool: "choose", input: `{"options": ["pizza", "tacos"], "weights": [1]}`, wantErr: "got 1 weights for 2 options"},
+		{tool: "choose", input: `{"options": []}`, wantErr: "nothing to choose from"},
+		{tool: "sha256", input: `{"text": "hello"}`, want: "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"},
+		{tool: "base64", input: `{"text": "foo"}`, want: b64(slack.SlashCommand{Text: "foo"})},
+		{tool: "base64", input: `{"text": "Zm9v", "decode": true}`, want: "foo"},
+		{tool: "base64", input: `{"text": "not base64!", "decode": true}`, wantErr: "illegal base64 data"},
+		{tool: "anagram", input: `{"letters": "toolongword"}`, wantErr: "max 8 chars"},
+		{tool: "streaks", input: `{}`, wantErr: "don't know which user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tool+" "+tt.input, func(t *testing.T) {
+			tool, ok := tools[tt.tool]
+			if !ok {
+				t.Fatalf("no %s tool", tt.tool)
+			}
+			got, err := tool.HandleTool(context.Background(), json.RawMessage(tt.input))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("HandleTool() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("HandleTool() = %q, want %q", *got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_anagramTool(t *testing.T) {
+	var anagram ToolHandler
+	for _, tool := range utilityTools(StreakTable{}) {
+		if tool.GetName() == "anagram" {
+			anagram = tool
+		}
+	}
+	got, err := anagram.HandleTool(context.Background(), json.RawMessage(`{"letters": "tca"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"act", "cat"} {
+		if !strings.Contains("\n"+*got+"\n", "\n"+want+"\n") {
+			t.Errorf("anagrams of tca = %q, want %s among them", *got, want)
+		}
+	}
+}
+
+func Test_tzConvert(t *testing.T) {
+	tests := []struct {
+		time    string
+		zone    string
+		want    []string
+		wantErr bool
+	}{
+		{time: "14:30", zone: "America/New_York", want: []string{"14:30 EDT/EST America/New_York", ":30 PDT/PST America/Los_Angeles"}},
+		{time: "09:05", zone: "utc", want: []string{":05 EDT/EST America/New_York"}},
+		{time: "14:30", zone: "xyz", wantErr: true},
+		{time: "2pm", zone: "est", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.time+" "+tt.zone, func(t *testing.T) {
+			got, err := tzConvert(tt.time, tt.zone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tzConvert() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("tzConvert() = %q, want it to contain %q", got, want)
+				}
+			}
+		})
+	}
+}
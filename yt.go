@@ -2,13 +2,12 @@ package main
 
 import (
 	"fmt"
-	"net/http"
 	"strings"
 
 	"github.com/slack-go/slack"
 )
 
-func yt(s slack.SlashCommand, w http.ResponseWriter) {
+func yt(s slack.SlashCommand) string {
 	// TODO: would be nice to handle https://www.youtube.com/c/STLChessClub/videos
 	// style links too
 	var msg string
@@ -29,5 +28,5 @@ func yt(s slack.SlashCommand, w http.ResponseWriter) {
 	} else {
 		msg = fmt.Sprintf("url format not recognised for %s", s.Text)
 	}
-	logErrMsgSlack(w, msg)
+	return msg
 }